@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"math/rand"
+	"os"
+	"time"
+)
+
+type BenchCmd struct {
+	Path        string     `arg:"" name:"path" help:"Directory to sample files from." type:"path"`
+	Sample      byteSize   `help:"Amount of data each setting hashes, e.g. 256M." placeholder:"SIZE" default:"256M"`
+	Workers     []int      `short:"j" help:"Worker counts to try." placeholder:"N,..." default:"1,2,4,8"`
+	BufferSizes []byteSize `help:"Read buffer sizes to try." placeholder:"SIZE,..." default:"32K,256K,1M,4M"`
+	Hashes      []string   `help:"Hash algorithms to try (${enum})." enum:"sha256,sha1,blake3,xxhash64" placeholder:"ALGORITHM,..." default:"sha256,blake3,xxhash64,sha1"`
+	DirectIO    bool       `help:"Read files with direct I/O, as with --direct-io when indexing (Linux only)."`
+
+	WalkOptions `embed:""`
+}
+
+// benchSetting is one combination of settings tried by bench.
+type benchSetting struct {
+	workers   int
+	buffer    byteSize
+	algorithm string
+}
+
+// benchResult is the outcome of hashing a share of the sample with a
+// setting.
+type benchResult struct {
+	files   int64
+	bytes   int64
+	elapsed time.Duration
+}
+
+func (r benchResult) throughput() float64 {
+	return float64(r.bytes) / r.elapsed.Seconds()
+}
+
+func (b *BenchCmd) Run(ctx *Context) error {
+
+	walker, err := b.walker()
+	if err != nil {
+		return err
+	}
+	if b.Sample <= 0 {
+		return errors.New("--sample must be positive")
+	}
+	if len(b.Workers) == 0 || len(b.BufferSizes) == 0 || len(b.Hashes) == 0 {
+		return errors.New("--workers, --buffer-sizes and --hashes need at least one value each")
+	}
+
+	// worker counts are tried first, then buffer sizes with the fastest
+	// count, then algorithms with the fastest of both
+	runs := len(b.Workers) + len(b.BufferSizes) + len(b.Hashes)
+	shares, reused, err := b.sample(walker, runs)
+	if err != nil {
+		return err
+	}
+	if reused {
+		dupfind.Log.Warnf("Warning: %s holds less than %s of files, so files are read more than once and may come from the page cache", b.Path, formatBytes(int64(b.Sample)*int64(runs)))
+	}
+
+	fmt.Printf("%-8s %-10s %-9s %8s %10s %9s %12s\n", "workers", "buffer", "hash", "files", "read", "time", "throughput")
+	best := benchSetting{workers: b.Workers[0], buffer: b.BufferSizes[0], algorithm: b.Hashes[0]}
+	run := 0
+	try := func(setting benchSetting) (benchResult, error) {
+		result, err := benchHash(ctx, shares[run], setting, b.DirectIO)
+		run++
+		if err != nil {
+			return result, err
+		}
+		fmt.Printf("%-8d %-10s %-9s %8d %10s %8.2fs %10s/s\n", setting.workers, formatBytes(int64(setting.buffer)), setting.algorithm,
+			result.files, formatBytes(result.bytes), result.elapsed.Seconds(), formatBytes(int64(result.throughput())))
+		return result, nil
+	}
+
+	var fastest float64
+	for _, workers := range b.Workers {
+		result, err := try(benchSetting{workers: workers, buffer: best.buffer, algorithm: best.algorithm})
+		if err != nil {
+			return err
+		}
+		if result.throughput() > fastest {
+			fastest, best.workers = result.throughput(), workers
+		}
+	}
+	fastest = 0
+	for _, buffer := range b.BufferSizes {
+		result, err := try(benchSetting{workers: best.workers, buffer: buffer, algorithm: best.algorithm})
+		if err != nil {
+			return err
+		}
+		if result.throughput() > fastest {
+			fastest, best.buffer = result.throughput(), buffer
+		}
+	}
+	fastest = 0
+	for _, algorithm := range b.Hashes {
+		result, err := try(benchSetting{workers: best.workers, buffer: best.buffer, algorithm: algorithm})
+		if err != nil {
+			return err
+		}
+		if result.throughput() > fastest {
+			fastest, best.algorithm = result.throughput(), algorithm
+		}
+	}
+
+	fmt.Printf("\nFastest: -j %d --read-buffer %s --hash %s (%s/s)\n", best.workers, flagSize(best.buffer), best.algorithm, formatBytes(int64(fastest)))
+
+	return nil
+}
+
+// sample picks files below the path in random order and splits them into
+// runs shares of about --sample bytes each, so that no setting reads files
+// another one has just read. It reports whether there were too few files
+// and some are shared.
+func (b *BenchCmd) sample(walker *dupfind.Walker, runs int) ([][]string, bool, error) {
+
+	var paths []string
+	var sizes []int64
+	err := walker.Walk(b.Path, nil, func(path string, info os.FileInfo) error {
+		if info.Mode().IsRegular() && info.Size() > 0 {
+			paths = append(paths, path)
+			sizes = append(sizes, info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(paths) == 0 {
+		return nil, false, fmt.Errorf("no files to sample below %s", b.Path)
+	}
+	order := rand.New(rand.NewSource(time.Now().UnixNano())).Perm(len(paths))
+
+	shares := make([][]string, runs)
+	next, reused := 0, false
+	for i := range shares {
+		var size int64
+		for size < int64(b.Sample) && len(shares[i]) < len(paths) {
+			if next == len(order) {
+				next, reused = 0, true
+			}
+			shares[i] = append(shares[i], paths[order[next]])
+			size += sizes[order[next]]
+			next++
+		}
+	}
+
+	return shares, reused, nil
+}
+
+// flagSize formats size as it is given on the command line.
+func flagSize(size byteSize) string {
+	switch {
+	case size%(1<<20) == 0:
+		return fmt.Sprintf("%dM", size>>20)
+	case size%(1<<10) == 0:
+		return fmt.Sprintf("%dK", size>>10)
+	default:
+		return fmt.Sprintf("%d", size)
+	}
+}
+
+// benchHash hashes paths with setting and measures how long it takes.
+func benchHash(ctx *Context, paths []string, setting benchSetting, directIO bool) (benchResult, error) {
+
+	hasher, err := dupfind.NewHasher(setting.algorithm, nil)
+	if err != nil {
+		return benchResult{}, err
+	}
+	hasher.BufferSize, hasher.DirectIO = int(setting.buffer), directIO
+	stats := newScanStats(ctx)
+
+	start := time.Now()
+	queue := make(chan string)
+	go func() {
+		defer close(queue)
+		for _, path := range paths {
+			queue <- path
+		}
+	}()
+	for range dupfind.HashFilePaths(queue, setting.workers, hasher, nil, stats) {
+	}
+
+	result := benchResult{files: stats.Files.Load(), bytes: stats.Hashed.Load(), elapsed: time.Since(start)}
+	return result, stats.Err()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"strings"
+)
+
+type CheckIndexCmd struct {
+	Index        string `arg:"" optional:"" help:"Index file to check (default: the index set in the config file)." type:"path"`
+	Repair       bool   `help:"Record each path once, keeping its last record as merge does. Checksum collisions and invalid checksums are left for verify and update."`
+	OutputFormat string `help:"Output format (${enum})." enum:"text,json" default:"text"`
+
+	SignOptions `embed:""`
+}
+
+func (c *CheckIndexCmd) Run(ctx *Context) error {
+
+	var err error
+	if c.Index, err = ctx.indexFile(c.Index); err != nil {
+		return err
+	}
+	key, err := c.signingKey()
+	if err != nil {
+		return err
+	}
+	header, records, err := dupfind.ReadIndex(c.Index)
+	if err != nil {
+		return err
+	}
+	problems := dupfind.CheckRecords(records)
+
+	// with JSON output, the summary goes to stderr
+	out := os.Stdout
+	if c.OutputFormat == "json" {
+		out = os.Stderr
+		if problems == nil {
+			problems = []dupfind.IndexProblem{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(problems); err != nil {
+			return err
+		}
+	} else {
+		for _, problem := range problems {
+			fmt.Printf("%-10s %s", strings.ToUpper(problem.Kind), problem.Path)
+			if problem.Other != "" {
+				fmt.Printf(" and %s", problem.Other)
+			}
+			fmt.Printf(": %s\n", problem.Detail)
+		}
+	}
+	counts := make(map[string]int)
+	for _, problem := range problems {
+		counts[problem.Kind]++
+	}
+	fmt.Fprintf(out, "Checked %d records: %d duplicate paths, %d conflicting paths, %d checksum collisions, %d invalid checksums.\n",
+		len(records), counts[dupfind.ProblemDuplicate], counts[dupfind.ProblemConflict], counts[dupfind.ProblemCollision], counts[dupfind.ProblemChecksum])
+
+	remaining := len(problems)
+	if c.Repair && counts[dupfind.ProblemDuplicate]+counts[dupfind.ProblemConflict] > 0 {
+		unique, dropped := dupfind.UniqueRecords(records)
+		if err := dupfind.OpenStore(c.Index).Write(header, unique); err != nil {
+			return fmt.Errorf("writing index %s: %w", c.Index, err)
+		}
+		if err := finishIndex(c.Index, key); err != nil {
+			return err
+		}
+		remaining -= counts[dupfind.ProblemDuplicate] + counts[dupfind.ProblemConflict]
+		fmt.Fprintf(out, "Repaired %s: dropped %d records of paths recorded more than once.\n", c.Index, dropped)
+	}
+	if remaining > 0 {
+		return &exitStatus{code: 1}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"sort"
+)
+
+type CompareCmd struct {
+	A       string `arg:"" name:"a" help:"Index file." type:"path"`
+	B       string `arg:"" name:"b" help:"Index file to compare with." type:"path"`
+	Both    bool   `help:"Also list the content that is in both indexes."`
+	Summary bool   `help:"Only print the totals, not the files."`
+}
+
+// contentTotals counts distinct checksums and the size of one file with
+// each.
+type contentTotals struct {
+	contents int
+	bytes    int64
+}
+
+func (t *contentTotals) add(records []dupfind.Metadata) {
+	t.contents++
+	t.bytes += records[0].Size
+}
+
+func (c *CompareCmd) Run(ctx *Context) error {
+
+	a, err := indexContents(c.A)
+	if err != nil {
+		return err
+	}
+	b, err := indexContents(c.B)
+	if err != nil {
+		return err
+	}
+	if algorithmsA, algorithmsB := contentAlgorithms(a), contentAlgorithms(b); len(algorithmsA) > 0 && len(algorithmsB) > 0 && !sharesKey(algorithmsA, algorithmsB) {
+		return fmt.Errorf("%s and %s were built with different hash algorithms and cannot be compared", c.A, c.B)
+	}
+
+	var keys []string
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	// list contents by the path of their first copy
+	first := func(key string) string {
+		if records, ok := a[key]; ok {
+			return records[0].Path
+		}
+		return b[key][0].Path
+	}
+	sort.Slice(keys, func(i, j int) bool { return first(keys[i]) < first(keys[j]) })
+
+	var both, onlyA, onlyB contentTotals
+	for _, key := range keys {
+		ra, inA := a[key]
+		rb, inB := b[key]
+		switch {
+		case inA && inB:
+			both.add(ra)
+			if c.Both && !c.Summary {
+				fmt.Printf("In both: %s = %s%s\n", ra[0].Path, rb[0].Path, otherCopies(len(ra)+len(rb)-2))
+			}
+		case inA:
+			onlyA.add(ra)
+			if !c.Summary {
+				fmt.Printf("Only in %s: %s%s\n", c.A, ra[0].Path, otherCopies(len(ra)-1))
+			}
+		default:
+			onlyB.add(rb)
+			if !c.Summary {
+				fmt.Printf("Only in %s: %s%s\n", c.B, rb[0].Path, otherCopies(len(rb)-1))
+			}
+		}
+	}
+
+	if !c.Summary && len(keys) > 0 {
+		fmt.Println()
+	}
+	fmt.Printf("In both: %d checksums, %s\n", both.contents, formatBytes(both.bytes))
+	fmt.Printf("Only in %s: %d checksums, %s\n", c.A, onlyA.contents, formatBytes(onlyA.bytes))
+	fmt.Printf("Only in %s: %d checksums, %s\n", c.B, onlyB.contents, formatBytes(onlyB.bytes))
+
+	if onlyA.contents > 0 || onlyB.contents > 0 {
+		return fmt.Errorf("indexes differ")
+	}
+	return nil
+}
+
+// indexContents reads the index at path and groups its records by
+// checksum key, each group sorted by path.
+func indexContents(path string) (map[string][]dupfind.Metadata, error) {
+
+	header, records, err := dupfind.ReadIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	warnPartial(path, header)
+	contents := make(map[string][]dupfind.Metadata)
+	for _, record := range dupfind.RootRecords(header, records, "") {
+		if dupfind.IsSpecial(record.Mode) {
+			continue
+		}
+		key := dupfind.ChecksumKey(record.Algorithm, record.Checksum)
+		contents[key] = append(contents[key], record)
+	}
+	for _, group := range contents {
+		sort.Slice(group, func(i, j int) bool { return group[i].Path < group[j].Path })
+	}
+
+	return contents, nil
+}
+
+// contentAlgorithms returns the hash algorithms of the contents.
+func contentAlgorithms(contents map[string][]dupfind.Metadata) map[string]bool {
+	algorithms := make(map[string]bool)
+	for _, group := range contents {
+		algorithms[dupfind.RecordAlgorithm(group[0])] = true
+	}
+	return algorithms
+}
+
+func sharesKey(a, b map[string]bool) bool {
+	for key := range a {
+		if b[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// otherCopies notes how many more copies of a content there are.
+func otherCopies(n int) string {
+	switch n {
+	case 0:
+		return ""
+	case 1:
+		return " (and 1 other copy)"
+	default:
+		return fmt.Sprintf(" (and %d other copies)", n)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"github.com/alecthomas/kong"
+	"io"
+	"os"
+	"strings"
+)
+
+type CompletionCmd struct {
+	Shell string `arg:"" help:"Shell to complete in (${enum})." enum:"bash,zsh,fish"`
+}
+
+// Run prints a completion script generated from the same command and flag
+// definitions as --help, so that it never lags behind them.
+func (c *CompletionCmd) Run(k *kong.Context) error {
+
+	app := k.Model
+	switch c.Shell {
+	case "bash":
+		return writeBashCompletion(os.Stdout, app)
+	case "zsh":
+		return writeZshCompletion(os.Stdout, app)
+	default:
+		return writeFishCompletion(os.Stdout, app)
+	}
+}
+
+// visibleCommands returns the commands listed by --help, with those that
+// only group subcommands, in the order they are defined.
+func visibleCommands(app *kong.Application) []*kong.Node {
+	var commands []*kong.Node
+	var visit func(node *kong.Node)
+	visit = func(node *kong.Node) {
+		for _, child := range node.Children {
+			if child.Type == kong.CommandNode && !child.Hidden {
+				commands = append(commands, child)
+				visit(child)
+			}
+		}
+	}
+	visit(app.Node)
+	return commands
+}
+
+// subcommands returns the commands directly below node.
+func subcommands(node *kong.Node) []*kong.Node {
+	var commands []*kong.Node
+	for _, child := range node.Children {
+		if child.Type == kong.CommandNode && !child.Hidden {
+			commands = append(commands, child)
+		}
+	}
+	return commands
+}
+
+// commandPath returns the words that select command, such as client find.
+func commandPath(command *kong.Node) string {
+	if command.Parent == nil || command.Parent.Type == kong.ApplicationNode {
+		return command.Name
+	}
+	return commandPath(command.Parent) + " " + command.Name
+}
+
+// ownFlags returns the flags of node listed by --help, without those of
+// the commands it is below. Those of the application are global.
+func ownFlags(node *kong.Node) []*kong.Flag {
+	var flags []*kong.Flag
+	for _, flag := range node.Flags {
+		if !flag.Hidden {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+// visibleFlags returns the flags of command listed by --help, with those
+// of the commands it is below but without the global ones.
+func visibleFlags(command *kong.Node) []*kong.Flag {
+	var flags []*kong.Flag
+	if command.Parent.Type != kong.ApplicationNode {
+		flags = visibleFlags(command.Parent)
+	}
+	return append(flags, ownFlags(command)...)
+}
+
+// takesFile reports whether value names a file or directory.
+func takesFile(value *kong.Value) bool {
+	switch value.Tag.Type {
+	case "path", "existingfile", "existingdir", "source":
+		return true
+	}
+	return value.Flag != nil && (value.Flag.PlaceHolder == "FILE" || value.Flag.PlaceHolder == "DIR")
+}
+
+// enumValues returns the values an enum flag accepts, without the empty one.
+func enumValues(flag *kong.Flag) []string {
+	var values []string
+	if flag.Enum == "" {
+		return nil
+	}
+	for _, value := range flag.EnumSlice() {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// flagWords returns the words that give flag on the command line.
+func flagWords(flag *kong.Flag) []string {
+	words := []string{"--" + flag.Name}
+	if flag.Short != 0 {
+		words = append(words, "-"+string(flag.Short))
+	}
+	if flag.Tag.Negatable {
+		words = append(words, "--no-"+flag.Name)
+	}
+	return words
+}
+
+// firstSentence shortens help to its first sentence, for shells that show
+// flag descriptions next to each other.
+func firstSentence(help string) string {
+	if i := strings.Index(help, ". "); i >= 0 {
+		return help[:i]
+	}
+	return strings.TrimSuffix(help, ".")
+}
+
+func writeBashCompletion(w io.Writer, app *kong.Application) error {
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for %s, generated by %s completion bash\n\n", app.Name, app.Name)
+	fmt.Fprintf(&b, "_%s() {\n", app.Name)
+	b.WriteString("\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}\n")
+	b.WriteString("\tlocal cmd word flags commands\n\n")
+
+	// the command is given by the words that name a command below the
+	// previous ones
+	var patterns []string
+	for _, command := range visibleCommands(app) {
+		parent := ""
+		if command.Parent.Type != kong.ApplicationNode {
+			parent = commandPath(command.Parent)
+		}
+		patterns = append(patterns, fmt.Sprintf("%q", parent+":"+command.Name))
+	}
+	b.WriteString("\tfor word in \"${COMP_WORDS[@]:1:COMP_CWORD-1}\"; do\n")
+	b.WriteString("\t\tcase \"$cmd:$word\" in\n")
+	fmt.Fprintf(&b, "\t\t%s) cmd=${cmd:+$cmd }$word ;;\n", strings.Join(patterns, "|"))
+	b.WriteString("\t\tesac\n")
+	b.WriteString("\tdone\n\n")
+
+	// the values of enum flags are completed, those of others are files
+	writeNode := func(indent string, flags []*kong.Flag, commands []*kong.Node) {
+		var words, cases []string
+		for _, flag := range flags {
+			words = append(words, flagWords(flag)...)
+			if values := enumValues(flag); len(values) > 0 {
+				cases = append(cases, fmt.Sprintf("%s%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n",
+					indent, strings.Join(flagWords(flag), "|"), strings.Join(values, " ")))
+			}
+		}
+		if len(cases) > 0 {
+			b.WriteString(indent + "case $prev in\n")
+			b.WriteString(strings.Join(cases, ""))
+			b.WriteString(indent + "esac\n")
+		}
+		if len(words) > 0 {
+			fmt.Fprintf(&b, "%sflags=\"$flags %s\"\n", indent, strings.Join(words, " "))
+		}
+		var names []string
+		for _, command := range commands {
+			names = append(names, command.Name)
+		}
+		if len(names) > 0 {
+			fmt.Fprintf(&b, "%scommands=%q\n", indent, strings.Join(names, " "))
+		}
+	}
+	b.WriteString("\tcase $cmd in\n")
+	b.WriteString("\t\"\")\n")
+	writeNode("\t\t", nil, subcommands(app.Node))
+	b.WriteString("\t\t;;\n")
+	for _, command := range visibleCommands(app) {
+		fmt.Fprintf(&b, "\t%q)\n", commandPath(command))
+		writeNode("\t\t", visibleFlags(command), subcommands(command))
+		b.WriteString("\t\t;;\n")
+	}
+	b.WriteString("\tesac\n")
+	writeNode("\t", ownFlags(app.Node), nil)
+	b.WriteString("\n")
+
+	b.WriteString("\tif [[ $cur == -* ]]; then\n")
+	b.WriteString("\t\tCOMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n")
+	b.WriteString("\telif [[ -n $commands ]]; then\n")
+	b.WriteString("\t\tCOMPREPLY=($(compgen -W \"$commands\" -- \"$cur\"))\n")
+	b.WriteString("\tfi\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "complete -o default -F _%s %s\n", app.Name, app.Name)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// zshQuote quotes s for a single-quoted _arguments spec, escaping the
+// brackets that end a description.
+func zshQuote(s string) string {
+	s = strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+	return strings.ReplaceAll(s, "'", `'\''`)
+}
+
+// zshSpecs returns the _arguments specs of flags.
+func zshSpecs(flags []*kong.Flag) []string {
+
+	var specs []string
+	for _, flag := range flags {
+		help := zshQuote(firstSentence(flag.Help))
+		var action string
+		if !flag.IsBool() && !flag.IsCounter() {
+			action = ":" + zshQuote(flag.FormatPlaceHolder()) + ":"
+			if values := enumValues(flag); len(values) > 0 {
+				action += "(" + strings.Join(values, " ") + ")"
+			} else if takesFile(flag.Value) {
+				action += "_files"
+			}
+		}
+		repeat := ""
+		if flag.IsSlice() || flag.IsMap() || flag.IsCounter() {
+			repeat = "*"
+		}
+		long := "--" + flag.Name
+		if !flag.IsBool() && !flag.IsCounter() {
+			long += "="
+		}
+		if flag.Short != 0 {
+			short := "-" + string(flag.Short)
+			if !flag.IsBool() && !flag.IsCounter() {
+				short += "+"
+			}
+			exclude := ""
+			if repeat == "" {
+				exclude = fmt.Sprintf("(-%c --%s)", flag.Short, flag.Name)
+			}
+			specs = append(specs, fmt.Sprintf("'%s%s'{%s,%s}'[%s]%s'", repeat, exclude, short, long, help, action))
+		} else {
+			specs = append(specs, fmt.Sprintf("'%s%s[%s]%s'", repeat, long, help, action))
+		}
+		if flag.Tag.Negatable {
+			specs = append(specs, fmt.Sprintf("'--no-%s[%s]'", flag.Name, help))
+		}
+	}
+
+	return specs
+}
+
+// zshFunction returns the name of the function completing the arguments
+// of node.
+func zshFunction(app *kong.Application, node *kong.Node) string {
+	if node == app.Node {
+		return "_" + app.Name
+	}
+	return "_" + app.Name + "_" + strings.NewReplacer(" ", "_", "-", "_").Replace(commandPath(node))
+}
+
+// writeZshFunction writes the function completing the arguments of node,
+// whose flags are flags, and those of the commands below it.
+func writeZshFunction(b *strings.Builder, app *kong.Application, node *kong.Node, flags []*kong.Flag) {
+
+	commands := subcommands(node)
+	fmt.Fprintf(b, "%s() {\n", zshFunction(app, node))
+	if len(commands) == 0 {
+		b.WriteString("\t_arguments \\\n")
+		for _, spec := range zshSpecs(flags) {
+			fmt.Fprintf(b, "\t\t%s \\\n", spec)
+		}
+		b.WriteString("\t\t'*:file:_files'\n")
+		b.WriteString("}\n\n")
+		return
+	}
+
+	b.WriteString("\tlocal state line\n")
+	b.WriteString("\tlocal -a commands\n")
+	b.WriteString("\tcommands=(\n")
+	for _, command := range commands {
+		fmt.Fprintf(b, "\t\t'%s:%s'\n", command.Name, strings.ReplaceAll(command.Help, "'", `'\''`))
+	}
+	b.WriteString("\t)\n")
+	b.WriteString("\t_arguments -C \\\n")
+	for _, spec := range zshSpecs(flags) {
+		fmt.Fprintf(b, "\t\t%s \\\n", spec)
+	}
+	b.WriteString("\t\t'1:command:->command' \\\n")
+	b.WriteString("\t\t'*::argument:->argument'\n")
+	b.WriteString("\tcase $state in\n")
+	b.WriteString("\tcommand)\n")
+	b.WriteString("\t\t_describe command commands\n")
+	b.WriteString("\t\t;;\n")
+	b.WriteString("\targument)\n")
+	b.WriteString("\t\tcase $line[1] in\n")
+	for _, command := range commands {
+		fmt.Fprintf(b, "\t\t%s) %s ;;\n", command.Name, zshFunction(app, command))
+	}
+	b.WriteString("\t\tesac\n")
+	b.WriteString("\t\t;;\n")
+	b.WriteString("\tesac\n")
+	b.WriteString("}\n\n")
+
+	for _, command := range commands {
+		// the words before the command are not passed on, nor are its
+		// parents' flags
+		writeZshFunction(b, app, command, ownFlags(command))
+	}
+}
+
+func writeZshCompletion(w io.Writer, app *kong.Application) error {
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n\n", app.Name)
+	fmt.Fprintf(&b, "# zsh completion for %s, generated by %s completion zsh\n\n", app.Name, app.Name)
+	writeZshFunction(&b, app, app.Node, ownFlags(app.Node))
+	fmt.Fprintf(&b, "_%s \"$@\"\n", app.Name)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// fishQuote quotes s as a single-quoted fish string.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// fishFlags writes the complete commands of flags, offered if condition
+// holds.
+func fishFlags(b *strings.Builder, name, condition string, flags []*kong.Flag) {
+	for _, flag := range flags {
+		fmt.Fprintf(b, "complete -c %s", name)
+		if condition != "" {
+			fmt.Fprintf(b, " -n \"%s\"", condition)
+		}
+		if flag.Short != 0 {
+			fmt.Fprintf(b, " -s %c", flag.Short)
+		}
+		fmt.Fprintf(b, " -l %s", flag.Name)
+		if !flag.IsBool() && !flag.IsCounter() {
+			if values := enumValues(flag); len(values) > 0 {
+				fmt.Fprintf(b, " -x -a %s", fishQuote(strings.Join(values, " ")))
+			} else if takesFile(flag.Value) {
+				b.WriteString(" -r -F")
+			} else {
+				b.WriteString(" -x")
+			}
+		}
+		fmt.Fprintf(b, " -d %s\n", fishQuote(firstSentence(flag.Help)))
+		if flag.Tag.Negatable {
+			fmt.Fprintf(b, "complete -c %s", name)
+			if condition != "" {
+				fmt.Fprintf(b, " -n \"%s\"", condition)
+			}
+			fmt.Fprintf(b, " -l no-%s -d %s\n", flag.Name, fishQuote(firstSentence(flag.Help)))
+		}
+	}
+}
+
+func writeFishCompletion(w io.Writer, app *kong.Application) error {
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s, generated by %s completion fish\n\n", app.Name, app.Name)
+
+	// __NAME_is tells whether the words before the cursor select command,
+	// as the bash completion does
+	var patterns []string
+	for _, command := range visibleCommands(app) {
+		parent := ""
+		if command.Parent.Type != kong.ApplicationNode {
+			parent = commandPath(command.Parent)
+		}
+		patterns = append(patterns, fishQuote(parent+":"+command.Name))
+	}
+	fmt.Fprintf(&b, "function __%s_is\n", app.Name)
+	b.WriteString("\tset -l cmd\n")
+	b.WriteString("\tfor word in (commandline -opc)[2..-1]\n")
+	b.WriteString("\t\tswitch \"$cmd:$word\"\n")
+	fmt.Fprintf(&b, "\t\t\tcase %s\n", strings.Join(patterns, " "))
+	b.WriteString("\t\t\t\tset cmd (string trim -- \"$cmd $word\")\n")
+	b.WriteString("\t\tend\n")
+	b.WriteString("\tend\n")
+	b.WriteString("\ttest \"$cmd\" = \"$argv[1]\"\n")
+	b.WriteString("end\n\n")
+
+	fmt.Fprintf(&b, "complete -c %s -f\n", app.Name)
+	fishFlags(&b, app.Name, "", ownFlags(app.Node))
+	nodes := append([]*kong.Node{app.Node}, visibleCommands(app)...)
+	for _, node := range nodes {
+		path := ""
+		if node != app.Node {
+			path = commandPath(node)
+		}
+		condition := fmt.Sprintf("__%s_is '%s'", app.Name, path)
+		for _, command := range subcommands(node) {
+			fmt.Fprintf(&b, "complete -c %s -n \"%s\" -a %s -d %s\n", app.Name, condition, command.Name, fishQuote(command.Help))
+		}
+		if node == app.Node {
+			continue
+		}
+		if len(node.Positional) > 0 {
+			fmt.Fprintf(&b, "complete -c %s -n \"%s\" -F\n", app.Name, condition)
+		}
+		fishFlags(&b, app.Name, condition, visibleFlags(node))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/alecthomas/kong"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultConfigPath is where defaults are read from unless --config is
+// given: ~/.config/dupfind/config.toml on Linux.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dupfind", "config.toml")
+}
+
+// config resolves flags that are not given on the command line from a
+// TOML file. Keys are flag names with - or _ between words; tables named
+// after a command hold values for that command only. The index key sets
+// the index file used when none is given.
+type config struct {
+	path   string
+	values map[string]any
+}
+
+// load reads the config file at path. A missing file is an error only if
+// required is set.
+func (c *config) load(path string, required bool) error {
+
+	c.path, c.values = path, nil
+	if _, err := toml.DecodeFile(path, &c.values); err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil
+		}
+		return fmt.Errorf("reading config: %w", err)
+	}
+
+	return nil
+}
+
+// Index returns the configured index file, if any.
+func (c *config) Index() string {
+	index, _ := c.values["index"].(string)
+	if index == "" {
+		return ""
+	}
+	return kong.ExpandPath(index)
+}
+
+func configKey(flag string) string {
+	return strings.ReplaceAll(flag, "-", "_")
+}
+
+func (c *config) lookup(values map[string]any, flag string) any {
+	if value, ok := values[configKey(flag)]; ok {
+		return value
+	}
+	return values[flag]
+}
+
+func (c *config) Resolve(ctx *kong.Context, parent *kong.Path, flag *kong.Flag) (any, error) {
+	if command := ctx.Selected(); command != nil {
+		section, _ := c.values[command.Name].(map[string]any)
+		if value := c.lookup(section, flag.Name); value != nil {
+			return value, nil
+		}
+	}
+	return c.lookup(c.values, flag.Name), nil
+}
+
+// Validate rejects keys that are neither flags nor commands, so that
+// misspelled settings do not go unnoticed.
+func (c *config) Validate(app *kong.Application) error {
+
+	known := map[string]bool{"index": true}
+	var visit func(node *kong.Node)
+	visit = func(node *kong.Node) {
+		for _, flag := range node.Flags {
+			known[configKey(flag.Name)] = true
+		}
+		for _, child := range node.Children {
+			known[child.Name] = true
+			visit(child)
+		}
+	}
+	visit(app.Node)
+
+	for key := range c.values {
+		if !known[configKey(key)] {
+			return fmt.Errorf("%s: unknown setting %q", c.path, key)
+		}
+	}
+
+	return nil
+}
+
+// configFlag replaces the default config file with another one.
+type configFlag string
+
+func (f configFlag) BeforeResolve(k *kong.Kong, ctx *kong.Context, trace *kong.Path, c *config) error {
+	path := string(ctx.FlagValue(trace.Flag).(configFlag))
+	if err := c.load(kong.ExpandPath(path), true); err != nil {
+		return err
+	}
+	return c.Validate(k.Model)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"path/filepath"
+)
+
+type CopyUniqueCmd struct {
+	Source  string `arg:"" help:"Directory to copy files from, such as a memory card." type:"path"`
+	Dest    string `arg:"" help:"Directory to copy files to. Files keep their path relative to the source." type:"path"`
+	Index   string `arg:"" optional:"" help:"Index of the files already archived (default: the index set in the config file)." type:"path"`
+	Workers int    `short:"j" help:"Number of parallel workers, 0 for one per CPU" default:"4"`
+	DryRun  bool   `short:"n" help:"Only print what would be copied"`
+	Add     bool   `help:"Add the copied files to the index, so that they are not copied again. All files are then hashed completely."`
+
+	HashOptions `embed:""`
+	WalkOptions `embed:""`
+	SignOptions `embed:""`
+}
+
+func (c *CopyUniqueCmd) Run(ctx *Context) error {
+
+	var err error
+	if c.Index, err = ctx.indexFile(c.Index); err != nil {
+		return err
+	}
+	walker, err := c.walker()
+	if err != nil {
+		return err
+	}
+	if _, ok := dupfind.CutPathPrefix(c.Dest, c.Source); ok {
+		return errors.New("the destination must not be inside the source")
+	}
+	key, err := c.signingKey()
+	if err != nil {
+		return err
+	}
+
+	index, err := dupfind.LoadIndex(c.Index)
+	if err != nil {
+		return err
+	}
+	index = dupfind.RootIndex(index, "")
+	warnPartial(c.Index, index.Header())
+	hasher, err := c.indexHasher(index)
+	if err != nil {
+		return err
+	}
+	if err := dupfind.CheckIndexAlgorithm(index, hasher); err != nil {
+		return fmt.Errorf("%s: %w", c.Index, err)
+	}
+
+	stats := newScanStats(ctx)
+	paths := make(chan string)
+	go dupfind.ProduceFilePaths(c.Source, paths, walker, stats)
+	var metadata <-chan dupfind.Metadata
+	if c.Add {
+		metadata = dupfind.HashFilePaths(paths, c.Workers, hasher, nil, stats)
+	} else {
+		// files whose size is not indexed are new without hashing them
+		kept, rejected := dupfind.PartitionBySize(paths, index.HasSize, hasher, stats)
+		metadata = mergeMetadata(dupfind.HashStatedFiles(kept, c.Workers, hasher, nil, stats), rejected)
+	}
+
+	var added []dupfind.Metadata
+	var copied, present, failed int
+	var size int64
+	for record := range metadata {
+		if stats.Aborted() {
+			continue
+		}
+		if record.Checksum != "" && len(index.Lookup(dupfind.ChecksumKey(record.Algorithm, record.Checksum))) > 0 {
+			dupfind.Log.With("path", record.Path).Debugf("Not copying %s, it is already in the index", record.Path)
+			present++
+			continue
+		}
+		rel, err := filepath.Rel(c.Source, record.Path)
+		if err != nil || rel == "." {
+			rel = filepath.Base(record.Path)
+		}
+		dest := filepath.Join(c.Dest, rel)
+		if c.DryRun {
+			fmt.Printf("Would copy %s to %s\n", record.Path, dest)
+			copied++
+			size += record.Size
+			continue
+		}
+		if err := copyUnique(record.Path, dest); err != nil {
+			dupfind.Log.With("path", record.Path, "error", err).Warnf("Could not copy %s: %v", record.Path, err)
+			failed++
+			continue
+		}
+		copied++
+		size += record.Size
+		dupfind.Log.With("path", record.Path).Debugf("Copied %s to %s", record.Path, dest)
+		if c.Add {
+			// the copy keeps the modification time, but is another file
+			record.Path, record.Device, record.Inode = dest, 0, 0
+			added = append(added, record)
+		}
+	}
+	stats.Report()
+
+	// files copied before an interruption are added all the same
+	verb := "Copied"
+	if c.DryRun {
+		verb = "Would copy"
+	}
+	fmt.Printf("%s %d files (%s), %d already in the index.\n", verb, copied, formatBytes(size), present)
+	if len(added) > 0 {
+		header, records, err := dupfind.ReadIndex(c.Index)
+		if err != nil {
+			return err
+		}
+		for _, record := range added {
+			record.Path = dupfind.RelativePath(header, record.Path)
+			records = append(records, record)
+		}
+		if err := dupfind.OpenStore(c.Index).Write(header, records); err != nil {
+			return fmt.Errorf("writing index %s: %w", c.Index, err)
+		}
+		if err := finishIndex(c.Index, key); err != nil {
+			return err
+		}
+		fmt.Printf("Added %d files to %s.\n", len(added), c.Index)
+	}
+	if err := stats.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be copied", failed)
+	}
+
+	return nil
+}
+
+// copyUnique copies src to dest, creating the directories leading to it.
+// Existing files are never overwritten.
+func copyUnique(src, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	return dupfind.CopyFile(src, dest)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"path/filepath"
+)
+
+type DedupeCmd struct {
+	Path      string   `arg:"" name:"path" help:"Directory of files to deduplicate." type:"path"`
+	Index     string   `arg:"" optional:"" help:"Index file (default: the index set in the config file)." type:"path"`
+	Workers   int      `short:"j" help:"Number of parallel workers, 0 for one per CPU" default:"4"`
+	Action    string   `help:"What to do with duplicate files: ${enum}. reflink makes them share their data on Btrfs, XFS or APFS, keeping both files." enum:"delete,hardlink,symlink,reflink" required:""`
+	DryRun    bool     `short:"n" help:"Only print what would be done" xor:"plan"`
+	Plan      string   `help:"Write the actions to FILE as a JSON plan instead of carrying them out, for apply to carry out later." placeholder:"FILE" type:"path" xor:"plan"`
+	Keep      []string `help:"Which copy to keep: oldest, newest, shortest (path), indexed or prefer:DIR. Later rules break ties of earlier ones. Only files below PATH are ever changed." placeholder:"RULE" default:"indexed"`
+	SameOwner bool     `help:"Only treat files as duplicates if they have the same owner and group, so that no user's files are replaced by links to another's. Files of different owners are never hardlinked, as a link has the owner of the file kept."`
+
+	HashOptions   `embed:""`
+	WalkOptions   `embed:""`
+	TrashOptions  `embed:""`
+	IgnoreOptions `embed:""`
+}
+
+func (d *DedupeCmd) Run(ctx *Context) error {
+
+	var err error
+	if d.Index, err = ctx.indexFile(d.Index); err != nil {
+		return err
+	}
+
+	walker, err := d.walker()
+	if err != nil {
+		return err
+	}
+	rules, err := parseKeepRules(d.Keep)
+	if err != nil {
+		return err
+	}
+	ignored, err := d.ignoredChecksums()
+	if err != nil {
+		return err
+	}
+
+	index, err := dupfind.LoadIndex(d.Index)
+	if err != nil {
+		return err
+	}
+	index = dupfind.RootIndex(index, "")
+	warnPartial(d.Index, index.Header())
+	hasher, err := d.indexHasher(index)
+	if err != nil {
+		return err
+	}
+	if err := dupfind.CheckIndexAlgorithm(index, hasher); err != nil {
+		return err
+	}
+
+	stats := newScanStats(ctx)
+	paths := make(chan string)
+	go dupfind.ProduceFilePaths(d.Path, paths, walker, stats)
+	metadata := dupfind.HashStatedFiles(dupfind.FilterBySize(paths, index.HasSize, hasher, stats), d.Workers, hasher, index, stats)
+
+	// the copy to keep is chosen once all copies below path are known
+	var keys []string
+	groups := make(map[string][]keepCandidate)
+	for record := range metadata {
+		// hardlinks to an indexed file share its data, there is nothing to gain
+		key := dupfind.ChecksumKey(record.Algorithm, record.Checksum)
+		indexed := index.Lookup(key)
+		if len(indexed) == 0 || dupfind.IsSpecial(record.Mode) || ignored.Has(record) || dupfind.AnySameInode(record, indexed) || anySameFile(record.Path, indexed) {
+			continue
+		}
+		if d.SameOwner {
+			key = ownerKey(key, record)
+		}
+		if groups[key] == nil {
+			// files inside archives, and streams, cannot be linked to
+			for _, other := range indexed {
+				if _, ok := dupfind.Container(other.Path); ok {
+					continue
+				}
+				if other = withOwner(other); !d.SameOwner || dupfind.SameOwner(record, other) {
+					groups[key] = append(groups[key], keepCandidate{Metadata: other, indexed: true})
+				}
+			}
+			if groups[key] == nil {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], keepCandidate{Metadata: record})
+	}
+
+	var planned []planAction
+	undo := newUndoLog(d.Index)
+	defer undo.Close()
+	for _, key := range keys {
+		if stats.Aborted() {
+			break
+		}
+		group := groups[key]
+		keep := group[chooseKeeper(group, rules)]
+		var keptErr error
+		checked := false
+		for _, record := range group {
+			if record.indexed || record.Path == keep.Path || sameFile(record.Path, keep.Path) {
+				continue
+			}
+			if d.Action == "hardlink" && !dupfind.SameOwner(record.Metadata, keep.Metadata) {
+				dupfind.Log.With("path", record.Path).Warnf("Not hardlinking %s to %s, they have different owners", record.Path, keep.Path)
+				continue
+			}
+			if d.DryRun {
+				fmt.Printf("Would %s %s (duplicate of %s)\n", d.Action, record.Path, keep.Path)
+				continue
+			}
+			if d.Plan != "" {
+				planned = append(planned, newPlanAction(d.Action, record.Metadata, keep.Path, hasher.Xattrs))
+				continue
+			}
+			if !checked {
+				keptErr, checked = checkKept(keep.Metadata, hasher.Xattrs), true
+			}
+			if keptErr != nil {
+				dupfind.Log.With("path", record.Path, "error", keptErr).Warnf("Could not %s %s: %v", d.Action, record.Path, keptErr)
+				continue
+			}
+			if err := dedupeFile(d.Action, record.Path, keep.Path, d.remove); err != nil {
+				dupfind.Log.With("path", record.Path, "error", err).Warnf("Could not %s %s: %v", d.Action, record.Path, err)
+				continue
+			}
+			if err := undo.record(newPlanAction(d.Action, record.Metadata, keep.Path, hasher.Xattrs)); err != nil {
+				return fmt.Errorf("recording %s in the undo log: %w", record.Path, err)
+			}
+			fmt.Printf("%s %s (duplicate of %s)\n", d.done(d.Action), record.Path, keep.Path)
+		}
+	}
+	stats.Report()
+	if err := stats.Err(); err != nil {
+		return err
+	}
+	if d.Plan != "" {
+		return writePlan(d.Plan, "dedupe", d.Index, planned)
+	}
+
+	return nil
+}
+
+var actionDone = map[string]string{
+	"delete":   "Removed",
+	"hardlink": "Hardlinked",
+	"symlink":  "Symlinked",
+	"reflink":  "Reflinked",
+}
+
+// sameFile reports whether both paths refer to the same file on disk, in
+// which case the "duplicate" must not be touched.
+func sameFile(a, b string) bool {
+	if dupfind.SamePath(a, b) {
+		return true
+	}
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
+
+func anySameFile(path string, records []dupfind.Metadata) bool {
+	for _, record := range records {
+		if sameFile(path, record.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKept fails if the file of record, the copy to keep, is gone or no
+// longer has the content it was hashed with, as with a stale index, so
+// that no duplicate is removed or linked to it. Files whose size and
+// modification time changed, or were not recorded, are hashed again.
+func checkKept(record dupfind.Metadata, xattrs string) error {
+
+	info, err := os.Stat(record.Path)
+	if err != nil {
+		return errors.New("the file kept is gone")
+	}
+	if !record.ModTime.IsZero() {
+		if info.Size() != record.Size {
+			return errors.New("the file kept changed since it was hashed")
+		}
+		if info.ModTime().Equal(record.ModTime) {
+			return nil
+		}
+	}
+
+	algorithm := dupfind.RecordAlgorithm(record)
+	checksum, _, _, err := dupfind.ComputeChecksum(record.Path, algorithm)
+	if err == nil && xattrs == dupfind.XattrsHash {
+		checksum, err = dupfind.XattrsChecksum(record.Path, checksum, algorithm)
+	}
+	if err != nil {
+		return fmt.Errorf("hashing the file kept: %w", err)
+	}
+	if checksum != record.Checksum {
+		return errors.New("the file kept changed since it was hashed")
+	}
+
+	return nil
+}
+
+// withOwner fills in the owner of the file of record if the index does not
+// hold it.
+func withOwner(record dupfind.Metadata) dupfind.Metadata {
+	if record.Owned {
+		return record
+	}
+	if info, err := os.Stat(record.Path); err == nil {
+		current := dupfind.FileMetadata(record.Path, info)
+		record.Owned, record.UID, record.GID = current.Owned, current.UID, current.GID
+	}
+	return record
+}
+
+// dedupeFile removes path with remove, makes it share the data of target
+// or replaces it with a link to target. Links are created under a
+// temporary name and renamed over path, so path is never left missing if
+// linking fails.
+func dedupeFile(action, path, target string, remove func(string) error) error {
+	switch action {
+	case "delete":
+		return remove(path)
+	case "reflink":
+		return dupfind.Reflink(target, path)
+	}
+
+	before, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.dupfind-tmp", filepath.Base(path)))
+	switch action {
+	case "hardlink":
+		err = os.Link(target, tmp)
+	case "symlink":
+		err = os.Symlink(target, tmp)
+	default:
+		err = fmt.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	keepTimes(action, path, target, before)
+
+	return nil
+}
+
+// keepTimes carries the modification time of the file replaced at path
+// over to the link replacing it, as far as it can be. A symlink gets it
+// itself. A hardlink shares the time and permissions of target, which is
+// left alone, as it may lie outside the tree deduplicated; either is
+// reported if it differs.
+func keepTimes(action, path, target string, before os.FileInfo) {
+
+	var err error
+	switch action {
+	case "symlink":
+		err = dupfind.Lchtimes(path, before.ModTime())
+	case "hardlink":
+		var kept os.FileInfo
+		if kept, err = os.Stat(target); err != nil {
+			break
+		}
+		if !kept.ModTime().Equal(before.ModTime()) {
+			dupfind.Log.With("path", path).Infof("%s now has the modification time %s of %s instead of %s",
+				path, longTime(kept.ModTime()), target, longTime(before.ModTime()))
+		}
+		if kept.Mode().Perm() != before.Mode().Perm() {
+			dupfind.Log.With("path", path).Warnf("Warning: %s now has the permissions %v of %s instead of %v",
+				path, kept.Mode().Perm(), target, before.Mode().Perm())
+		}
+	}
+	if err != nil {
+		dupfind.Log.With("path", path, "error", err).Warnf("Could not keep the modification time of %s: %v", path, err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type DiffCmd struct {
+	A       string `arg:"" name:"a" help:"Directory or index file." type:"path"`
+	B       string `arg:"" name:"b" help:"Directory or index file to compare with." type:"path"`
+	Workers int    `short:"j" help:"Number of parallel workers, 0 for one per CPU" default:"4"`
+	Renamed bool   `help:"Report files that are only in one tree, but have the same content as a file only in the other, as renamed or moved."`
+
+	HashOptions `embed:""`
+	WalkOptions `embed:""`
+}
+
+// treeRecords returns the records of the files in a directory tree, keyed
+// by their slash-separated path relative to the tree's root. If path is
+// not a directory it is read as an index of the tree.
+func treeRecords(path string, workers int, walker *dupfind.Walker, hasher *dupfind.Hasher, stats *dupfind.ScanStats) (map[string]dupfind.Metadata, error) {
+
+	root := path
+	var metadata <-chan dupfind.Metadata
+	if info, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		metadata = dupfind.ProduceMetadata(path, workers, walker, hasher, stats)
+	} else {
+		header, records, err := dupfind.ReadIndex(path)
+		if err != nil {
+			return nil, err
+		}
+		warnPartial(path, header)
+		records = dupfind.RootRecords(header, records, "")
+		if header.Root == "" {
+			return nil, fmt.Errorf("index %s does not record the directory it was built from", path)
+		}
+		root = header.Root
+		ch := make(chan dupfind.Metadata, len(records))
+		for _, record := range records {
+			ch <- record
+		}
+		close(ch)
+		metadata = ch
+	}
+
+	tree := make(map[string]dupfind.Metadata)
+	for record := range metadata {
+		rel, err := filepath.Rel(root, record.Path)
+		if err != nil {
+			rel = record.Path
+		}
+		tree[dupfind.NormalizePath(filepath.ToSlash(rel))] = record
+	}
+
+	return tree, stats.Err()
+}
+
+func (d *DiffCmd) Run(ctx *Context) error {
+
+	hasher, err := d.hasher()
+	if err != nil {
+		return err
+	}
+	walker, err := d.walker()
+	if err != nil {
+		return err
+	}
+
+	stats := newScanStats(ctx)
+	a, err := treeRecords(d.A, d.Workers, walker, hasher, stats)
+	if err != nil {
+		return err
+	}
+	b, err := treeRecords(d.B, d.Workers, walker, hasher, stats)
+	if err != nil {
+		return err
+	}
+
+	var rels []string
+	for rel := range a {
+		rels = append(rels, rel)
+	}
+	for rel := range b {
+		if _, ok := a[rel]; !ok {
+			rels = append(rels, rel)
+		}
+	}
+	sort.Strings(rels)
+	var renamed map[string]string
+	if d.Renamed {
+		renamed = renamedFiles(rels, a, b)
+	}
+
+	var onlyA, onlyB, differ, moved int
+	for _, rel := range rels {
+		ra, inA := a[rel]
+		rb, inB := b[rel]
+		switch {
+		case !inB && renamed[rel] != "":
+			moved++
+			fmt.Printf("Renamed %s -> %s\n", rel, renamed[rel])
+		case !inA && renamed[rel] != "":
+			// reported with the file it was renamed from
+		case !inB:
+			onlyA++
+			fmt.Printf("Only in %s: %s\n", d.A, rel)
+		case !inA:
+			onlyB++
+			fmt.Printf("Only in %s: %s\n", d.B, rel)
+		case dupfind.RecordAlgorithm(ra) != dupfind.RecordAlgorithm(rb):
+			differ++
+			fmt.Printf("Files %s and %s cannot be compared, hashed with %s and %s\n",
+				ra.Path, rb.Path, dupfind.RecordAlgorithm(ra), dupfind.RecordAlgorithm(rb))
+		case ra.Checksum != rb.Checksum:
+			differ++
+			fmt.Printf("Files %s and %s differ\n", ra.Path, rb.Path)
+		case hasher.Xattrs == dupfind.XattrsRecord && ra.Xattrs != rb.Xattrs:
+			differ++
+			fmt.Printf("Files %s and %s differ only in their extended attributes\n", ra.Path, rb.Path)
+		}
+	}
+	if d.Renamed {
+		fmt.Printf("%d only in %s, %d only in %s, %d differ, %d renamed.\n", onlyA, d.A, onlyB, d.B, differ, moved)
+	} else {
+		fmt.Printf("%d only in %s, %d only in %s, %d differ.\n", onlyA, d.A, onlyB, d.B, differ)
+	}
+	stats.Report()
+
+	if onlyA > 0 || onlyB > 0 || differ > 0 || moved > 0 {
+		return fmt.Errorf("trees differ")
+	}
+	return nil
+}
+
+// renamedFiles pairs files only in a with files only in b that have the
+// same content. The result maps the paths of both files of a pair to the
+// other one's. Copies are paired in path order, and empty files, which all
+// have the same content, are never paired.
+func renamedFiles(rels []string, a, b map[string]dupfind.Metadata) map[string]string {
+
+	onlyB := make(map[string][]string)
+	for _, rel := range rels {
+		record, inB := b[rel]
+		if _, inA := a[rel]; inB && !inA && record.Size > 0 && !dupfind.IsSpecial(record.Mode) {
+			key := dupfind.ChecksumKey(record.Algorithm, record.Checksum)
+			onlyB[key] = append(onlyB[key], rel)
+		}
+	}
+
+	renamed := make(map[string]string)
+	for _, rel := range rels {
+		record, inA := a[rel]
+		if _, inB := b[rel]; !inA || inB || record.Size == 0 || dupfind.IsSpecial(record.Mode) {
+			continue
+		}
+		key := dupfind.ChecksumKey(record.Algorithm, record.Checksum)
+		if candidates := onlyB[key]; len(candidates) > 0 {
+			renamed[rel], renamed[candidates[0]] = candidates[0], rel
+			onlyB[key] = candidates[1:]
+		}
+	}
+
+	return renamed
+}
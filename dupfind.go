@@ -1,195 +1,985 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/json"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"github.com/alecthomas/kong"
-	"io"
+	"io/fs"
+	"jvkersch/dupfind/dupfind"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"sync"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Context struct {
+	// Context is canceled when dupfind is interrupted.
+	context.Context
+	// ErrorsFatal aborts a run on the first file that cannot be processed.
+	ErrorsFatal bool
+	// Index is the index file used if a command is given none.
+	Index string
 }
 
-type BuildCmd struct {
-	Path    string `arg:"" name:"path" help:"Directory to index." type:"path"`
-	Index   string `arg:"" help:"Index file." type:"path"`
-	Workers int    `short:"j" help:"Number of parallel workers" default:"4"`
+// indexFile returns index, or the configured index if it is empty.
+func (c *Context) indexFile(index string) (string, error) {
+	if index != "" {
+		return index, nil
+	}
+	if c.Index == "" {
+		return "", errors.New("no index file given, and none set in the config file")
+	}
+	return c.Index, nil
 }
 
-type FindCmd struct {
-	Path    string `arg:"" name:"path" help:"Directory of files to look up." type:"path"`
-	Index   string `arg:"" help:"Index file." type:"path"`
-	Workers int    `short:"j" help:"Number of parallel workers" default:"4"`
-	Short   bool   `help:"For duplicate files, only print out path"`
-	Rm      bool   `help:"Remove duplicate files. WARNING: IRREVERSIBLE"`
+func newScanStats(ctx *Context) *dupfind.ScanStats {
+	return dupfind.NewScanStats(ctx, ctx.ErrorsFatal)
 }
 
-type Metadata struct {
-	Path     string `json:"path"`
-	Checksum string `json:"checksum"`
+type BuildCmd struct {
+	Path       string        `arg:"" name:"path" help:"Directory or s3://bucket/prefix to index, or - to index the files named on stdin." type:"source"`
+	Index      string        `arg:"" optional:"" help:"Index file (default: the index set in the config file)." type:"path"`
+	Paths      []string      `name:"path" help:"Also index DIR, so that one index covers several directories, such as drives mounted at the same time. Records store the directory they were found in. Can be repeated." placeholder:"DIR" type:"source"`
+	Workers    int           `short:"j" help:"Number of parallel workers, 0 for one per CPU" default:"4"`
+	Force      bool          `short:"f" help:"Overwrite an existing index file"`
+	Compress   string        `help:"Compress the index with gzip or zstd. Index files ending in .gz or .zst are compressed anyway." enum:",gzip,zstd" default:""`
+	Archives   bool          `help:"Also index the files inside zip and tar archives, as ARCHIVE!MEMBER."`
+	Streams    bool          `help:"On Windows, also index the NTFS alternate data streams of files, as FILE:STREAM."`
+	Perceptual bool          `help:"Also store perceptual hashes of JPEG, PNG and GIF images, so that find --perceptual can report near-duplicates."`
+	Relative   bool          `help:"Store paths relative to the indexed directory, so that the index stays usable when the directory is mounted elsewhere."`
+	Sort       bool          `help:"Write records sorted by path, so that identical trees give identical indexes. Records are held in memory until all files are hashed."`
+	Chunks     bool          `help:"Also store the hashes of content-defined chunks of each file, so that find --chunks can report files sharing most of their content (experimental)."`
+	Null       bool          `help:"File paths on stdin are separated by NUL characters, as written by find -print0, instead of newlines."`
+	Encrypt    bool          `help:"Encrypt the index with the passphrase given with --passphrase-file or DUPFIND_PASSPHRASE, so that it does not reveal the names of the indexed files."`
+	Sparse     bool          `help:"Also record the space that sparse files take on disk, which stats reports (not on Windows)."`
+	Resume     bool          `help:"Resume an interrupted or crashed build of the index, hashing only the files that were not hashed before or changed since."`
+	Checkpoint time.Duration `help:"Save the progress of the build this often, so that it can be resumed after a crash. 0 saves none." default:"30s"`
+	Bloom      bool          `help:"Also write a Bloom filter of the index to INDEX.bloom, so that find can skip files that are not indexed without loading the index. Later writes keep it up to date."`
+	History    bool          `help:"Keep the history of the index in INDEX.history, recording a snapshot whenever it is written, for the history command. An existing index is then replaced without --force, its content being recorded first."`
+
+	HashOptions     `embed:""`
+	WalkOptions     `embed:""`
+	ProgressOptions `embed:""`
+	SignOptions     `embed:""`
+	BudgetOptions   `embed:""`
 }
 
-func produceMetadata(root string, workers int) <-chan Metadata {
+type FindCmd struct {
+	Path            string   `arg:"" name:"path" help:"Directory or s3://bucket/prefix of files to look up, or - to look up the files named on stdin." type:"source"`
+	Indexes         []string `arg:"" optional:"" name:"index" help:"Index files. Matches are looked up in all of them (default: the index set in the config file)." type:"path"`
+	Workers         int      `short:"j" help:"Number of parallel workers, 0 for one per CPU" default:"4"`
+	Short           bool     `help:"For duplicate files, only print out path" xor:"style"`
+	Long            bool     `help:"Print duplicates in aligned columns with the size and modification time of both copies and their checksum." xor:"style"`
+	Porcelain       bool     `help:"Print each reported file as a line of tab-separated fields in a format that stays the same across versions, for scripts: kind, path, indexed path, size and checksum." xor:"style"`
+	Print0          bool     `short:"0" help:"Only print the path of each reported file, followed by a NUL character, for use with xargs -0."`
+	Rm              bool     `help:"Remove duplicate files. WARNING: IRREVERSIBLE" xor:"rm"`
+	Tail            bool     `help:"Read file paths from stdin (pass - as path) until EOF and report each as it arrives"`
+	Null            bool     `help:"File paths on stdin are separated by NUL characters, as written by find -print0, instead of newlines."`
+	Partial         bool     `help:"Compare the first ${partial_size} of each file with the index before hashing it completely" default:"true" negatable:""`
+	OutputFormat    string   `help:"Output format (${enum})." enum:"text,json,ndjson,csv" default:"text"`
+	Fields          []string `help:"Only output these fields of each match, such as path,index_path,size,mtime,mode." placeholder:"FIELD,..."`
+	IgnoreHardlinks bool     `help:"Treat hardlinks to the same file as one file, and never report hardlinks to an indexed file."`
+	Archives        bool     `help:"Also look up the files inside zip and tar archives."`
+	Streams         bool     `help:"On Windows, also look up the NTFS alternate data streams of files."`
+	Perceptual      bool     `help:"Also report images that look like an indexed image, judged by perceptual hashes stored with build --perceptual."`
+	MaxDistance     int      `help:"Number of bits in which the perceptual hashes of similar images may differ (0-64)." default:"10"`
+	Chunks          bool     `help:"Also report files sharing most of their content-defined chunks with an indexed file, as stored with build --chunks (experimental)."`
+	MinShared       int      `help:"Percentage of chunks that files reported by --chunks must share with an indexed file." default:"50"`
+	Self            bool     `help:"Also report files that duplicate another file being looked up. All files are hashed completely." xor:"self"`
+	Missing         bool     `help:"Report the files that are not in the index instead of those that are." xor:"self,rm"`
+	Root            string   `help:"Look for the indexed files below DIR instead of the directory the index was built from." placeholder:"DIR" type:"path"`
+	Force           bool     `short:"f" help:"Look up files even if an index holds no checksums computed with the algorithm they are hashed with."`
+	ExitCode        bool     `help:"Exit with status 1 if any files were reported and 0 otherwise, and with status 2 on errors."`
+	By              []string `help:"Match files to indexed files with the same name, size or both (name,size) instead of the same content. Nothing is hashed, so matches are only likely duplicates." enum:"name,size"`
+	IgnoreEmpty     bool     `help:"Skip empty files, which all have the same content and would all be reported. Pass --no-ignore-empty to look them up." default:"true" negatable:""`
+	LowMemory       bool     `help:"Look files up on disk instead of loading the indexes into memory, which keeps memory use flat for huge indexes but is slower. JSON indexes are first copied to a temporary SQLite database in the cache directory."`
+	Ordered         bool     `help:"Report files sorted by path, so that the output of runs can be compared, instead of as soon as they are hashed. Nothing is reported until all files are hashed."`
+	Dirs            bool     `help:"Report directories all of whose files duplicate indexed files as one line each, followed by the duplicates outside them, instead of every duplicate file."`
+	AllowOverlap    bool     `help:"Also report files inside an indexed directory as duplicates of themselves. By default, a file only matches other indexed files."`
+	Exec            string   `help:"Run COMMAND for each reported file, with {} replaced by its path, {index} by the indexed path and {checksum} by the checksum. COMMAND is split into arguments like a shell would, but not run by one." placeholder:"COMMAND"`
+
+	HashOptions     `embed:""`
+	WalkOptions     `embed:""`
+	ProgressOptions `embed:""`
+	IgnoreOptions   `embed:""`
+	NotifyOptions   `embed:""`
+	BudgetOptions   `embed:""`
+}
 
-	paths := make(chan string)
-	metadata := make(chan Metadata)
+func (b *BuildCmd) Run(ctx *Context) error {
 
-	// close metadata channel once all producers are done
-	var gather sync.WaitGroup
-	go func() {
-		gather.Wait()
-		close(metadata)
-	}()
+	var err error
+	if b.Index, err = ctx.indexFile(b.Index); err != nil {
+		return err
+	}
 
-	// start producer
-	go produceFilePaths(root, paths)
+	hasher, err := b.hasher()
+	if err != nil {
+		return err
+	}
+	hasher.Archives = b.Archives
+	hasher.Streams = b.Streams
+	hasher.Perceptual = b.Perceptual
+	hasher.Chunks = b.Chunks
+	hasher.Sparse = b.Sparse
+	walker, err := b.walker()
+	if err != nil {
+		return err
+	}
+	if (b.Path == "-" || dupfind.IsRemote(b.Path)) && b.Relative {
+		return errors.New("--relative needs a local directory to index")
+	}
+	roots := append([]string{b.Path}, b.Paths...)
+	if err := checkRoots(roots, b.Relative); err != nil {
+		return err
+	}
+	// budgeted builds continue where the last one stopped
+	if b.budgeted() && !b.Force && interruptedBuild(b.Index) {
+		b.Resume = true
+	}
+	var previous []dupfind.Metadata
+	if b.Resume {
+		if dupfind.IsRemote(b.Path) {
+			return errors.New("--resume needs local files to index")
+		}
+		if previous, err = b.previousRecords(); err != nil {
+			return err
+		}
+	} else if err := checkOverwrite(b.Index, b.Force || b.History || keepsHistory(b.Index)); err != nil {
+		return err
+	} else if _, err := os.Stat(dupfind.CheckpointFile(b.Index)); err == nil && !b.Force {
+		return fmt.Errorf("a build of %s was interrupted, pass --resume to continue it or --force to start over", b.Index)
+	}
+	key, err := b.signingKey()
+	if err != nil {
+		return err
+	}
+	if b.History {
+		if err := startHistory(b.Index); err != nil {
+			return fmt.Errorf("starting the history of %s: %w", b.Index, err)
+		}
+	}
+	store, err := openIndexStore(b.Index, b.Compress, b.Encrypt)
+	if err != nil {
+		return err
+	}
+	var checkpoint *dupfind.Checkpoint
+	if b.Checkpoint > 0 {
+		if checkpoint, err = dupfind.CreateCheckpoint(b.Index, b.Checkpoint, b.Resume); err != nil {
+			return fmt.Errorf("saving progress: %w", err)
+		}
+	}
 
-	// start consumer/producer (path -> metadata)
-	for i := 0; i < workers; i++ {
-		gather.Add(1)
-		go func(consumerID int) {
-			defer gather.Done()
-			consumeFilePaths(consumerID, paths, metadata)
-		}(i)
+	stats := newScanStats(ctx)
+	b.limit(stats)
+	paths := make(chan string)
+	if len(roots) > 1 {
+		go dupfind.ProduceRootPaths(roots, paths, walker, stats)
+	} else {
+		go produceInputPaths(b.Path, b.Null, paths, walker, stats)
+	}
+	var stale <-chan string = paths
+	var reused int
+	var kept <-chan dupfind.Metadata
+	if b.Resume {
+		stale, kept = reuseRecords(paths, previous, hasher, &reused)
+	}
+	metadata := dupfind.HashFilePaths(stale, b.Workers, hasher, nil, stats)
+	if checkpoint != nil {
+		metadata = checkpointMetadata(metadata, checkpoint)
+	}
+	if kept != nil {
+		metadata = mergeMetadata(kept, metadata)
+	}
+	if len(roots) > 1 {
+		metadata = dupfind.TagRoots(metadata, roots)
+	}
+	if stop := b.startProgress(roots, walker, stats); stop != nil {
+		metadata = stopWhenDone(metadata, stop)
+	}
+	if b.Sort {
+		metadata = sortMetadata(metadata)
+	}
+	root := b.Path
+	if root == "-" {
+		// files named on stdin need not share a directory
+		root = ""
+	}
+	header := dupfind.NewIndexHeader(root, hasher.Algorithm())
+	header.Relative = b.Relative
+	header.HashFor = hasher.Rules()
+	if hasher.Xattrs != dupfind.XattrsIgnore {
+		header.Xattrs = hasher.Xattrs
+	}
+	if len(roots) > 1 {
+		header.Roots = roots
+	}
+	// reproducible builds pin the creation time
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		header.Created = time.Unix(epoch, 0).UTC()
+	}
+	err = writeIndex(metadata, store, b.Index, header, key, stats, true)
+	// the index holds all files hashed unless writing it failed
+	if checkpoint != nil && err == nil {
+		err = checkpoint.Remove()
+	} else if checkpoint != nil {
+		checkpoint.Close()
+	}
+	if b.Bloom && err == nil {
+		err = writeBloomFilter(b.Index)
+	}
+	if b.Resume && err == nil {
+		fmt.Printf("Resumed build, reusing %d files hashed before.\n", reused)
+	}
+	if errors.Is(err, dupfind.ErrBudget) {
+		fmt.Println("Stopped once the budget was used up, the next build with a budget continues where this one stopped.")
+		err = nil
 	}
+	stats.Report()
 
-	return metadata
+	return err
 }
 
-func (b *BuildCmd) Run(ctx *Context) error {
+// checkRoots fails if several roots are given where only one is
+// supported, or if one of them lies below another, whose walk would
+// visit its files twice.
+func checkRoots(roots []string, relative bool) error {
 
-	metadata := produceMetadata(b.Path, b.Workers)
-	writeIndex(metadata, b.Index)
+	if len(roots) < 2 {
+		return nil
+	}
+	if relative {
+		return errors.New("--relative needs a single directory to index")
+	}
+	for i, root := range roots {
+		if root == "-" {
+			return errors.New("--path cannot be combined with files named on stdin")
+		}
+		for j, other := range roots {
+			if _, ok := dupfind.CutPathPrefix(root, other); ok && i != j {
+				return fmt.Errorf("%s lies below %s, which is indexed already", root, other)
+			}
+		}
+	}
 
 	return nil
 }
 
-func produceFilePaths(root string, paths chan<- string) {
-	defer close(paths)
+// writeErrorReport lists the files that could not be indexed, and those
+// that changed while they were hashed, with the reason, next to the index
+// as INDEX.errors. A list left by an earlier run is removed if all files
+// were indexed without trouble.
+func writeErrorReport(index string, stats *dupfind.ScanStats) error {
 
-	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	name := index + ".errors"
+	failures, unstable := stats.Failures(), stats.UnstableFiles()
+	if len(failures) == 0 && len(unstable) == 0 {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return err
 		}
-		if !info.IsDir() {
-			paths <- path
-		}
 		return nil
-	})
+	}
+
+	var b strings.Builder
+	for _, failure := range append(failures, unstable...) {
+		fmt.Fprintf(&b, "%s\t%v\n", failure.Path, failure.Err)
+	}
+	if err := os.WriteFile(name, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		fmt.Printf("%d files could not be indexed, see %s.\n", len(failures), name)
+	}
+	if len(unstable) > 0 {
+		fmt.Printf("%d files changed while they were hashed and may have wrong checksums, see %s.\n", len(unstable), name)
+	}
+
+	return nil
 }
 
-func consumeFilePaths(id int, paths <-chan string, metadata chan<- Metadata) {
-	for path := range paths {
-		checksum, err := computeChecksum(path)
-		if err != nil {
-			log.Printf("Could not compute checksum for file %s: %v", path, err)
-			continue
-		}
-		metadata <- Metadata{Path: path, Checksum: checksum}
+// produceInputPaths sends the files below path that walker visits to
+// paths, or the files named on stdin if path is -.
+func produceInputPaths(path string, null bool, paths chan<- string, walker *dupfind.Walker, stats *dupfind.ScanStats) {
+	if path != "-" {
+		dupfind.ProduceFilePaths(path, paths, walker, stats)
+		return
 	}
+	sep := byte('\n')
+	if null {
+		sep = 0
+	}
+	dupfind.ProduceInputPaths(os.Stdin, sep, paths, walker, stats)
 }
 
-func computeChecksum(path string) (string, error) {
-	f, err := os.Open(path)
+// readPassphrase returns the passphrase of encrypted indexes, read from
+// file or, if it is empty, from the environment.
+func readPassphrase(file string) (string, error) {
+	if file == "" {
+		return os.Getenv("DUPFIND_PASSPHRASE"), nil
+	}
+	data, err := os.ReadFile(file)
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
-
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
+	passphrase, _, _ := strings.Cut(string(data), "\n")
+	passphrase = strings.TrimSuffix(passphrase, "\r")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase file %s is empty", file)
 	}
+	return passphrase, nil
+}
 
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+// openIndexStore opens the index file for writing with the given
+// compression, or as its name implies if compression is empty, and
+// encrypts it if asked to.
+func openIndexStore(index string, compression string, encrypt bool) (dupfind.IndexStore, error) {
+	if encrypt {
+		return dupfind.OpenEncryptedStore(index, compression)
+	}
+	if compression == "" {
+		return dupfind.OpenStore(index), nil
+	}
+	return dupfind.OpenCompressedStore(index, compression)
 }
 
-func writeIndex(metadata <-chan Metadata, index string) {
+// writeIndex stores records in the index file as they arrive, and keeps
+// the new index unless the run was aborted. If it was interrupted and
+// partial is set, the files hashed so far are kept as a partial index.
+// The index is signed with key unless it is nil.
+func writeIndex(metadata <-chan dupfind.Metadata, store dupfind.IndexStore, index string, header dupfind.IndexHeader, key ed25519.PrivateKey, stats *dupfind.ScanStats, partial bool) error {
 
-	var records []Metadata
+	w, err := store.Create()
+	if err != nil {
+		// drain the pipeline so that its workers finish
+		stats.Abort(err)
+		for range metadata {
+		}
+		return fmt.Errorf("writing index %s: %w", index, err)
+	}
+
+	var count int
 	for record := range metadata {
-		records = append(records, record)
+		if stats.Aborted() && !errors.Is(stats.Err(), context.Canceled) || dupfind.IsIndexFile(index, record.Path) {
+			continue
+		}
+		record.Path = dupfind.RelativePath(header, record.Path)
+		if err := w.Add(record); err != nil {
+			stats.Abort(fmt.Errorf("writing index %s: %w", index, err))
+			continue
+		}
+		count++
+	}
+	err = stats.Err()
+	if err != nil && !(partial && errors.Is(err, context.Canceled)) {
+		w.Abort()
+		return err
 	}
+	header.Partial = err != nil
 
-	file, err := os.Create(index)
-	if err != nil {
-		log.Fatal("Error opening file:", err)
+	if err := w.Close(header); err != nil {
+		return fmt.Errorf("writing index %s: %w", index, err)
+	}
+	if err := finishIndex(index, key); err != nil {
+		return err
 	}
-	defer file.Close()
 
-	jsonData, err := json.MarshalIndent(records, "", "  ")
-	if err != nil {
-		log.Fatal("Error marshaling to JSON:", err)
+	if header.Partial {
+		fmt.Printf("Partial index file %s written with %d files.\n", index, count)
+	} else {
+		fmt.Printf("Index file %s written.\n", index)
+	}
+	if err := writeErrorReport(index, stats); err != nil {
+		dupfind.Log.With("error", err).Warnf("Could not write the list of files that failed: %v", err)
 	}
-	file.Write(jsonData)
+	return err
+}
+
+// sortMetadata passes on all records, sorted by path, once metadata is
+// closed.
+func sortMetadata(metadata <-chan dupfind.Metadata) <-chan dupfind.Metadata {
 
-	fmt.Printf("Index file %s written.\n", index)
+	out := make(chan dupfind.Metadata)
+	go func() {
+		defer close(out)
+		var records []dupfind.Metadata
+		for record := range metadata {
+			records = append(records, record)
+		}
+		sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+		for _, record := range records {
+			out <- record
+		}
+	}()
+
+	return out
+}
+
+// checkOverwrite refuses to replace an existing index file unless force
+// is set.
+func checkOverwrite(index string, force bool) error {
+	if _, err := os.Stat(index); err == nil && !force {
+		return fmt.Errorf("index file %s already exists, pass --force to overwrite it", index)
+	}
+	return nil
+}
+
+// warnPartial warns that lookups in a partial index may miss duplicates.
+func warnPartial(name string, header dupfind.IndexHeader) {
+	if header.Partial {
+		dupfind.Log.With("index", name).Warnf("Warning: index %s is partial because its build was interrupted", name)
+	}
+}
+
+// exitStatus ends dupfind with the exit status code, after printing err
+// unless it is nil.
+type exitStatus struct {
+	code int
+	err  error
+}
+
+func (e *exitStatus) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitStatus) Unwrap() error {
+	return e.err
 }
 
 func (f *FindCmd) Run(ctx *Context) error {
 
-	index := loadIndex(f.Index)
-	metadata := produceMetadata(f.Path, f.Workers)
-	lookupRecords(metadata, index, f.Short, f.Rm)
+	summary := runSummary{Command: "find"}
+	if err := f.checkNotify(); err != nil {
+		return err
+	}
+	reported, err := f.find(ctx, &summary)
+	f.notify(summary, reported > 0, err)
+	if !f.ExitCode {
+		return err
+	}
+	if err != nil {
+		return &exitStatus{code: 2, err: err}
+	}
+	if reported > 0 {
+		return &exitStatus{code: 1}
+	}
 
 	return nil
 }
 
-func loadIndex(path string) map[string]string {
+// find looks up the files and returns the number of files reported. The
+// outcome is added to summary.
+func (f *FindCmd) find(ctx *Context, summary *runSummary) (int, error) {
 
-	jsonData, err := os.ReadFile(path)
+	if len(f.Indexes) == 0 {
+		index, err := ctx.indexFile("")
+		if err != nil {
+			return 0, err
+		}
+		f.Indexes = []string{index}
+	}
+	summary.Index = strings.Join(f.Indexes, ", ")
+
+	if err := checkFields(f.Fields, matchFields); err != nil {
+		return 0, err
+	}
+	format := f.OutputFormat
+	if f.Print0 {
+		if format != "text" || len(f.Fields) > 0 {
+			return 0, errors.New("--print0 cannot be combined with --output-format or --fields")
+		}
+		format = "print0"
+	}
+	if f.Long {
+		if format != "text" || len(f.Fields) > 0 {
+			return 0, errors.New("--long cannot be combined with --output-format, --fields or --print0")
+		}
+		format = "long"
+	}
+	if f.Porcelain {
+		if format != "text" || len(f.Fields) > 0 {
+			return 0, errors.New("--porcelain cannot be combined with --output-format, --fields or --print0")
+		}
+		format = "porcelain"
+	}
+	var rollup *dupfind.DirRollup
+	if f.Dirs {
+		if err := f.checkDirs(); err != nil {
+			return 0, err
+		}
+		rollup = dupfind.NewDirRollup(f.Path)
+	}
+	out, err := f.matchWriter(format, rollup)
 	if err != nil {
-		log.Fatal("Error reading file:", err)
+		return 0, err
+	}
+	if f.IgnoreEmpty && f.MinSize == 0 {
+		f.MinSize = 1
+	}
+	walker, err := f.walker()
+	if err != nil {
+		return 0, err
+	}
+
+	if f.Root != "" && len(f.Indexes) > 1 {
+		return 0, errors.New("--root can only be used with a single index")
+	}
+	if len(f.By) > 0 {
+		return f.findBy(ctx, walker, out, summary)
+	}
+	indexes := make([]dupfind.Index, len(f.Indexes))
+	for i, name := range f.Indexes {
+		var remove func()
+		if indexes[i], remove, err = f.loadIndex(name); err != nil {
+			return 0, err
+		}
+		defer remove()
+		indexes[i] = dupfind.RootIndex(indexes[i], f.Root)
+		warnPartial(name, indexes[i].Header())
+	}
+	index := indexes[0]
+	if len(indexes) > 1 {
+		index = dupfind.NewMultiIndex(f.Indexes, indexes)
 	}
 
-	var records []Metadata
-	err = json.Unmarshal(jsonData, &records)
+	// files are hashed like the indexed ones unless --hash says otherwise
+	hasher, err := f.indexHasher(index)
 	if err != nil {
-		log.Fatal("Error unmarshaling JSON:", err)
+		return 0, err
+	}
+	hasher.Archives = f.Archives
+	hasher.Streams = f.Streams
+	hasher.Perceptual = f.Perceptual
+	hasher.Chunks = f.Chunks
+	for i, name := range f.Indexes {
+		if err := dupfind.CheckIndexAlgorithm(indexes[i], hasher); err != nil && !f.Force {
+			return 0, fmt.Errorf("%s: %w; pass --hash to choose the algorithm, or --force to look up files anyway", name, err)
+		}
 	}
 
-	index := make(map[string]string)
-	for _, record := range records {
-		index[record.Checksum] = record.Path
+	ignored, err := f.ignoredChecksums()
+	if err != nil {
+		return 0, err
 	}
 
-	return index
+	var candidates dupfind.Index
+	if f.Partial && !f.Self && !f.Missing {
+		candidates = index
+	}
+	// without --self, files whose size is not indexed cannot be duplicates
+	keep := index.HasSize
+	if f.Self {
+		keep = func(int64) bool { return true }
+	}
+
+	stats := newScanStats(ctx)
+	f.limit(stats)
+	paths := make(chan string)
+	workers := f.Workers
+	if f.Tail {
+		if f.Path != "-" {
+			return 0, errors.New("--tail reads paths from stdin, pass - as path")
+		}
+		if f.Ordered {
+			return 0, errors.New("--ordered cannot be combined with --tail, which reports files as they arrive")
+		}
+		// hash paths one at a time so results are reported as they arrive
+		workers, hasher.StatWorkers, hasher.HashWorkers = 1, 0, 0
+	}
+	go produceInputPaths(f.Path, f.Null, paths, walker, stats)
+	var input <-chan string = paths
+	if rollup != nil {
+		input = rollup.CountPaths(paths)
+	}
+	var metadata <-chan dupfind.Metadata
+	if f.Missing {
+		// files whose size is not indexed are missing without hashing them
+		kept, rejected := dupfind.PartitionBySize(input, index.HasSize, hasher, stats)
+		metadata = mergeMetadata(dupfind.HashStatedFiles(kept, workers, hasher, nil, stats), rejected)
+	} else {
+		metadata = dupfind.HashStatedFiles(dupfind.FilterBySize(input, keep, hasher, stats), workers, hasher, candidates, stats)
+	}
+	if !f.Tail {
+		if stop := f.startProgress([]string{f.Path}, walker, stats); stop != nil {
+			metadata = stopWhenDone(metadata, stop)
+		}
+	}
+	if f.Ordered {
+		// workers finish files in any order
+		metadata = sortMetadata(metadata)
+	}
+	matcher := &dupfind.Matcher{Index: index, Ignore: ignored, Perceptual: f.Perceptual, MaxDistance: f.MaxDistance,
+		Chunks: f.Chunks, MinShared: f.MinShared, SkipSelf: !f.AllowOverlap && !f.Missing && f.overlaps(indexes),
+		Xattrs: hasher.Xattrs == dupfind.XattrsRecord && index.Header().Xattrs == dupfind.XattrsRecord}
+	if f.IgnoreHardlinks {
+		matcher.Links = make(dupfind.LinkSet)
+	}
+	if f.Self {
+		matcher.Scanned = make(map[string][]dupfind.Metadata)
+	}
+	if f.Missing {
+		lookupMissing(metadata, matcher, out)
+	} else {
+		lookupRecords(metadata, matcher, out, f.Rm)
+	}
+	if err := out.Close(); err != nil {
+		return out.matches, err
+	}
+	stats.Report()
+	f.summarize(out, stats, summary)
+
+	return out.matches, budgetErr(stats.Err())
+}
+
+// overlaps reports whether the files looked up may lie inside one of the
+// directories indexed, where they would match themselves. Files named on
+// stdin may lie anywhere.
+func (f *FindCmd) overlaps(indexes []dupfind.Index) bool {
+
+	if f.Path == "-" {
+		return true
+	}
+	if dupfind.IsRemote(f.Path) {
+		return false
+	}
+	overlaps := false
+	for i, index := range indexes {
+		for _, root := range index.Header().AllRoots() {
+			if !dupfind.IsRemote(root) && dupfind.PathsOverlap(f.Path, root) {
+				dupfind.Log.Infof("%s overlaps %s, indexed in %s: files are not reported as duplicates of themselves",
+					f.Path, root, f.Indexes[i])
+				overlaps = true
+			}
+		}
+	}
+
+	return overlaps
+}
+
+// checkDirs checks that the options of a find --dirs run allow rolling
+// matches up to the directories below the path looked up.
+func (f *FindCmd) checkDirs() error {
+
+	if f.Rm || f.Missing || f.Tail || f.Archives || f.Streams || f.Long || f.Print0 || f.Exec != "" || len(f.By) > 0 {
+		return errors.New("--dirs cannot be combined with --rm, --missing, --tail, --archives, --streams, --long, --print0, --exec or --by")
+	}
+	if f.Path == "-" || dupfind.IsRemote(f.Path) {
+		return errors.New("--dirs needs a local directory to look up")
+	}
+	if info, err := os.Stat(f.Path); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("--dirs needs a directory to look up, %s is not one", f.Path)
+	}
+
+	return nil
 }
 
-func lookupRecords(metadata <-chan Metadata, index map[string]string, short bool, rm bool) {
+// matchWriter returns the writer for the matches reported, which runs
+// the --exec command for each. With rollup, the matches are rolled up to
+// directories before they are written.
+func (f *FindCmd) matchWriter(format string, rollup *dupfind.DirRollup) (*countingMatchWriter, error) {
+	out := newMatchWriter(format, os.Stdout, f.Short, f.Fields)
+	if rollup != nil {
+		out = &dirMatchWriter{out: out, rollup: rollup}
+	}
+	if f.Exec != "" {
+		e, err := newExecMatchWriter(f.Exec, out)
+		if err != nil {
+			return nil, err
+		}
+		out = e
+	}
+	return &countingMatchWriter{MatchWriter: out}, nil
+}
+
+// loadIndex opens the index file name for lookups, on disk with
+// --low-memory. If the index has a current Bloom filter, it is only
+// loaded once a file may match. The returned function removes the
+// temporary copy of the index that --low-memory makes.
+func (f *FindCmd) loadIndex(name string) (dupfind.Index, func(), error) {
+
+	remove := func() {}
+	load := func() (dupfind.Index, error) {
+		if !f.LowMemory {
+			return dupfind.LoadIndex(name)
+		}
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			dir = os.TempDir()
+		}
+		start := time.Now()
+		index, cleanup, err := dupfind.LoadIndexOnDisk(name, filepath.Join(dir, "dupfind"))
+		if err != nil {
+			return nil, err
+		}
+		dupfind.Log.Debugf("Copied %s to disk in %v", name, time.Since(start).Round(time.Millisecond))
+		remove = cleanup
+		return index, nil
+	}
+
+	// with a Bloom filter, the index is only loaded once a file may match
+	index, err := dupfind.OpenBloomIndex(name, load)
+	switch {
+	case err == nil:
+		return index, func() { remove() }, nil
+	case errors.Is(err, dupfind.ErrStaleBloomFilter):
+		dupfind.Log.Warnf("Warning: %s is out of date and was not used; run update --bloom to rewrite it", dupfind.BloomFile(name))
+	case !errors.Is(err, fs.ErrNotExist):
+		dupfind.Log.Warnf("Warning: cannot use %s: %v", dupfind.BloomFile(name), err)
+	}
+	index, err = load()
+
+	return index, remove, err
+}
+
+// summarize logs how many files were looked up and reported, unless the
+// run was aborted other than by its budget.
+func (f *FindCmd) summarize(out *countingMatchWriter, stats *dupfind.ScanStats, summary *runSummary) {
+	budget := errors.Is(stats.Err(), dupfind.ErrBudget)
+	if stats.Aborted() && !budget {
+		return
+	}
+	reported := "duplicates"
+	if f.Missing {
+		reported = "missing"
+		summary.Summary = fmt.Sprintf("Checked %d files, %d not in the index (%s)", stats.Files.Load(), out.matches, formatBytes(out.size))
+	} else {
+		summary.Summary = fmt.Sprintf("Checked %d files, %d duplicates (%s duplicated)", stats.Files.Load(), out.matches, formatBytes(out.size))
+	}
+	if budget {
+		summary.Summary += ", stopped once the budget was used up"
+	}
+	summary.Counts = map[string]int64{"files": stats.Files.Load(), reported: int64(out.matches), "bytes": out.size, "errors": stats.Failed.Load()}
+	dupfind.Log.Infof("%s", summary.Summary)
+}
+
+// lookupRecords reports records that duplicate an indexed file, removing
+// them if rm is set.
+func lookupRecords(metadata <-chan dupfind.Metadata, matcher *dupfind.Matcher, out MatchWriter, rm bool) {
+	for record := range metadata {
+		match, ok := matcher.Match(record)
+		if !ok {
+			continue
+		}
+		if archive, _, ok := dupfind.ArchiveMember(record.Path); rm && ok {
+			dupfind.Log.With("path", record.Path).Warnf("Not removing %s, it is inside archive %s", record.Path, archive)
+		} else if file, _, ok := dupfind.FileStream(record.Path); rm && ok {
+			dupfind.Log.With("path", record.Path).Warnf("Not removing %s, it is a stream of %s", record.Path, file)
+		} else if rm && match.Self {
+			dupfind.Log.With("path", record.Path).Warnf("Not removing %s, it duplicates %s which is not indexed", record.Path, match.IndexPath)
+		} else if rm && match.Similar {
+			dupfind.Log.With("path", record.Path).Warnf("Not removing %s, it is only similar to %s", record.Path, match.IndexPath)
+		} else if rm {
+			err := os.Remove(record.Path)
+			if err != nil {
+				dupfind.Log.With("path", record.Path, "error", err).Warnf("%v", err)
+				continue
+			}
+			match.Removed = true
+		}
+		if err := out.Write(match); err != nil {
+			dupfind.Log.Errorf("Error writing output: %v", err)
+		}
+	}
+}
+
+// findBy reports the files with the same name or size as an indexed file,
+// as selected by --by, without hashing them.
+func (f *FindCmd) findBy(ctx *Context, walker *dupfind.Walker, out *countingMatchWriter, summary *runSummary) (int, error) {
+
+	if f.Rm || f.Self || f.IgnoreHashes != "" || f.Perceptual || f.Chunks || f.Archives || f.Streams || f.Tail {
+		return 0, errors.New("--by cannot be combined with --rm, --self, --ignore-hashes, --perceptual, --chunks, --archives, --streams or --tail")
+	}
+	var byName, bySize bool
+	for _, by := range f.By {
+		byName = byName || by == "name"
+		bySize = bySize || by == "size"
+	}
+	key := func(record dupfind.Metadata) string {
+		var key string
+		if byName {
+			key = dupfind.PathKey(filepath.Base(record.Path))
+		}
+		if bySize {
+			key += "\x00" + strconv.FormatInt(record.Size, 10)
+		}
+		return key
+	}
+
+	indexed := make(map[string][]dupfind.Metadata)
+	for _, name := range f.Indexes {
+		header, records, err := dupfind.ReadIndex(name)
+		if err != nil {
+			return 0, err
+		}
+		warnPartial(name, header)
+		for _, record := range dupfind.RootRecords(header, records, f.Root) {
+			indexed[key(record)] = append(indexed[key(record)], record)
+		}
+	}
+
+	stats := newScanStats(ctx)
+	paths := make(chan string)
+	go produceInputPaths(f.Path, f.Null, paths, walker, stats)
+	stated := dupfind.StatFilePaths(paths, stats)
+	if f.Ordered {
+		stated = sortMetadata(stated)
+	}
+	for record := range stated {
+		records := indexed[key(record)]
+		if f.IgnoreHardlinks && dupfind.AnySameInode(record, records) {
+			continue
+		}
+		match := dupfind.Match{Path: record.Path, Size: record.Size, ModTime: record.ModTime, Mode: record.Mode}
+		if len(records) > 0 && !f.Missing {
+			match.Similar, match.IndexPath = true, records[0].Path
+			match.IndexSize, match.IndexModTime = records[0].Size, records[0].ModTime
+			match.IndexPaths = make([]string, len(records))
+			for i, indexed := range records {
+				match.IndexPaths[i] = indexed.Path
+			}
+		} else if len(records) == 0 && f.Missing {
+			match.Missing = true
+		} else {
+			continue
+		}
+		if err := out.Write(match); err != nil {
+			dupfind.Log.Errorf("Error writing output: %v", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return out.matches, err
+	}
+	stats.Report()
+	f.summarize(out, stats, summary)
+
+	return out.matches, stats.Err()
+}
+
+// lookupMissing reports records that do not duplicate an indexed file.
+// Records without a checksum were ruled out without hashing them.
+func lookupMissing(metadata <-chan dupfind.Metadata, matcher *dupfind.Matcher, out MatchWriter) {
 	for record := range metadata {
-		indexPath, duplicate := index[record.Checksum]
-		if duplicate {
-			if rm {
-				err := os.Remove(record.Path)
-				if err != nil {
-					log.Println(err)
-				} else {
-					fmt.Printf("Removed %s\n", record.Path)
-				}
-			} else if short {
-				file := filepath.Base(record.Path)
-				fmt.Println(file)
-			} else {
-				fmt.Printf("File %s is duplicate with index file %s\n",
-					record.Path, indexPath)
+		if record.Checksum != "" {
+			if _, ok := matcher.Match(record); ok {
+				continue
 			}
 		}
+		missing := dupfind.Match{Path: record.Path, Size: record.Size, Missing: true}
+		if record.Checksum != "" {
+			missing.Checksum = dupfind.ChecksumKey(record.Algorithm, record.Checksum)
+		}
+		if err := out.Write(missing); err != nil {
+			dupfind.Log.Errorf("Error writing output: %v", err)
+		}
 	}
 }
 
 var cli struct {
-	Build BuildCmd `cmd:"" help:"Build index"`
-	Find  FindCmd  `cmd:"" help:"Look up files in index"`
+	Version          kong.VersionFlag `help:"Print version and exit"`
+	Config           configFlag       `help:"Read default settings from FILE instead of ${config_path}." placeholder:"FILE"`
+	ErrorsFatal      bool             `help:"Abort on the first file that cannot be read, instead of skipping it"`
+	Quiet            bool             `short:"q" help:"Only log errors, not warnings about individual files" xor:"verbosity"`
+	Verbose          bool             `short:"v" help:"Also log debugging messages, such as each file hashed" xor:"verbosity"`
+	LogFormat        string           `help:"Format of log messages (${enum})." enum:"text,json" default:"text"`
+	CaseInsensitive  bool             `help:"Treat paths that differ only in case as the same file (default on Windows)." default:"${case_insensitive}" negatable:""`
+	NormalizeUnicode bool             `help:"Treat paths that differ only in their Unicode normalization as the same file, as names copied between macOS and Linux often do. Pass --no-normalize-unicode to compare them byte by byte." default:"true" negatable:""`
+	PassphraseFile   string           `help:"Read the passphrase of encrypted indexes from the first line of FILE. It can also be set with the DUPFIND_PASSPHRASE environment variable." placeholder:"FILE" type:"path"`
+
+	Build      BuildCmd       `cmd:"" help:"Build index"`
+	Find       FindCmd        `cmd:"" help:"Look up files in index"`
+	Dedupe     DedupeCmd      `cmd:"" help:"Remove or link files that duplicate indexed files"`
+	Update     UpdateCmd      `cmd:"" help:"Update index, re-hashing only changed files"`
+	Scan       ScanCmd        `cmd:"" help:"Find duplicates within a directory without an index"`
+	Merge      MergeCmd       `cmd:"" help:"Combine several index files into one"`
+	Verify     VerifyCmd      `cmd:"" help:"Re-hash indexed files to detect changes and corruption"`
+	Prune      PruneCmd       `cmd:"" help:"Remove entries for deleted files from an index"`
+	CheckIndex CheckIndexCmd  `cmd:"" name:"check-index" help:"Check an index for paths recorded more than once and checksum collisions"`
+	Diff       DiffCmd        `cmd:"" help:"Compare two directory trees or indexes by content"`
+	Compare    CompareCmd     `cmd:"" help:"Compare the contents of two indexes without reading any files"`
+	Stats      StatsCmd       `cmd:"" help:"Summarize the contents of an index"`
+	Report     ReportCmd      `cmd:"" help:"List duplicates in an index by wasted space"`
+	Top        TopCmd         `cmd:"" help:"List the largest duplicated files and the directories with the most duplicated bytes"`
+	Review     ReviewCmd      `cmd:"" help:"Choose interactively which duplicates in an index to remove or link"`
+	Apply      ApplyCmd       `cmd:"" help:"Carry out a plan written by dedupe or review --plan"`
+	Undo       UndoCmd        `cmd:"" help:"Restore the files replaced by the last dedupe, apply or review run as copies of their own"`
+	History    HistoryCmd     `cmd:"" help:"Show when files and content were added to and removed from an index kept with --history"`
+	Lookup     IndexLookupCmd `cmd:"" help:"Print the indexed files with a checksum"`
+	CopyUnique CopyUniqueCmd  `cmd:"" name:"copy-unique" help:"Copy the files whose content is not in an index"`
+	Export     ExportCmd      `cmd:"" help:"Write an index as sha256sum, BSD or hashdeep checksums"`
+	Import     ImportCmd      `cmd:"" help:"Build an index from sha256sum, BSD or hashdeep checksums"`
+	Watch      WatchCmd       `cmd:"" help:"Keep an index up to date as files change"`
+	Serve      ServeCmd       `cmd:"" help:"Serve lookups in an index over HTTP"`
+	Client     ClientCmd      `cmd:"" help:"Query a running dupfind server"`
+	Bench      BenchCmd       `cmd:"" help:"Measure hashing speed with different worker counts, buffer sizes and algorithms"`
+	Keygen     KeygenCmd      `cmd:"" help:"Generate a key pair for signing indexes"`
+	Migrate    MigrateCmd     `cmd:"" help:"Upgrade an index to the current format, filling in missing file metadata"`
+	Completion CompletionCmd  `cmd:"" help:"Print a completion script for bash, zsh or fish"`
+	Man        ManCmd         `cmd:"" help:"Print the manual page"`
 }
 
 func main() {
-	ctx := kong.Parse(&cli)
-	err := ctx.Run(&Context{})
+	conf := &config{}
+	if path := defaultConfigPath(); path != "" {
+		if err := conf.load(path, false); err != nil {
+			log.Fatal(err)
+		}
+	}
+	ctx := kong.Parse(&cli, kong.Vars{
+		"partial_size":     formatBytes(dupfind.PartialSize),
+		"version":          dupfind.Version,
+		"serve_address":    defaultServeAddress,
+		"config_path":      defaultConfigPath(),
+		"cache_path":       defaultCachePath(),
+		"fields":           "path, checksum, size, mtime, mode, allocated",
+		"case_insensitive": strconv.FormatBool(dupfind.CaseInsensitivePaths),
+	}, kong.Resolvers(conf), kong.Bind(conf), kong.NamedMapper("source", sourceMapper{}))
+
+	if cli.Quiet {
+		dupfind.Log.SetLevel(dupfind.LevelError)
+	} else if cli.Verbose {
+		dupfind.Log.SetLevel(dupfind.LevelDebug)
+	}
+	dupfind.Log.SetJSON(cli.LogFormat == "json")
+	dupfind.CaseInsensitivePaths = cli.CaseInsensitive
+	dupfind.NormalizedPaths = cli.NormalizeUnicode
+	passphrase, err := readPassphrase(cli.PassphraseFile)
 	ctx.FatalIfErrorf(err)
+	dupfind.IndexPassphrase = passphrase
+
+	// stop cleanly on the first signal, and restore the default behavior
+	// so that a second one terminates immediately
+	interrupted, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupted.Done()
+		stop()
+	}()
+
+	err = ctx.Run(&Context{Context: interrupted, ErrorsFatal: cli.ErrorsFatal, Index: conf.Index()})
+	// commands may choose their exit status, as find --exit-code does
+	var status *exitStatus
+	if errors.As(err, &status) {
+		err = status.err
+	}
+	if errors.Is(err, context.Canceled) {
+		err = errors.New("interrupted")
+	}
+	if status == nil {
+		ctx.FatalIfErrorf(err)
+		return
+	}
+	if err != nil {
+		ctx.Errorf("%s", err)
+	}
+	os.Exit(status.code)
 }
@@ -0,0 +1,165 @@
+package dupfind
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ArchiveSeparator separates the path of an archive from the name of a
+// member in the paths of archive members, as in backup.zip!photos/a.jpg.
+const ArchiveSeparator = "!"
+
+var archiveExtensions = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+func isArchive(path string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hasher) scansArchive(path string) bool {
+	return h.Archives && isArchive(path) && !IsRemote(path)
+}
+
+// ArchiveMember splits the path of an archive member into the path of the
+// archive and the member's name. It returns false for other paths.
+func ArchiveMember(path string) (string, string, bool) {
+	for i := 0; i < len(path); i++ {
+		if strings.HasPrefix(path[i:], ArchiveSeparator) && isArchive(path[:i]) {
+			return path[:i], path[i+len(ArchiveSeparator):], true
+		}
+	}
+	return "", "", false
+}
+
+// archiveEntry is a regular file in an archive.
+type archiveEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+	open    func() (io.ReadCloser, error)
+}
+
+// hashArchive sends a record for every regular file in the archive at
+// path. If candidates is not nil, members of a size that does not occur in
+// it are skipped.
+func hashArchive(path string, metadata chan<- Metadata, hasher *Hasher, candidates Index, stats *ScanStats) {
+
+	err := readArchive(path, func(entry archiveEntry) error {
+		if stats.Aborted() {
+			return errAborted
+		}
+		stats.Files.Add(1)
+		member := path + ArchiveSeparator + entry.name
+		if candidates != nil && !candidates.HasSize(entry.size) {
+			stats.Skipped.Add(1)
+			return nil
+		}
+
+		r, err := entry.open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		algorithm := hasher.AlgorithmFor(entry.name)
+		checksum, partial, n, err := hasher.checksumReader(hasher.Throttle.Reader(r), algorithm)
+		stats.Hashed.Add(n)
+		if err != nil {
+			return err
+		}
+
+		record := Metadata{
+			Path:     member,
+			Checksum: checksum,
+			Partial:  partial,
+			Size:     entry.size,
+			ModTime:  entry.modTime,
+		}
+		if algorithm != DefaultAlgorithm {
+			record.Algorithm = algorithm
+		}
+		metadata <- record
+		return nil
+	})
+	if err != nil && err != errAborted {
+		stats.Fail(path, err)
+	}
+}
+
+// errAborted stops reading an archive when the run is aborted.
+var errAborted = errors.New("aborted")
+
+// readArchive calls fn for each regular file in the archive at path.
+func readArchive(path string, fn func(archiveEntry) error) error {
+
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		zr, err := zip.OpenReader(longPath(path))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			err := fn(archiveEntry{
+				name:    f.Name,
+				size:    int64(f.UncompressedSize64),
+				modTime: f.Modified,
+				open:    f.Open,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if !strings.HasSuffix(strings.ToLower(path), ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		err = fn(archiveEntry{
+			name:    header.Name,
+			size:    header.Size,
+			modTime: header.ModTime,
+			open:    func() (io.ReadCloser, error) { return io.NopCloser(tr), nil },
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
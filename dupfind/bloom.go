@@ -0,0 +1,336 @@
+package dupfind
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrStaleBloomFilter is returned by OpenBloomIndex if the index was
+// written after its Bloom filter.
+var ErrStaleBloomFilter = errors.New("Bloom filter is older than the index")
+
+const (
+	// bloomBitsPerEntry and bloomHashes give about 1% false positives.
+	bloomBitsPerEntry = 10
+	bloomHashes       = 7
+)
+
+// BloomFile returns the name of the Bloom filter of index.
+func BloomFile(index string) string {
+	return index + ".bloom"
+}
+
+// bloomHeader is the first line of a Bloom filter file, followed by the
+// bits of the filter as little-endian 64-bit words.
+type bloomHeader struct {
+	// IndexSize and IndexModTime identify the index file the filter was
+	// computed from.
+	IndexSize    int64       `json:"index_size"`
+	IndexModTime time.Time   `json:"index_mod_time"`
+	Index        IndexHeader `json:"index"`
+	Algorithms   []string    `json:"algorithms"`
+	// Sizes and Partials tell whether all records have a modification
+	// time and partial checksum, and so whether the filter holds their
+	// sizes and partial checksums as a mapIndex would.
+	Sizes    bool   `json:"sizes"`
+	Partials bool   `json:"partials"`
+	Bits     uint64 `json:"bits"`
+	Hashes   int    `json:"hashes"`
+}
+
+type bloomFilter struct {
+	words  []uint64
+	hashes int
+}
+
+func newBloomFilter(entries int) *bloomFilter {
+	words := (entries*bloomBitsPerEntry + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return &bloomFilter{words: make([]uint64, words), hashes: bloomHashes}
+}
+
+// positions calls f with the bit positions of entry, derived from one
+// 64-bit hash by double hashing.
+func (b *bloomFilter) positions(entry string, f func(uint64) bool) bool {
+
+	n := uint64(len(b.words)) * 64
+	h1 := xxhash.Sum64String(entry)
+	h2 := bits.RotateLeft64(h1, 32) | 1
+	for i := 0; i < b.hashes; i++ {
+		if !f((h1 + uint64(i)*h2) % n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) add(entry string) {
+	b.positions(entry, func(bit uint64) bool {
+		b.words[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+func (b *bloomFilter) has(entry string) bool {
+	return b.positions(entry, func(bit uint64) bool {
+		return b.words[bit/64]&(1<<(bit%64)) != 0
+	})
+}
+
+// Entries of the filter are prefixed by what they stand for.
+func bloomKey(key string) string {
+	return "k:" + key
+}
+
+func bloomSize(size int64) string {
+	return "s:" + strconv.FormatInt(size, 10)
+}
+
+func bloomPartial(size int64, key string) string {
+	return "p:" + partialKey(size, key)
+}
+
+// eachRecord passes the records of index to add. JSON indexes are
+// streamed, so that they need not fit into memory.
+func eachRecord(index string, add func(Metadata) error) (IndexHeader, error) {
+
+	if isSQLitePath(index) {
+		header, records, err := sqliteStore(index).Read()
+		if err != nil {
+			return header, err
+		}
+		for _, record := range records {
+			if err := add(record); err != nil {
+				return header, err
+			}
+		}
+		return header, nil
+	}
+
+	r, err := jsonStore{path: index}.open()
+	if err != nil {
+		return IndexHeader{}, err
+	}
+	defer r.Close()
+	header, err := streamRecords(r, add)
+	if err != nil {
+		return header, err
+	}
+	return header, checkIndexVersion(header)
+}
+
+// WriteBloomFilter writes a Bloom filter of the checksums, sizes and
+// partial checksums in index to BloomFile(index). The index is read twice,
+// first to size the filter, but never held in memory.
+func WriteBloomFilter(index string) error {
+
+	info, err := os.Stat(index)
+	if err != nil {
+		return err
+	}
+	header := bloomHeader{IndexSize: info.Size(), IndexModTime: info.ModTime().UTC(), Sizes: true, Partials: true, Hashes: bloomHashes}
+	var entries int
+	algorithms := make(map[string]bool)
+	_, err = eachRecord(index, func(record Metadata) error {
+		entries += 3
+		algorithms[RecordAlgorithm(record)] = true
+		header.Sizes = header.Sizes && !record.ModTime.IsZero()
+		header.Partials = header.Partials && record.Partial != ""
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for algorithm := range algorithms {
+		header.Algorithms = append(header.Algorithms, algorithm)
+	}
+	sort.Strings(header.Algorithms)
+
+	filter := newBloomFilter(entries)
+	header.Index, err = eachRecord(index, func(record Metadata) error {
+		filter.add(bloomKey(ChecksumKey(record.Algorithm, record.Checksum)))
+		if header.Sizes {
+			filter.add(bloomSize(record.Size))
+		}
+		if header.Partials {
+			filter.add(bloomPartial(record.Size, partialKeyOf(record)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	header.Bits = uint64(len(filter.words)) * 64
+
+	name := BloomFile(index)
+	tmp, err := createTemp(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = json.NewEncoder(w).Encode(header)
+	if err == nil {
+		err = binary.Write(w, binary.LittleEndian, filter.words)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return renameTemp(tmp, name)
+}
+
+// readBloomHeader reads the header of a Bloom filter file and checks that
+// it was computed from the current contents of index.
+func readBloomHeader(index string, r *bufio.Reader) (bloomHeader, error) {
+
+	var header bloomHeader
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return header, fmt.Errorf("reading Bloom filter: %w", err)
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return header, fmt.Errorf("reading Bloom filter: %w", err)
+	}
+	info, err := os.Stat(index)
+	if err != nil {
+		return header, err
+	}
+	if info.Size() != header.IndexSize || !info.ModTime().Equal(header.IndexModTime) {
+		return header, ErrStaleBloomFilter
+	}
+
+	return header, nil
+}
+
+// BloomFilterCurrent reports whether index has a Bloom filter computed
+// from its current contents.
+func BloomFilterCurrent(index string) bool {
+
+	f, err := os.Open(BloomFile(index))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = readBloomHeader(index, bufio.NewReader(f))
+
+	return err == nil
+}
+
+// OpenBloomIndex returns an index that answers lookups from the Bloom
+// filter of index, and calls load to read the index itself only once a
+// lookup may match. The error wraps fs.ErrNotExist if index has no
+// filter, or is ErrStaleBloomFilter if it is out of date.
+func OpenBloomIndex(index string, load func() (Index, error)) (Index, error) {
+
+	f, err := os.Open(BloomFile(index))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header, err := readBloomHeader(index, r)
+	if err != nil {
+		return nil, err
+	}
+	if header.Bits == 0 || header.Bits%64 != 0 || header.Hashes <= 0 {
+		return nil, fmt.Errorf("reading Bloom filter: invalid size")
+	}
+	filter := &bloomFilter{words: make([]uint64, header.Bits/64), hashes: header.Hashes}
+	if err := binary.Read(r, binary.LittleEndian, filter.words); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("reading Bloom filter: %w", err)
+	}
+
+	algorithms := make(map[string]bool)
+	for _, algorithm := range header.Algorithms {
+		algorithms[algorithm] = true
+	}
+	return &bloomIndex{name: index, header: header, algorithms: algorithms, filter: filter, load: load}, nil
+}
+
+// bloomIndex answers lookups of checksums that are not indexed from a
+// Bloom filter, and loads the index for the others.
+type bloomIndex struct {
+	name       string
+	header     bloomHeader
+	algorithms map[string]bool
+	filter     *bloomFilter
+
+	load   func() (Index, error)
+	once   sync.Once
+	loaded Index
+}
+
+// index loads the index on first use. If it cannot be read, nothing is
+// found in it.
+func (b *bloomIndex) index() Index {
+	b.once.Do(func() {
+		start := time.Now()
+		index, err := b.load()
+		if err != nil {
+			Log.Errorf("Error loading index after a match in its Bloom filter: %v", err)
+			index = NewMapIndex(b.header.Index, nil)
+		}
+		Log.Debugf("Loaded %s after a match in its Bloom filter in %v", b.name, time.Since(start).Round(time.Millisecond))
+		b.loaded = index
+	})
+	return b.loaded
+}
+
+func (b *bloomIndex) Lookup(key string) []Metadata {
+	if !b.filter.has(bloomKey(key)) {
+		return nil
+	}
+	return b.index().Lookup(key)
+}
+
+func (b *bloomIndex) HasSize(size int64) bool {
+	return !b.header.Sizes || b.filter.has(bloomSize(size))
+}
+
+func (b *bloomIndex) HasPartial(size int64, key string) bool {
+	return !b.header.Partials || b.filter.has(bloomPartial(size, key))
+}
+
+func (b *bloomIndex) Algorithms() map[string]bool {
+	return b.algorithms
+}
+
+func (b *bloomIndex) Similar(perceptual string, maxDistance int) []Metadata {
+	return b.index().Similar(perceptual, maxDistance)
+}
+
+func (b *bloomIndex) Overlapping(chunks []string, minShare int) ([]Metadata, []int) {
+	return b.index().Overlapping(chunks, minShare)
+}
+
+func (b *bloomIndex) Header() IndexHeader {
+	return b.header.Index
+}
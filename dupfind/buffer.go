@@ -0,0 +1,52 @@
+package dupfind
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// directAlign is the alignment that direct I/O requires of buffers, their
+// sizes and file offsets.
+const directAlign = 4096
+
+// defaultDirectBuffer is the read buffer size for direct I/O if none is
+// set, as reads without the page cache must be large to be fast.
+const defaultDirectBuffer = 1 << 20
+
+// bufferPools holds a *sync.Pool of read buffers for each buffer size, so
+// that workers reuse buffers instead of allocating one per file.
+var bufferPools sync.Map
+
+// getBuffer returns a buffer of size bytes, aligned for direct I/O.
+func getBuffer(size int) *[]byte {
+	pool, _ := bufferPools.LoadOrStore(size, &sync.Pool{New: func() any {
+		b := make([]byte, size+directAlign)
+		offset := (directAlign - int(uintptr(unsafe.Pointer(&b[0]))%directAlign)) % directAlign
+		b = b[offset : offset+size : offset+size]
+		return &b
+	}})
+	return pool.(*sync.Pool).Get().(*[]byte)
+}
+
+// putBuffer returns a buffer from getBuffer to its pool.
+func putBuffer(buf *[]byte) {
+	if pool, ok := bufferPools.Load(len(*buf)); ok {
+		pool.(*sync.Pool).Put(buf)
+	}
+}
+
+// readBuffer returns the buffer to hash files with, or nil to let io.Copy
+// allocate one.
+func (h *Hasher) readBuffer() *[]byte {
+	size := h.BufferSize
+	if h.DirectIO {
+		if size == 0 {
+			size = defaultDirectBuffer
+		}
+		size = (size + directAlign - 1) / directAlign * directAlign
+	}
+	if size <= 0 {
+		return nil
+	}
+	return getBuffer(size)
+}
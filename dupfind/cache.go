@@ -0,0 +1,84 @@
+package dupfind
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+)
+
+const cacheSchema = `
+CREATE TABLE IF NOT EXISTS hashes (
+	path      TEXT NOT NULL,
+	algorithm TEXT NOT NULL,
+	size      INTEGER NOT NULL,
+	mtime     INTEGER NOT NULL,
+	checksum  TEXT NOT NULL,
+	partial   TEXT NOT NULL,
+	PRIMARY KEY (path, algorithm)
+);
+`
+
+// HashCache remembers the checksums of files across runs, so that files
+// whose size and modification time are unchanged are not hashed again.
+type HashCache struct {
+	db     *sql.DB
+	lookup *sql.Stmt
+	store  *sql.Stmt
+}
+
+// cached is a checksum remembered by a HashCache.
+type cached struct {
+	checksum string
+	partial  string
+}
+
+// OpenHashCache opens the cache at path, creating it if needed.
+func OpenHashCache(path string) (*HashCache, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	// losing the last entries in a crash only costs hashing them again
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(OFF)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(cacheSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	c := &HashCache{db: db}
+	if c.lookup, err = db.Prepare("SELECT checksum, partial FROM hashes WHERE path = ? AND algorithm = ? AND size = ? AND mtime = ?"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if c.store, err = db.Prepare("INSERT OR REPLACE INTO hashes VALUES (?, ?, ?, ?, ?, ?)"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Close closes the cache.
+func (c *HashCache) Close() error {
+	return c.db.Close()
+}
+
+// get returns the checksum of the file at path hashed with algorithm, if
+// it was cached for a file of the same size and modification time.
+func (c *HashCache) get(path, algorithm string, info os.FileInfo) (cached, bool) {
+	var entry cached
+	err := c.lookup.QueryRow(path, algorithm, info.Size(), info.ModTime().UnixNano()).Scan(&entry.checksum, &entry.partial)
+	return entry, err == nil
+}
+
+// put remembers the checksum of the file at path. Errors are logged, as
+// the cache only saves work.
+func (c *HashCache) put(path, algorithm string, info os.FileInfo, entry cached) {
+	_, err := c.store.Exec(path, algorithm, info.Size(), info.ModTime().UnixNano(), entry.checksum, entry.partial)
+	if err != nil {
+		Log.With("path", path, "error", err).Warnf("Could not cache checksum of %s: %v", path, err)
+	}
+}
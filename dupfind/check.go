@@ -0,0 +1,128 @@
+package dupfind
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Kinds of IndexProblem.
+const (
+	// ProblemDuplicate is a path recorded more than once with the same
+	// content, as left by overlapping runs or merges.
+	ProblemDuplicate = "duplicate"
+	// ProblemConflict is a path recorded more than once with different
+	// content.
+	ProblemConflict = "conflict"
+	// ProblemCollision is a checksum shared by files of different sizes,
+	// which cannot have the same content.
+	ProblemCollision = "collision"
+	// ProblemChecksum is a checksum that is not one of its algorithm.
+	ProblemChecksum = "checksum"
+)
+
+// IndexProblem is an inconsistency in the records of an index. Other is
+// the path of the record Path collides with, and Detail describes the
+// problem.
+type IndexProblem struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path"`
+	Other  string `json:"other,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// CheckRecords returns the problems found in records, ordered by path.
+// Paths are compared as PathKey does, so that records differing only in
+// case are the same path where that is so on disk.
+func CheckRecords(records []Metadata) []IndexProblem {
+
+	var problems []IndexProblem
+	byPath := make(map[string][]int)
+	byKey := make(map[string]int)
+	for i, record := range records {
+		byPath[PathKey(record.Path)] = append(byPath[PathKey(record.Path)], i)
+		if IsSpecial(record.Mode) {
+			continue
+		}
+		if detail := checkChecksum(record); detail != "" {
+			problems = append(problems, IndexProblem{Kind: ProblemChecksum, Path: record.Path, Detail: detail})
+			continue
+		}
+		key := ChecksumKey(record.Algorithm, record.Checksum)
+		j, ok := byKey[key]
+		if !ok {
+			byKey[key] = i
+			continue
+		}
+		if other := records[j]; other.Size != record.Size && !SamePath(other.Path, record.Path) {
+			problems = append(problems, IndexProblem{
+				Kind:   ProblemCollision,
+				Path:   record.Path,
+				Other:  other.Path,
+				Detail: fmt.Sprintf("checksum %s is recorded for %d and %d bytes", key, record.Size, other.Size),
+			})
+		}
+	}
+
+	for _, indexes := range byPath {
+		if len(indexes) < 2 {
+			continue
+		}
+		first := records[indexes[0]]
+		problem := IndexProblem{
+			Kind:   ProblemDuplicate,
+			Path:   first.Path,
+			Detail: fmt.Sprintf("recorded %d times", len(indexes)),
+		}
+		for _, i := range indexes[1:] {
+			if !sameContent(first, records[i]) {
+				problem.Kind = ProblemConflict
+				problem.Detail = fmt.Sprintf("recorded %d times with different content", len(indexes))
+				break
+			}
+		}
+		problems = append(problems, problem)
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Path < problems[j].Path })
+
+	return problems
+}
+
+// checkChecksum describes what is wrong with the checksum of record, if
+// anything.
+func checkChecksum(record Metadata) string {
+
+	algorithm := RecordAlgorithm(record)
+	newHash, ok := HashAlgorithms[algorithm]
+	if !ok {
+		return fmt.Sprintf("unknown hash algorithm %q", algorithm)
+	}
+	decoded, err := hex.DecodeString(record.Checksum)
+	if err != nil || len(decoded) != newHash().Size() {
+		return fmt.Sprintf("invalid %s checksum %q", algorithm, record.Checksum)
+	}
+
+	return ""
+}
+
+func sameContent(a, b Metadata) bool {
+	return a.Size == b.Size && ChecksumKey(a.Algorithm, a.Checksum) == ChecksumKey(b.Algorithm, b.Checksum)
+}
+
+// UniqueRecords returns records with each path recorded once, keeping the
+// last of its records as merge does, and the number of records dropped.
+func UniqueRecords(records []Metadata) ([]Metadata, int) {
+
+	last := make(map[string]int, len(records))
+	for i, record := range records {
+		last[PathKey(record.Path)] = i
+	}
+	unique := make([]Metadata, 0, len(last))
+	for i, record := range records {
+		if last[PathKey(record.Path)] == i {
+			unique = append(unique, record)
+		}
+	}
+
+	return unique, len(records) - len(unique)
+}
@@ -0,0 +1,116 @@
+package dupfind
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// CheckpointFile returns the name of the file that a build of index saves
+// its progress to.
+func CheckpointFile(index string) string {
+	return index + ".checkpoint"
+}
+
+// Checkpoint saves the records of a build as they are hashed, one JSON
+// object per line, so that the build can be resumed after a crash. The
+// records are written to disk every interval, and when it is closed.
+type Checkpoint struct {
+	name     string
+	f        *os.File
+	w        *bufio.Writer
+	interval time.Duration
+	saved    time.Time
+}
+
+// CreateCheckpoint starts the checkpoint of a build of index. If resume is
+// set, records are added to those of an earlier checkpoint.
+func CreateCheckpoint(index string, interval time.Duration, resume bool) (*Checkpoint, error) {
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	name := CheckpointFile(index)
+	f, err := os.OpenFile(name, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checkpoint{name: name, f: f, w: bufio.NewWriter(f), interval: interval, saved: time.Now()}, nil
+}
+
+// Add records that a file was hashed.
+func (c *Checkpoint) Add(record Metadata) error {
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	c.w.Write(data)
+	if err := c.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	if time.Since(c.saved) < c.interval {
+		return nil
+	}
+	c.saved = time.Now()
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	return c.f.Sync()
+}
+
+// Close writes the records added to disk and keeps the checkpoint, for a
+// build that failed.
+func (c *Checkpoint) Close() error {
+	err := c.w.Flush()
+	if closeErr := c.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Remove deletes the checkpoint once the index is written.
+func (c *Checkpoint) Remove() error {
+	c.f.Close()
+	return os.Remove(c.name)
+}
+
+// ReadCheckpoint returns the records saved by an earlier build of index,
+// or nil if there is no checkpoint. A record cut off by a crash is
+// skipped, and later records of a path replace earlier ones.
+func ReadCheckpoint(index string) ([]Metadata, error) {
+
+	f, err := os.Open(CheckpointFile(index))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Metadata
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var record Metadata
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			Log.Debugf("Skipping incomplete record in %s", CheckpointFile(index))
+			continue
+		}
+		if i, ok := seen[PathKey(record.Path)]; ok {
+			records[i] = record
+			continue
+		}
+		seen[PathKey(record.Path)] = len(records)
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
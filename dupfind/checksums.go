@@ -0,0 +1,66 @@
+package dupfind
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ChecksumSet holds checksums of content that is expected to be
+// duplicated, such as license files, and is never reported.
+type ChecksumSet map[string]bool
+
+// ReadChecksumSet reads the checksums listed in the file at path, one per
+// line. Only the first word of a line is read, so that the output of
+// sha256sum or export can be used, and for BSD lines the checksum after
+// the =. Blank lines and lines starting with # are skipped. A checksum may
+// be prefixed with its algorithm, as in xxhash64:..., but matches files
+// hashed with any algorithm.
+func ReadChecksumSet(path string) (ChecksumSet, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set := make(ChecksumSet)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		checksum := strings.TrimPrefix(strings.Fields(line)[0], "\\")
+		if i := strings.LastIndex(line, " = "); i >= 0 && !isHex(checksum) {
+			checksum = strings.TrimSpace(line[i+3:])
+		}
+		if _, after, ok := strings.Cut(checksum, ":"); ok {
+			checksum = after
+		}
+		if !isHex(checksum) {
+			return nil, fmt.Errorf("%s:%d: not a checksum", path, n)
+		}
+		set[strings.ToLower(checksum)] = true
+	}
+
+	return set, scanner.Err()
+}
+
+// Has reports whether the checksum of record is in the set.
+func (s ChecksumSet) Has(record Metadata) bool {
+	return s[strings.ToLower(record.Checksum)]
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package dupfind
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"io"
+	"sort"
+)
+
+// Content-defined chunk sizes. Boundaries are placed where a rolling hash
+// of the preceding bytes matches chunkMask, so inserting or removing data
+// only changes the chunks around the edit.
+const (
+	minChunkSize = 2 * 1024
+	maxChunkSize = 64 * 1024
+	chunkMask    = 1<<13 - 1 // 8 KiB average
+)
+
+// gear holds the random values mixed into the rolling hash for each byte.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64, so that the table is the same in every build
+	state := uint64(0x6475706669)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
+
+// ComputeChunks splits the file at path into content-defined chunks and
+// returns the distinct chunk hashes, sorted.
+func ComputeChunks(path string) ([]string, int64, error) {
+	return new(Hasher).chunks(context.Background(), path)
+}
+
+func (h *Hasher) chunks(ctx context.Context, path string) ([]string, int64, error) {
+	f, err := h.open(ctx, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	return chunkReader(bufio.NewReader(f))
+}
+
+func chunkReader(r io.ByteReader) ([]string, int64, error) {
+
+	seen := make(map[uint64]bool)
+	digest := xxhash.New()
+	var buf []byte
+	var rolling uint64
+	var n int64
+	flush := func() {
+		digest.Reset()
+		digest.Write(buf)
+		seen[digest.Sum64()] = true
+		buf, rolling = buf[:0], 0
+	}
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, n, err
+		}
+		n++
+		buf = append(buf, c)
+		rolling = rolling<<1 + gear[c]
+		if len(buf) >= minChunkSize && rolling&chunkMask == 0 || len(buf) >= maxChunkSize {
+			flush()
+		}
+	}
+	if len(buf) > 0 {
+		flush()
+	}
+
+	chunks := make([]string, 0, len(seen))
+	for h := range seen {
+		chunks = append(chunks, fmt.Sprintf("%016x", h))
+	}
+	sort.Strings(chunks)
+
+	return chunks, n, nil
+}
+
+// chunkIndex finds indexed records sharing chunks with a file.
+type chunkIndex struct {
+	records []Metadata
+	// owners maps chunk hashes to the records containing them
+	owners map[string][]int
+}
+
+func newChunkIndex(records []Metadata) *chunkIndex {
+
+	index := &chunkIndex{owners: make(map[string][]int)}
+	for _, record := range records {
+		if len(record.Chunks) == 0 {
+			continue
+		}
+		index.records = append(index.records, record)
+		for _, chunk := range record.Chunks {
+			index.owners[chunk] = append(index.owners[chunk], len(index.records)-1)
+		}
+	}
+
+	return index
+}
+
+// overlapping returns the records sharing at least minShare percent of
+// their chunks with chunks, most similar first, and the shares.
+func (c *chunkIndex) overlapping(chunks []string, minShare int) ([]Metadata, []int) {
+
+	shared := make(map[int]int)
+	for _, chunk := range chunks {
+		for _, i := range c.owners[chunk] {
+			shared[i]++
+		}
+	}
+
+	type overlap struct {
+		record Metadata
+		share  int
+	}
+	var overlaps []overlap
+	for i, count := range shared {
+		record := c.records[i]
+		total := len(chunks)
+		if len(record.Chunks) > total {
+			total = len(record.Chunks)
+		}
+		if share := 100 * count / total; share >= minShare {
+			overlaps = append(overlaps, overlap{record, share})
+		}
+	}
+	sort.Slice(overlaps, func(i, j int) bool {
+		if overlaps[i].share != overlaps[j].share {
+			return overlaps[i].share > overlaps[j].share
+		}
+		return overlaps[i].record.Path < overlaps[j].record.Path
+	})
+
+	records := make([]Metadata, len(overlaps))
+	shares := make([]int, len(overlaps))
+	for i, o := range overlaps {
+		records[i], shares[i] = o.record, o.share
+	}
+
+	return records, shares
+}
@@ -0,0 +1,111 @@
+package dupfind
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Compression formats for JSON indexes.
+const (
+	CompressNone = ""
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressionFor returns the compression implied by the extension of
+// name.
+func compressionFor(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz":
+		return CompressGzip
+	case ".zst":
+		return CompressZstd
+	default:
+		return CompressNone
+	}
+}
+
+// fileCompression returns the compression of the existing file name,
+// judged by its first bytes once decrypted.
+func fileCompression(name string) string {
+
+	f, err := os.Open(name)
+	if err != nil {
+		return CompressNone
+	}
+	defer f.Close()
+	r, err := decrypt(f)
+	if err != nil {
+		return CompressNone
+	}
+
+	magic := make([]byte, len(zstdMagic))
+	n, _ := io.ReadFull(r, magic)
+	return sniffCompression(magic[:n])
+}
+
+func sniffCompression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return CompressGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		return CompressZstd
+	default:
+		return CompressNone
+	}
+}
+
+// decompress returns a reader for the uncompressed contents of r, which
+// may be compressed in any supported format.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	switch sniffCompression(magic) {
+	case CompressGzip:
+		return gzip.NewReader(br)
+	case CompressZstd:
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// compress returns a writer that compresses into w. Closing it flushes
+// the compressed stream but does not close w.
+func compress(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		return zstd.NewWriter(w)
+	case CompressNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
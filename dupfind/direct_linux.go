@@ -0,0 +1,18 @@
+package dupfind
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openDirect opens the file at path with O_DIRECT, so that reading it
+// bypasses the page cache. Files on file systems without direct I/O, such
+// as tmpfs, are opened normally.
+func openDirect(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if errors.Is(err, syscall.EINVAL) {
+		return os.Open(path)
+	}
+	return f, err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package dupfind
+
+import "os"
+
+// openDirect opens the file at path normally; direct I/O is only used on
+// Linux.
+func openDirect(path string) (*os.File, error) {
+	return os.Open(path)
+}
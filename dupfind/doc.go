@@ -0,0 +1,31 @@
+// Package dupfind finds duplicate files by comparing their checksums
+// against an index of previously hashed files.
+//
+// A run is a pipeline of channels: a Walker lists the files below a root
+// directory, HashFilePaths hashes them with a pool of workers, and the
+// resulting Metadata records are either stored with an IndexStore or
+// looked up in an Index with a Matcher. ScanStats collects what happened
+// along the way. For example, to report files in dir that duplicate
+// files in index.json:
+//
+//	index, err := dupfind.LoadIndex("index.json")
+//	if err != nil {
+//		return err
+//	}
+//	walker, err := dupfind.NewWalker(dupfind.WalkConfig{SkipSymlinks: true})
+//	if err != nil {
+//		return err
+//	}
+//	hasher, err := dupfind.NewHasher(dupfind.DefaultAlgorithm, nil)
+//	if err != nil {
+//		return err
+//	}
+//	stats := dupfind.NewScanStats(context.Background(), false)
+//	matcher := &dupfind.Matcher{Index: index}
+//	for record := range dupfind.ProduceMetadata(dir, 4, walker, hasher, stats) {
+//		if match, ok := matcher.Match(record); ok {
+//			fmt.Println(match.Path, "duplicates", match.IndexPath)
+//		}
+//	}
+//	return stats.Err()
+package dupfind
@@ -0,0 +1,75 @@
+package dupfind
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"filippo.io/age"
+	"io"
+	"os"
+)
+
+// IndexPassphrase is the passphrase that encrypted JSON indexes are
+// decrypted with, and that indexes are encrypted with when asked to.
+var IndexPassphrase string
+
+// ErrNoPassphrase is returned when reading an encrypted index while
+// IndexPassphrase is empty.
+var ErrNoPassphrase = errors.New("index is encrypted, but no passphrase was given")
+
+// ageMagic starts files encrypted with age, which can also decrypt
+// encrypted indexes with age -d.
+var ageMagic = []byte("age-encryption.org/v1\n")
+
+// fileEncrypted reports whether the existing file name is encrypted.
+func fileEncrypted(name string) bool {
+
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(ageMagic))
+	n, _ := io.ReadFull(f, magic)
+	return bytes.Equal(magic[:n], ageMagic)
+}
+
+// decrypt returns a reader for the decrypted contents of r if it is
+// encrypted, and for r itself otherwise.
+func decrypt(r io.Reader) (io.Reader, error) {
+
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(ageMagic)); !bytes.Equal(magic, ageMagic) {
+		return br, nil
+	}
+	if IndexPassphrase == "" {
+		return nil, ErrNoPassphrase
+	}
+	identity, err := age.NewScryptIdentity(IndexPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	d, err := age.Decrypt(br, identity)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, errors.New("wrong passphrase for encrypted index")
+	}
+
+	return d, err
+}
+
+// encrypt returns a writer that encrypts into w with IndexPassphrase.
+// Closing it finishes the encrypted stream but does not close w.
+func encrypt(w io.Writer) (io.WriteCloser, error) {
+
+	if IndexPassphrase == "" {
+		return nil, errors.New("no passphrase to encrypt the index with")
+	}
+	recipient, err := age.NewScryptRecipient(IndexPassphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return age.Encrypt(w, recipient)
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package dupfind
+
+import "os"
+
+// fileID returns zeros where device and inode numbers are not available.
+func fileID(info os.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
+
+// fileOwner reports false where file owners are not available.
+func fileOwner(info os.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
+
+// allocatedSize reports false where the space a file takes on disk is
+// not available.
+func allocatedSize(info os.FileInfo) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package dupfind
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode number of a file.
+func fileID(info os.FileInfo) (uint64, uint64) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), uint64(st.Ino)
+	}
+	return 0, 0
+}
+
+// fileOwner returns the user and group owning a file.
+func fileOwner(info os.FileInfo) (uint32, uint32, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid, true
+	}
+	return 0, 0, false
+}
+
+// allocatedSize returns the space a file takes on disk.
+func allocatedSize(info os.FileInfo) (int64, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512, true
+	}
+	return 0, false
+}
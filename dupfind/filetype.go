@@ -0,0 +1,102 @@
+package dupfind
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileTypes maps the classes of files accepted by WalkConfig.Types to the
+// extensions of their files.
+var fileTypes = map[string][]string{
+	"image":    {"jpg", "jpeg", "png", "gif", "bmp", "tif", "tiff", "webp", "heic", "heif", "avif", "svg", "ico", "psd", "raw", "dng", "cr2", "cr3", "nef", "arw", "orf", "rw2", "raf", "srw", "pef"},
+	"video":    {"mp4", "m4v", "mov", "avi", "mkv", "webm", "wmv", "flv", "mpg", "mpeg", "3gp", "mts", "m2ts", "ts", "vob", "ogv"},
+	"audio":    {"mp3", "flac", "wav", "ogg", "oga", "opus", "m4a", "aac", "wma", "aif", "aiff", "ape", "mid", "midi"},
+	"document": {"pdf", "doc", "docx", "odt", "rtf", "txt", "md", "tex", "xls", "xlsx", "ods", "csv", "ppt", "pptx", "odp", "epub"},
+	"archive":  {"zip", "tar", "gz", "tgz", "bz2", "xz", "zst", "7z", "rar", "iso", "dmg"},
+}
+
+// mimeTypes maps the MIME types sniffed from the content of files without
+// an extension to their class. Types not listed are classed by their
+// prefix, such as image/.
+var mimeTypes = map[string]string{
+	"application/ogg":              "audio",
+	"application/pdf":              "document",
+	"application/postscript":       "document",
+	"application/zip":              "archive",
+	"application/x-gzip":           "archive",
+	"application/x-rar-compressed": "archive",
+}
+
+// typeExtensions returns the extensions of the files that the types and
+// extensions given select, or nil if they select all files.
+func typeExtensions(types, extensions []string) (map[string]bool, error) {
+
+	if len(types) == 0 && len(extensions) == 0 {
+		return nil, nil
+	}
+	selected := make(map[string]bool)
+	for _, name := range types {
+		exts, ok := fileTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown file type %q", name)
+		}
+		for _, ext := range exts {
+			selected[ext] = true
+		}
+	}
+	for _, ext := range extensions {
+		selected[strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+	}
+
+	return selected, nil
+}
+
+// sniffType returns the class of the file at path judging by its first
+// bytes, or "" if it is none of the classes.
+func sniffType(path string) string {
+
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if n == 0 && err != nil {
+		return ""
+	}
+	mime, _, _ := strings.Cut(http.DetectContentType(head[:n]), ";")
+	if class, ok := mimeTypes[mime]; ok {
+		return class
+	}
+	class, _, _ := strings.Cut(mime, "/")
+	switch class {
+	case "image", "video", "audio":
+		return class
+	case "text":
+		return "document"
+	}
+	return ""
+}
+
+// typeAllowed reports whether the file at path passes the type filters,
+// judging by its extension or, for files without one, by its first bytes
+// if sniff is set and sniffing is enabled.
+func (w *Walker) typeAllowed(path string, sniff bool) bool {
+
+	if w.extensions == nil {
+		return true
+	}
+	name := filepath.Base(path)
+	if ext := filepath.Ext(name); ext != "" && ext != name {
+		return w.extensions[strings.ToLower(ext[1:])]
+	}
+	if !sniff || !w.sniffTypes {
+		return false
+	}
+	return w.types[sniffType(path)]
+}
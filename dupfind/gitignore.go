@@ -0,0 +1,230 @@
+package dupfind
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// gitRule is a single pattern from a .gitignore file.
+type gitRule struct {
+	re       *regexp.Regexp
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// gitRules holds the ignore rules of a walk, keyed by the slash-separated
+// directory (relative to the walk root) whose .gitignore they come from.
+type gitRules map[string][]gitRule
+
+// parseGitRule compiles a line of a .gitignore file. It returns false for
+// blank lines and comments.
+func parseGitRule(line string) (gitRule, bool) {
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return gitRule{}, false
+	}
+
+	var rule gitRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return gitRule{}, false
+	}
+
+	re, err := regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		return gitRule{}, false
+	}
+	rule.re = re
+
+	return rule, true
+}
+
+// globToRegexp translates a gitignore glob, including ** wildcards, into a
+// regular expression.
+func globToRegexp(glob string) string {
+
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
+
+func readGitRules(name string) ([]gitRule, error) {
+
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []gitRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseGitRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, scanner.Err()
+}
+
+// globalGitExcludes returns the path of the user's global excludes file.
+func globalGitExcludes() string {
+	if out, err := exec.Command("git", "config", "--get", "core.excludesFile").Output(); err == nil {
+		if name := strings.TrimSpace(string(out)); name != "" {
+			return expandHome(name)
+		}
+	}
+	if config := os.Getenv("XDG_CONFIG_HOME"); config != "" {
+		return filepath.Join(config, "git", "ignore")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "git", "ignore")
+}
+
+func expandHome(name string) string {
+	if strings.HasPrefix(name, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, name[2:])
+		}
+	}
+	return name
+}
+
+// loadRootGitRules reads the global excludes, the repository's
+// info/exclude file and the .gitignore file in root.
+func loadRootGitRules(root string) (gitRules, error) {
+
+	var rules []gitRule
+	for _, name := range []string{
+		globalGitExcludes(),
+		filepath.Join(root, ".git", "info", "exclude"),
+		filepath.Join(root, ".gitignore"),
+	} {
+		if name == "" {
+			continue
+		}
+		more, err := readGitRules(name)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, more...)
+	}
+
+	return gitRules{"": rules}, nil
+}
+
+// load reads the .gitignore file of the directory dir, given both as a
+// file system path and relative to the walk root.
+func (g gitRules) load(dir, rel string) error {
+	rules, err := readGitRules(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return err
+	}
+	if len(rules) > 0 {
+		g[rel] = rules
+	}
+	return nil
+}
+
+// ignored reports whether rel, a slash-separated path relative to the walk
+// root, is ignored. Rules in deeper directories take precedence, as do
+// later rules within a file.
+func (g gitRules) ignored(rel string, isDir bool) bool {
+
+	if path.Base(rel) == ".git" && isDir {
+		return true
+	}
+
+	// collect directories from the root down to the parent of rel
+	dirs := []string{""}
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' {
+			dirs = append(dirs, rel[:i])
+		}
+	}
+
+	ignored := false
+	for _, dir := range dirs {
+		local := rel
+		if dir != "" {
+			local = rel[len(dir)+1:]
+		}
+		for _, rule := range g[dir] {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			subject := local
+			if !rule.anchored {
+				subject = path.Base(local)
+			}
+			if rule.re.MatchString(subject) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored
+}
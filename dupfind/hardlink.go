@@ -0,0 +1,40 @@
+package dupfind
+
+// LinkSet remembers which files on disk have been seen, to recognize
+// further hardlinks to them.
+type LinkSet map[[2]uint64]bool
+
+// Seen reports whether a hardlink to the file of record was seen before,
+// and remembers it otherwise. Records without an inode are never seen.
+func (s LinkSet) Seen(record Metadata) bool {
+	if record.Inode == 0 {
+		return false
+	}
+	id := [2]uint64{record.Device, record.Inode}
+	if s[id] {
+		return true
+	}
+	s[id] = true
+	return false
+}
+
+// SameInode reports whether both records describe the same file on disk.
+func SameInode(a, b Metadata) bool {
+	return a.Inode != 0 && a.Device == b.Device && a.Inode == b.Inode
+}
+
+// SameOwner reports whether both records are of files with the same owner
+// and group. Records without an owner only match each other.
+func SameOwner(a, b Metadata) bool {
+	return a.Owned == b.Owned && a.UID == b.UID && a.GID == b.GID
+}
+
+// AnySameInode reports whether record is a hardlink to any of the others.
+func AnySameInode(record Metadata, others []Metadata) bool {
+	for _, other := range others {
+		if SameInode(record, other) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package dupfind
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"hash"
+	"lukechampine.com/blake3"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAlgorithm is the hash algorithm used unless another is chosen.
+const DefaultAlgorithm = "sha256"
+
+// HashAlgorithms maps the names of the supported hash algorithms to their
+// constructors.
+var HashAlgorithms = map[string]func() hash.Hash{
+	"sha256":   sha256.New,
+	"sha1":     sha1.New,
+	"blake3":   func() hash.Hash { return blake3.New(32, nil) },
+	"xxhash64": func() hash.Hash { return xxhash.New() },
+}
+
+func algorithmNames() string {
+	var names []string
+	for name := range HashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+type hashRule struct {
+	pattern   string
+	algorithm string
+}
+
+// Hasher selects the hash algorithm for a file. Rules are matched against
+// the file's base name in the order they were given, and the first match
+// wins; files matching no rule use the fallback algorithm.
+type Hasher struct {
+	fallback string
+	rules    []hashRule
+	// known maps paths to the algorithm they must be hashed with
+	known map[string]string
+	// Archives makes HashFilePaths hash the members of zip and tar
+	// archives as well as the archives themselves.
+	Archives bool
+	// Streams makes HashFilePaths hash the NTFS alternate data streams of
+	// files on Windows, recording each as FILE:STREAM.
+	Streams bool
+	// Perceptual makes HashFilePaths compute perceptual hashes of images.
+	Perceptual bool
+	// Chunks makes HashFilePaths split files into content-defined chunks,
+	// to find files sharing most of their content.
+	Chunks bool
+	// Sparse makes HashFilePaths record the space sparse files take on
+	// disk, in Metadata.Allocated.
+	Sparse bool
+	// ChangeRetries is how many times a file that changed while it was
+	// hashed is hashed again. If it still changes, its record is marked
+	// Unstable.
+	ChangeRetries int
+	// Xattrs is how HashFilePaths treats extended attributes: XattrsHash
+	// or XattrsRecord, or XattrsIgnore if empty.
+	Xattrs string
+	// Throttle, if not nil, limits the rate at which files are read.
+	Throttle *Throttle
+	// Pause, if not zero, is how long each worker sleeps before reading a
+	// file, so that the disk is left to others in between.
+	Pause time.Duration
+	// StatWorkers, if not zero, is the number of workers that stat files
+	// ahead of the workers hashing them, and for PartitionBySize. Where
+	// stat is slow, as on network file systems, more of them keep the
+	// hashing workers busy.
+	StatWorkers int
+	// HashWorkers, if not zero, is the number of workers hashing files,
+	// overriding the number passed to HashFilePaths.
+	HashWorkers int
+	// MaxOpen, if not zero, limits how many files all workers together
+	// have open for reading at once.
+	MaxOpen   int
+	slotsOnce sync.Once
+	slots     chan struct{}
+	// BufferSize, if not zero, is the size of the buffers files are read
+	// into for hashing. Buffers are pooled, so each worker reuses one.
+	BufferSize int
+	// DirectIO reads files for hashing without going through the page
+	// cache, on Linux, so that hashing huge files does not evict
+	// everything else from it. Buffers are then 1 MiB unless BufferSize
+	// is set.
+	DirectIO bool
+	// Cache, if not nil, supplies the checksums of unchanged files and
+	// remembers those of the files hashed.
+	Cache *HashCache
+}
+
+// NewHasher parses overrides of the form PATTERN=ALGORITHM.
+func NewHasher(fallback string, overrides []string) (*Hasher, error) {
+
+	if _, ok := HashAlgorithms[fallback]; !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q (available: %s)", fallback, algorithmNames())
+	}
+
+	h := &Hasher{fallback: fallback}
+	for _, override := range overrides {
+		pattern, algorithm, ok := strings.Cut(override, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid hash override %q, expected PATTERN=ALGORITHM", override)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in hash override %q: %v", override, err)
+		}
+		if _, ok := HashAlgorithms[algorithm]; !ok {
+			return nil, fmt.Errorf("unknown hash algorithm %q (available: %s)", algorithm, algorithmNames())
+		}
+		h.rules = append(h.rules, hashRule{pattern: pattern, algorithm: algorithm})
+	}
+
+	return h, nil
+}
+
+// NewRecordHasher returns a hasher that hashes each file with the
+// algorithm used for its record, for instance to compare against an index.
+func NewRecordHasher(records []Metadata) *Hasher {
+	h := &Hasher{fallback: DefaultAlgorithm, known: make(map[string]string)}
+	for _, record := range records {
+		h.known[PathKey(record.Path)] = RecordAlgorithm(record)
+	}
+	return h
+}
+
+// Algorithm returns the algorithm used for files that match no rule.
+func (h *Hasher) Algorithm() string {
+	return h.fallback
+}
+
+// AlgorithmFor returns the algorithm to hash the file at path with.
+func (h *Hasher) AlgorithmFor(path string) string {
+	if algorithm, ok := h.known[PathKey(path)]; ok {
+		return algorithm
+	}
+	name := filepath.Base(path)
+	for _, rule := range h.rules {
+		if matched, _ := filepath.Match(rule.pattern, name); matched {
+			return rule.algorithm
+		}
+	}
+	return h.fallback
+}
+
+// Rules returns the overrides the hasher was created with, as
+// PATTERN=ALGORITHM.
+func (h *Hasher) Rules() []string {
+	var rules []string
+	for _, rule := range h.rules {
+		rules = append(rules, rule.pattern+"="+rule.algorithm)
+	}
+	return rules
+}
+
+// IndexAlgorithm returns the algorithm the checksums in index were
+// computed with, as recorded in its header or else used by all of its
+// records. It returns "" if there is none.
+func IndexAlgorithm(index Index) string {
+	if algorithm := index.Header().Algorithm; algorithm != "" {
+		return algorithm
+	}
+	algorithms := index.Algorithms()
+	if len(algorithms) != 1 {
+		return ""
+	}
+	for algorithm := range algorithms {
+		return algorithm
+	}
+	return ""
+}
+
+// CheckIndexAlgorithm fails if index holds no checksums computed with any
+// algorithm the hasher uses, its fallback or that of one of its rules, in
+// which case no duplicates could be found.
+func CheckIndexAlgorithm(index Index, h *Hasher) error {
+	algorithms := index.Algorithms()
+	if len(algorithms) == 0 || algorithms[h.fallback] {
+		return nil
+	}
+	for _, rule := range h.rules {
+		if algorithms[rule.algorithm] {
+			return nil
+		}
+	}
+
+	var names []string
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("index was built with %s, but files are hashed with %s",
+		strings.Join(names, ", "), h.fallback)
+}
+
+// ChecksumKey qualifies a checksum with its algorithm so that checksums
+// computed with different algorithms never compare equal. Default
+// algorithm checksums are left bare to match older indexes.
+func ChecksumKey(algorithm, checksum string) string {
+	if algorithm == "" || algorithm == DefaultAlgorithm {
+		return checksum
+	}
+	return algorithm + ":" + checksum
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package dupfind
+
+import "os"
+
+// hiddenAttribute reports false, as files are only hidden by their name
+// outside Windows.
+func hiddenAttribute(info os.FileInfo) bool {
+	return false
+}
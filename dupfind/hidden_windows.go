@@ -0,0 +1,14 @@
+package dupfind
+
+import (
+	"os"
+	"syscall"
+)
+
+// hiddenAttribute reports whether the file has the hidden attribute set.
+func hiddenAttribute(info os.FileInfo) bool {
+	if data, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return data.FileAttributes&syscall.FILE_ATTRIBUTE_HIDDEN != 0
+	}
+	return false
+}
@@ -0,0 +1,527 @@
+package dupfind
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IndexVersion is the current index format version. Version 0 is the
+// original bare list of records without a header.
+const IndexVersion = 1
+
+// Version is the dupfind version recorded in index headers. Release builds
+// set it with -ldflags "-X jvkersch/dupfind/dupfind.Version=...".
+var Version = "dev"
+
+// IndexHeader describes how an index was built.
+type IndexHeader struct {
+	Version     int       `json:"version"`
+	Algorithm   string    `json:"algorithm,omitempty"`
+	Root        string    `json:"root,omitempty"`
+	Created     time.Time `json:"created"`
+	ToolVersion string    `json:"tool_version,omitempty"`
+	// Roots lists the directories of an index built from several, the
+	// first of which is Root. Each record then names its own.
+	Roots []string `json:"roots,omitempty"`
+	// Partial marks an index whose build was interrupted, so that it does
+	// not cover all files below Root.
+	Partial bool `json:"partial,omitempty"`
+	// Relative marks an index whose paths are relative to Root, so that
+	// it can be used wherever the indexed directory is mounted.
+	Relative bool `json:"relative,omitempty"`
+	// Xattrs is how extended attributes were treated, XattrsHash or
+	// XattrsRecord, if not ignored.
+	Xattrs string `json:"xattrs,omitempty"`
+	// HashFor lists the rules, as PATTERN=ALGORITHM, that chose the
+	// algorithm of files other than the fallback Algorithm.
+	HashFor []string `json:"hash_for,omitempty"`
+	// Summary counts the records and duplicates in the index. It is set
+	// by the writer when the index is written.
+	Summary *IndexSummary `json:"summary,omitempty"`
+}
+
+// NewIndexHeader returns the header for a new index of root.
+func NewIndexHeader(root string, algorithm string) IndexHeader {
+	return IndexHeader{
+		Version:     IndexVersion,
+		Algorithm:   algorithm,
+		Root:        root,
+		Created:     time.Now().UTC(),
+		ToolVersion: Version,
+	}
+}
+
+// AllRoots returns the directories the index was built from, which are
+// none if it does not record them.
+func (h IndexHeader) AllRoots() []string {
+	if len(h.Roots) > 0 {
+		return h.Roots
+	}
+	if h.Root != "" {
+		return []string{h.Root}
+	}
+	return nil
+}
+
+func checkIndexVersion(header IndexHeader) error {
+	if header.Version > IndexVersion {
+		return fmt.Errorf("index format version %d is newer than supported version %d, please upgrade dupfind",
+			header.Version, IndexVersion)
+	}
+	return nil
+}
+
+// Metadata is the record of an indexed file.
+type Metadata struct {
+	Path      string    `json:"path"`
+	Checksum  string    `json:"checksum"`
+	Algorithm string    `json:"algorithm,omitempty"`
+	Partial   string    `json:"partial,omitempty"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	// Mode holds the file's type and permission bits, if recorded.
+	Mode os.FileMode `json:"mode,omitempty"`
+	// Device and Inode identify the file on disk, so that hardlinks to
+	// the same file can be recognized. They are zero where unsupported.
+	Device uint64 `json:"device,omitempty"`
+	Inode  uint64 `json:"inode,omitempty"`
+	// Owned marks records of files whose owner was recorded, as UID and
+	// GID. Owners are not recorded on Windows.
+	Owned bool   `json:"owned,omitempty"`
+	UID   uint32 `json:"uid,omitempty"`
+	GID   uint32 `json:"gid,omitempty"`
+	// Source is the index a record was merged from, if recorded.
+	Source string `json:"source,omitempty"`
+	// Root is the directory the file was found in, if the index was
+	// built from several.
+	Root string `json:"root,omitempty"`
+	// Perceptual is the perceptual hash of an image, if computed.
+	Perceptual string `json:"perceptual,omitempty"`
+	// Chunks are the hashes of the file's content-defined chunks, if
+	// computed.
+	Chunks []string `json:"chunks,omitempty"`
+	// Sparse marks files that take less space on disk than their Size,
+	// if recorded, and Allocated is the space they take.
+	Sparse    bool  `json:"sparse,omitempty"`
+	Allocated int64 `json:"allocated,omitempty"`
+	// Xattrs is the checksum of the file's extended attributes, if it has
+	// any and they were hashed or recorded.
+	Xattrs string `json:"xattrs,omitempty"`
+	// Unstable marks files that kept changing while they were hashed,
+	// whose checksum may match none of their versions.
+	Unstable bool `json:"unstable,omitempty"`
+}
+
+// Index answers checksum lookups against a set of indexed files.
+type Index interface {
+	// Lookup returns the records of all indexed files whose checksum key
+	// (see ChecksumKey) equals key, ordered by path.
+	Lookup(key string) []Metadata
+	// HasSize reports whether an indexed file may have the given size.
+	HasSize(size int64) bool
+	// HasPartial reports whether an indexed file of the given size may
+	// have the given partial checksum key.
+	HasPartial(size int64, key string) bool
+	// Algorithms returns the set of hash algorithms used in the index.
+	Algorithms() map[string]bool
+	// Similar returns the records of images whose perceptual hash is at
+	// most maxDistance bits from the given one, closest first.
+	Similar(perceptual string, maxDistance int) []Metadata
+	// Overlapping returns the records sharing at least minShare percent
+	// of their chunks with the given ones, most similar first, and the
+	// percentages shared.
+	Overlapping(chunks []string, minShare int) ([]Metadata, []int)
+	Header() IndexHeader
+}
+
+// IndexStore reads and writes index records in a particular file format.
+type IndexStore interface {
+	Read() (IndexHeader, []Metadata, error)
+	Write(header IndexHeader, records []Metadata) error
+	// Create starts writing a new index, replacing the stored one once
+	// the writer is closed.
+	Create() (IndexWriter, error)
+	// Index opens the stored records for lookups.
+	Index() (Index, error)
+}
+
+// OpenStore picks the storage backend for an index file from its
+// extension. SQLite databases can be queried without loading the whole
+// index into memory; everything else is stored as JSON. JSON indexes are
+// compressed if the path ends in .gz or .zst, or if the existing index is.
+func OpenStore(path string) IndexStore {
+	if isSQLitePath(path) {
+		return sqliteStore(path)
+	}
+	return jsonStore{path: path}
+}
+
+// OpenCompressedStore opens a JSON index that is written with the given
+// compression, whatever its extension.
+func OpenCompressedStore(path string, compression string) (IndexStore, error) {
+	if isSQLitePath(path) {
+		return nil, fmt.Errorf("SQLite index %s cannot be compressed", path)
+	}
+	if _, err := compress(io.Discard, compression); err != nil {
+		return nil, err
+	}
+	return jsonStore{path: path, compression: compression}, nil
+}
+
+// OpenEncryptedStore is OpenCompressedStore for a JSON index that is
+// encrypted with IndexPassphrase.
+func OpenEncryptedStore(path string, compression string) (IndexStore, error) {
+	if isSQLitePath(path) {
+		return nil, fmt.Errorf("SQLite index %s cannot be encrypted", path)
+	}
+	if IndexPassphrase == "" {
+		return nil, errors.New("no passphrase to encrypt the index with")
+	}
+	if _, err := compress(io.Discard, compression); err != nil {
+		return nil, err
+	}
+	return jsonStore{path: path, compression: compression, encrypt: true}, nil
+}
+
+func isSQLitePath(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".db", ".sqlite", ".sqlite3":
+		return true
+	default:
+		return false
+	}
+}
+
+type mapIndex struct {
+	header  IndexHeader
+	records map[string][]Metadata
+	// sizes is nil if some records predate sizes being stored
+	sizes map[int64]bool
+	// partials is nil if some records have no partial checksum
+	partials   map[string]bool
+	algorithms map[string]bool
+	images     []Metadata
+	chunks     *chunkIndex
+}
+
+func partialKey(size int64, key string) string {
+	return fmt.Sprintf("%d:%s", size, key)
+}
+
+func (m *mapIndex) Lookup(key string) []Metadata {
+	return m.records[key]
+}
+
+func (m *mapIndex) HasSize(size int64) bool {
+	return m.sizes == nil || m.sizes[size]
+}
+
+// partialKeyOf returns the checksum key of a record's partial checksum, or
+// the empty string if the record has none.
+func partialKeyOf(record Metadata) string {
+	if record.Partial == "" {
+		return ""
+	}
+	return ChecksumKey(record.Algorithm, record.Partial)
+}
+
+func (m *mapIndex) HasPartial(size int64, key string) bool {
+	return m.partials == nil || m.partials[partialKey(size, key)]
+}
+
+func (m *mapIndex) Algorithms() map[string]bool {
+	return m.algorithms
+}
+
+func (m *mapIndex) Similar(perceptual string, maxDistance int) []Metadata {
+	return similarImages(m.images, perceptual, maxDistance)
+}
+
+func (m *mapIndex) Overlapping(chunks []string, minShare int) ([]Metadata, []int) {
+	return m.chunks.overlapping(chunks, minShare)
+}
+
+func (m *mapIndex) Header() IndexHeader {
+	return m.header
+}
+
+// NewMapIndex returns an in-memory index of records.
+func NewMapIndex(header IndexHeader, records []Metadata) Index {
+
+	index := &mapIndex{
+		header:     header,
+		records:    make(map[string][]Metadata),
+		sizes:      make(map[int64]bool),
+		partials:   make(map[string]bool),
+		algorithms: make(map[string]bool),
+	}
+	for _, record := range records {
+		index.algorithms[RecordAlgorithm(record)] = true
+		key := ChecksumKey(record.Algorithm, record.Checksum)
+		index.records[key] = append(index.records[key], record)
+		if record.Perceptual != "" {
+			index.images = append(index.images, record)
+		}
+		if record.ModTime.IsZero() {
+			index.sizes = nil
+		} else if index.sizes != nil {
+			index.sizes[record.Size] = true
+		}
+		if record.Partial == "" {
+			index.partials = nil
+		} else if index.partials != nil {
+			index.partials[partialKey(record.Size, partialKeyOf(record))] = true
+		}
+	}
+	for _, group := range index.records {
+		sort.Slice(group, func(i, j int) bool { return group[i].Path < group[j].Path })
+	}
+	index.chunks = newChunkIndex(records)
+
+	return index
+}
+
+// RecordAlgorithm returns the algorithm a record's checksum was computed
+// with. Records without one predate algorithm selection and used SHA-256.
+func RecordAlgorithm(record Metadata) string {
+	if record.Algorithm == "" {
+		return DefaultAlgorithm
+	}
+	return record.Algorithm
+}
+
+// jsonStore keeps the whole index as a JSON object holding the header and
+// the list of records. Version 0 indexes are a bare list of records.
+// Compressed and encrypted files are recognized when reading;
+// compression and encrypt set the format to write, which otherwise
+// follows the file name and the existing file.
+type jsonStore struct {
+	path        string
+	compression string
+	encrypt     bool
+}
+
+func (s jsonStore) writeCompression() string {
+	if s.compression != CompressNone {
+		return s.compression
+	}
+	if compression := compressionFor(s.path); compression != CompressNone {
+		return compression
+	}
+	return fileCompression(s.path)
+}
+
+type jsonIndex struct {
+	IndexHeader
+	Records []Metadata `json:"records"`
+}
+
+// open opens the index file for reading, decrypting and decompressing it.
+func (s jsonStore) open() (io.ReadCloser, error) {
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := decrypt(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := decompress(d)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return readCloser{r, f}, nil
+}
+
+// readCloser closes both the reader and the file it reads from.
+type readCloser struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (r readCloser) Close() error {
+	r.ReadCloser.Close()
+	return r.f.Close()
+}
+
+func (s jsonStore) Read() (IndexHeader, []Metadata, error) {
+
+	r, err := s.open()
+	if err != nil {
+		return IndexHeader{}, nil, err
+	}
+	defer r.Close()
+	jsonData, err := io.ReadAll(r)
+	if err != nil {
+		return IndexHeader{}, nil, err
+	}
+
+	var index jsonIndex
+	if bytes.HasPrefix(bytes.TrimSpace(jsonData), []byte("[")) {
+		err = json.Unmarshal(jsonData, &index.Records)
+	} else {
+		err = json.Unmarshal(jsonData, &index)
+	}
+	if err != nil {
+		return IndexHeader{}, nil, err
+	}
+	if err := checkIndexVersion(index.IndexHeader); err != nil {
+		return IndexHeader{}, nil, err
+	}
+
+	return index.IndexHeader, index.Records, nil
+}
+
+func (s jsonStore) Write(header IndexHeader, records []Metadata) error {
+	return writeAll(s, header, records)
+}
+
+// Create starts a new index. Records are written as they are added and
+// the header follows them, since it is only known once the run ends.
+func (s jsonStore) Create() (IndexWriter, error) {
+
+	tmp, err := createTemp(s.path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	var e io.WriteCloser = nopWriteCloser{f}
+	if s.encrypt || fileEncrypted(s.path) {
+		if e, err = encrypt(f); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return nil, err
+		}
+	}
+	c, err := compress(e, s.writeCompression())
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	w := &jsonWriter{name: s.path, tmp: tmp, f: f, e: e, c: c, w: bufio.NewWriter(c), summary: newSummaryCounter()}
+	w.w.WriteString("{\n  \"records\": [")
+	return w, nil
+}
+
+type jsonWriter struct {
+	name  string
+	tmp   string
+	f     *os.File
+	e     io.WriteCloser
+	c     io.WriteCloser
+	w     *bufio.Writer
+	count int
+
+	summary *summaryCounter
+}
+
+func (j *jsonWriter) Add(record Metadata) error {
+
+	data, err := json.MarshalIndent(record, "    ", "  ")
+	if err != nil {
+		return err
+	}
+	if j.count > 0 {
+		j.w.WriteString(",")
+	}
+	j.count++
+	j.summary.add(record)
+	j.w.WriteString("\n    ")
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonWriter) Close(header IndexHeader) error {
+
+	header.Summary = j.summary.summary()
+	data, err := json.MarshalIndent(header, "", "  ")
+	if err != nil {
+		j.Abort()
+		return err
+	}
+	if j.count > 0 {
+		j.w.WriteString("\n  ")
+	}
+	// splice the header fields into the enclosing object
+	j.w.WriteString("],")
+	j.w.Write(bytes.TrimPrefix(data, []byte("{")))
+	j.w.WriteString("\n")
+
+	if err := j.w.Flush(); err != nil {
+		j.Abort()
+		return err
+	}
+	if err := j.c.Close(); err != nil {
+		j.Abort()
+		return err
+	}
+	if err := j.e.Close(); err != nil {
+		j.Abort()
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		j.Abort()
+		return err
+	}
+	if err := j.f.Close(); err != nil {
+		os.Remove(j.tmp)
+		return err
+	}
+	return renameTemp(j.tmp, j.name)
+}
+
+func (j *jsonWriter) Abort() {
+	j.c.Close()
+	j.e.Close()
+	j.f.Close()
+	os.Remove(j.tmp)
+}
+
+func (s jsonStore) Index() (Index, error) {
+	header, records, err := s.Read()
+	if err != nil {
+		return nil, err
+	}
+	return NewMapIndex(header, records), nil
+}
+
+// ReadIndex reads all records of the index file at path.
+func ReadIndex(path string) (IndexHeader, []Metadata, error) {
+
+	header, records, err := OpenStore(path).Read()
+	if err != nil {
+		return IndexHeader{}, nil, fmt.Errorf("reading index %s: %w", path, err)
+	}
+
+	return header, records, nil
+}
+
+// LoadIndex opens the index file at path for lookups.
+func LoadIndex(path string) (Index, error) {
+
+	index, err := OpenStore(path).Index()
+	if err != nil {
+		return nil, fmt.Errorf("reading index %s: %w", path, err)
+	}
+
+	return index, nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package dupfind
+
+import (
+	"time"
+)
+
+// Lchtimes does nothing where the times of symlinks cannot be set.
+func Lchtimes(path string, mtime time.Time) error {
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package dupfind
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"time"
+)
+
+// Lchtimes sets the modification time of the symlink at path itself,
+// rather than of the file it points to.
+func Lchtimes(path string, mtime time.Time) error {
+	tv := unix.NsecToTimeval(mtime.UnixNano())
+	if err := unix.Lutimes(path, []unix.Timeval{tv, tv}); err != nil {
+		return &os.PathError{Op: "lutimes", Path: path, Err: err}
+	}
+	return nil
+}
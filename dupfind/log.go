@@ -0,0 +1,125 @@
+package dupfind
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+type logOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+}
+
+// Logger writes messages at or above its level to standard error, as
+// text or as one JSON object per line. Loggers returned by With share
+// their settings with the logger they were derived from.
+type Logger struct {
+	out *logOutput
+	// fields are key/value pairs added to JSON messages
+	fields []any
+}
+
+// Log is the logger used by dupfind. Messages below LevelInfo are
+// dropped unless its level is lowered.
+var Log = &Logger{out: &logOutput{w: os.Stderr, level: LevelInfo}}
+
+// SetLevel drops messages below level.
+func (l *Logger) SetLevel(level Level) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.level = level
+}
+
+// SetJSON switches between text and JSON output.
+func (l *Logger) SetJSON(enabled bool) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.json = enabled
+}
+
+// SetOutput redirects messages to w.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w = w
+}
+
+// Enabled reports whether messages at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	return level >= l.out.level
+}
+
+// With returns a logger that adds the given key/value pairs to JSON
+// messages. Text messages are expected to mention them already.
+func (l *Logger) With(keyValues ...any) *Logger {
+	fields := append(append([]any(nil), l.fields...), keyValues...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+func (l *Logger) Debugf(format string, args ...any) { l.logf(LevelDebug, format, args...) }
+func (l *Logger) Infof(format string, args ...any)  { l.logf(LevelInfo, format, args...) }
+func (l *Logger) Warnf(format string, args ...any)  { l.logf(LevelWarn, format, args...) }
+func (l *Logger) Errorf(format string, args ...any) { l.logf(LevelError, format, args...) }
+
+func (l *Logger) logf(level Level, format string, args ...any) {
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	if level < l.out.level {
+		return
+	}
+
+	now := time.Now()
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	if !l.out.json {
+		fmt.Fprintf(l.out.w, "%s %s\n", now.Format("2006/01/02 15:04:05"), msg)
+		return
+	}
+
+	entry := map[string]any{
+		"time":  now.Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		value := l.fields[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[fmt.Sprint(l.fields[i])] = value
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Fprintf(l.out.w, "%s %s\n", now.Format("2006/01/02 15:04:05"), msg)
+		return
+	}
+	l.out.w.Write(append(data, '\n'))
+}
@@ -0,0 +1,28 @@
+package dupfind
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPath is the length from which Windows refuses paths that are not in
+// the \\?\ form, leaving room for a file name in a directory path.
+const maxPath = 248
+
+// longPath returns path in the \\?\ form if it is too long for the
+// Windows API otherwise.
+func longPath(path string) string {
+
+	if len(path) < maxPath || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if rest, ok := strings.CutPrefix(abs, `\\`); ok {
+		return `\\?\UNC\` + rest
+	}
+
+	return `\\?\` + abs
+}
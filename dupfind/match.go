@@ -0,0 +1,208 @@
+package dupfind
+
+import (
+	"os"
+	"time"
+)
+
+// Match is a file found to duplicate an indexed file. IndexPath is the
+// first of the IndexPaths holding the same content, and Source the index
+// it came from, if known.
+type Match struct {
+	Path       string   `json:"path"`
+	IndexPath  string   `json:"index_path"`
+	IndexPaths []string `json:"index_paths"`
+	Source     string   `json:"source,omitempty"`
+	Checksum   string   `json:"checksum"`
+	Size       int64    `json:"size"`
+	// ModTime and Mode describe the file at Path, and IndexSize and
+	// IndexModTime the one at IndexPath as it was indexed.
+	ModTime      time.Time   `json:"mtime"`
+	Mode         os.FileMode `json:"mode,omitempty"`
+	IndexSize    int64       `json:"index_size"`
+	IndexModTime time.Time   `json:"index_mtime"`
+	Removed      bool        `json:"removed,omitempty"`
+	// Similar is set if the file only resembles the indexed files: images
+	// whose perceptual hash is Distance bits away from IndexPath's, files
+	// sharing Shared percent of their chunks with IndexPath, or files with
+	// the same name or size, whose content was not compared.
+	Similar  bool `json:"similar,omitempty"`
+	Distance int  `json:"distance,omitempty"`
+	Shared   int  `json:"shared,omitempty"`
+	// Self is set if IndexPaths are files matched before rather than
+	// indexed files.
+	Self bool `json:"self,omitempty"`
+	// Missing is set for files reported because they have no duplicate.
+	Missing bool `json:"missing,omitempty"`
+	// Dir is set for directories all of whose Files files duplicate
+	// indexed files, Size in total, with IndexPath the directory holding
+	// all their duplicates.
+	Dir   bool `json:"dir,omitempty"`
+	Files int  `json:"files,omitempty"`
+	// XattrsDiffer is set for duplicates whose extended attributes differ
+	// from those of IndexPath.
+	XattrsDiffer bool `json:"xattrs_differ,omitempty"`
+}
+
+// Matcher finds the indexed files that a record duplicates.
+type Matcher struct {
+	Index Index
+	// Ignore holds content that is never reported.
+	Ignore ChecksumSet
+	// Links, if not nil, suppresses hardlinks to an indexed file and
+	// hardlinks to a file that was matched before.
+	Links LinkSet
+	// Perceptual matches images without an exact duplicate to indexed
+	// images whose perceptual hash is at most MaxDistance bits away.
+	Perceptual  bool
+	MaxDistance int
+	// Chunks matches files without an exact duplicate to indexed files
+	// sharing at least MinShared percent of their chunks.
+	Chunks    bool
+	MinShared int
+	// Scanned, if not nil, collects the records without an indexed
+	// duplicate, so that later records with the same content are matched
+	// to them.
+	Scanned map[string][]Metadata
+	// SkipSelf leaves out the indexed records of the file being matched
+	// itself, for files looked up inside the indexed directory.
+	// Hardlinks to it are still matched.
+	SkipSelf bool
+	// Xattrs flags duplicates whose extended attributes differ from those
+	// of the indexed file, as recorded for both.
+	Xattrs bool
+}
+
+// Match returns the match for record, if it duplicates an indexed file.
+func (m *Matcher) Match(record Metadata) (Match, bool) {
+	match, ok := m.match(record)
+	match.ModTime, match.Mode = record.ModTime, record.Mode
+	return match, ok
+}
+
+func (m *Matcher) match(record Metadata) (Match, bool) {
+
+	if IsSpecial(record.Mode) || m.Ignore.Has(record) {
+		return Match{}, false
+	}
+	key := ChecksumKey(record.Algorithm, record.Checksum)
+	indexed := m.others(record, m.Index.Lookup(key))
+	self := false
+	if len(indexed) == 0 && m.Scanned != nil {
+		indexed, self = m.Scanned[key], true
+		m.Scanned[key] = append(indexed, record)
+	}
+	if len(indexed) == 0 {
+		return m.similar(record, key)
+	}
+	if m.Links != nil && (AnySameInode(record, indexed) || m.Links.Seen(record)) {
+		return Match{}, false
+	}
+
+	return Match{
+		Path:         record.Path,
+		IndexPath:    indexed[0].Path,
+		IndexSize:    indexed[0].Size,
+		IndexModTime: indexed[0].ModTime,
+		Source:       indexed[0].Source,
+		IndexPaths:   recordPaths(indexed),
+		Checksum:     key,
+		Size:         record.Size,
+		Self:         self,
+		XattrsDiffer: m.Xattrs && record.Xattrs != indexed[0].Xattrs,
+	}, true
+}
+
+func (m *Matcher) similar(record Metadata, key string) (Match, bool) {
+
+	if !m.Perceptual || record.Perceptual == "" {
+		return m.overlapping(record, key)
+	}
+	similar := m.others(record, m.Index.Similar(record.Perceptual, m.MaxDistance))
+	if len(similar) == 0 {
+		return m.overlapping(record, key)
+	}
+	distance, _ := PerceptualDistance(record.Perceptual, similar[0].Perceptual)
+
+	return Match{
+		Path:         record.Path,
+		IndexPath:    similar[0].Path,
+		IndexSize:    similar[0].Size,
+		IndexModTime: similar[0].ModTime,
+		Source:       similar[0].Source,
+		IndexPaths:   recordPaths(similar),
+		Checksum:     key,
+		Size:         record.Size,
+		Similar:      true,
+		Distance:     distance,
+	}, true
+}
+
+func (m *Matcher) overlapping(record Metadata, key string) (Match, bool) {
+
+	if !m.Chunks || len(record.Chunks) == 0 {
+		return Match{}, false
+	}
+	overlapping, shares := m.Index.Overlapping(record.Chunks, m.MinShared)
+	if m.SkipSelf {
+		var kept []Metadata
+		var keptShares []int
+		for i, other := range overlapping {
+			if !isSelf(record, other) {
+				kept, keptShares = append(kept, other), append(keptShares, shares[i])
+			}
+		}
+		overlapping, shares = kept, keptShares
+	}
+	if len(overlapping) == 0 {
+		return Match{}, false
+	}
+
+	return Match{
+		Path:         record.Path,
+		IndexPath:    overlapping[0].Path,
+		IndexSize:    overlapping[0].Size,
+		IndexModTime: overlapping[0].ModTime,
+		Source:       overlapping[0].Source,
+		IndexPaths:   recordPaths(overlapping),
+		Checksum:     key,
+		Size:         record.Size,
+		Similar:      true,
+		Shared:       shares[0],
+	}, true
+}
+
+// others returns the indexed records that are not of the file of record
+// itself, if self-matches are skipped.
+func (m *Matcher) others(record Metadata, indexed []Metadata) []Metadata {
+
+	if !m.SkipSelf {
+		return indexed
+	}
+	var others []Metadata
+	for _, other := range indexed {
+		if !isSelf(record, other) {
+			others = append(others, other)
+		}
+	}
+
+	return others
+}
+
+// isSelf reports whether the indexed record other is of the same file as
+// record. Only files with the same path or inode need their paths
+// resolved, so that hardlinks are told apart.
+func isSelf(record, other Metadata) bool {
+	if !SamePath(record.Path, other.Path) && !SameInode(record, other) {
+		return false
+	}
+	return SamePath(CanonicalPath(record.Path), CanonicalPath(other.Path))
+}
+
+func recordPaths(records []Metadata) []string {
+	paths := make([]string, len(records))
+	for i, record := range records {
+		paths[i] = record.Path
+	}
+	return paths
+}
@@ -0,0 +1,130 @@
+package dupfind
+
+import (
+	"sort"
+	"strings"
+)
+
+// multiIndex answers lookups from several indexes at once.
+type multiIndex struct {
+	names   []string
+	indexes []Index
+}
+
+// NewMultiIndex combines indexes into one. Records found in it have their
+// Source set to the name of the index they came from.
+func NewMultiIndex(names []string, indexes []Index) Index {
+	return &multiIndex{names: names, indexes: indexes}
+}
+
+func (m *multiIndex) tag(i int, records []Metadata) []Metadata {
+	tagged := make([]Metadata, len(records))
+	for j, record := range records {
+		record.Source = m.names[i]
+		tagged[j] = record
+	}
+	return tagged
+}
+
+func (m *multiIndex) Lookup(key string) []Metadata {
+
+	var records []Metadata
+	for i, index := range m.indexes {
+		records = append(records, m.tag(i, index.Lookup(key))...)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+
+	return records
+}
+
+func (m *multiIndex) HasSize(size int64) bool {
+	for _, index := range m.indexes {
+		if index.HasSize(size) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *multiIndex) HasPartial(size int64, key string) bool {
+	for _, index := range m.indexes {
+		if index.HasPartial(size, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *multiIndex) Algorithms() map[string]bool {
+
+	algorithms := make(map[string]bool)
+	for _, index := range m.indexes {
+		for algorithm := range index.Algorithms() {
+			algorithms[algorithm] = true
+		}
+	}
+
+	return algorithms
+}
+
+func (m *multiIndex) Similar(perceptual string, maxDistance int) []Metadata {
+
+	var records []Metadata
+	for i, index := range m.indexes {
+		records = append(records, m.tag(i, index.Similar(perceptual, maxDistance))...)
+	}
+
+	return similarImages(records, perceptual, maxDistance)
+}
+
+func (m *multiIndex) Overlapping(chunks []string, minShare int) ([]Metadata, []int) {
+
+	var records []Metadata
+	var shares []int
+	for i, index := range m.indexes {
+		r, s := index.Overlapping(chunks, minShare)
+		records = append(records, m.tag(i, r)...)
+		shares = append(shares, s...)
+	}
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return shares[order[i]] > shares[order[j]] })
+
+	sorted := make([]Metadata, len(records))
+	sortedShares := make([]int, len(records))
+	for i, j := range order {
+		sorted[i], sortedShares[i] = records[j], shares[j]
+	}
+
+	return sorted, sortedShares
+}
+
+// Header describes the combined indexes: it is partial if any of them is,
+// and names an algorithm, hash rules, or a treatment of extended
+// attributes, only if all of them were built with it.
+func (m *multiIndex) Header() IndexHeader {
+
+	var header IndexHeader
+	for i, index := range m.indexes {
+		h := index.Header()
+		if i == 0 {
+			header = h
+			header.Root, header.Roots = "", nil
+			continue
+		}
+		header.Partial = header.Partial || h.Partial
+		if h.Algorithm != header.Algorithm {
+			header.Algorithm = ""
+		}
+		if h.Xattrs != header.Xattrs {
+			header.Xattrs = ""
+		}
+		if strings.Join(h.HashFor, "\n") != strings.Join(header.HashFor, "\n") {
+			header.HashFor = nil
+		}
+	}
+
+	return header
+}
@@ -0,0 +1,16 @@
+package dupfind
+
+import "golang.org/x/sys/unix"
+
+// prioDarwinProcess and prioDarwinBackground put a process in the
+// background band, which throttles its CPU and disk use.
+const (
+	prioDarwinProcess    = 4
+	prioDarwinBackground = 0x1000
+)
+
+// LowerPriority gives the CPU and the disks to other programs first, for
+// runs in the background.
+func LowerPriority() error {
+	return unix.Setpriority(prioDarwinProcess, 0, prioDarwinBackground)
+}
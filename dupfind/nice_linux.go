@@ -0,0 +1,44 @@
+package dupfind
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"strconv"
+)
+
+// ioprioIdle is the idle I/O scheduling class for ioprio_set, under which
+// the disk is only used when no one else needs it.
+const ioprioIdle = 3 << 13
+
+// LowerPriority gives the CPU and the disks to other programs first, for
+// runs in the background. Linux sets priorities per thread, so all
+// threads are changed, and threads started later inherit theirs.
+func LowerPriority() error {
+
+	done := make(map[int]bool)
+	for {
+		entries, err := os.ReadDir("/proc/self/task")
+		if err != nil {
+			return err
+		}
+		changed := false
+		for _, entry := range entries {
+			tid, err := strconv.Atoi(entry.Name())
+			if err != nil || done[tid] {
+				continue
+			}
+			if err := unix.Setpriority(unix.PRIO_PROCESS, tid, 19); err != nil {
+				return err
+			}
+			if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, 1, uintptr(tid), ioprioIdle); errno != 0 {
+				return errno
+			}
+			done[tid] = true
+			changed = true
+		}
+		// threads started meanwhile may have inherited the old priority
+		if !changed {
+			return nil
+		}
+	}
+}
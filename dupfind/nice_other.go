@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package dupfind
+
+import "errors"
+
+// LowerPriority fails where dupfind cannot change its priority.
+func LowerPriority() error {
+	return errors.New("lowering the priority is not supported on this system")
+}
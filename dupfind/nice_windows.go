@@ -0,0 +1,9 @@
+package dupfind
+
+import "golang.org/x/sys/windows"
+
+// LowerPriority gives the CPU and the disks to other programs first, for
+// runs in the background.
+func LowerPriority() error {
+	return windows.SetPriorityClass(windows.CurrentProcess(), windows.PROCESS_MODE_BACKGROUND_BEGIN)
+}
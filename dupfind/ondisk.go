@@ -0,0 +1,141 @@
+package dupfind
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// LoadIndexOnDisk opens the index file at path for lookups that are
+// answered on disk, so that memory use does not grow with the size of the
+// index. JSON indexes are copied record by record into a temporary SQLite
+// database in dir, which is looked up through its indexes on checksums and
+// sizes. The returned function removes it once the index is no longer
+// used. SQLite indexes are used as they are.
+func LoadIndexOnDisk(path, dir string) (Index, func(), error) {
+
+	if isSQLitePath(path) {
+		index, err := LoadIndex(path)
+		return index, func() {}, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.CreateTemp(dir, "index-*.db")
+	if err != nil {
+		return nil, nil, err
+	}
+	f.Close()
+	tmp := f.Name()
+	remove := func() {
+		for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+			os.Remove(tmp + suffix)
+		}
+	}
+
+	if err := copyToSQLite(jsonStore{path: path}, sqliteStore(tmp)); err != nil {
+		remove()
+		return nil, nil, fmt.Errorf("reading index %s: %w", path, err)
+	}
+	index, err := sqliteStore(tmp).Index()
+	if err != nil {
+		remove()
+		return nil, nil, fmt.Errorf("reading index %s: %w", path, err)
+	}
+
+	return index, func() {
+		index.(*sqliteIndex).db.Close()
+		remove()
+	}, nil
+}
+
+// copyToSQLite streams the records of src into dst without holding them
+// all in memory.
+func copyToSQLite(src jsonStore, dst sqliteStore) error {
+
+	r, err := src.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := dst.Create()
+	if err != nil {
+		return err
+	}
+	header, err := streamRecords(r, w.Add)
+	if err == nil {
+		err = checkIndexVersion(header)
+	}
+	if err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Close(header)
+}
+
+// streamRecords decodes a JSON index from r, passing each record to add as
+// it is read, and returns the header. The header may follow the records,
+// as it does in indexes written by a JSON IndexWriter.
+func streamRecords(r io.Reader, add func(Metadata) error) (IndexHeader, error) {
+
+	var header IndexHeader
+	dec := json.NewDecoder(r)
+	token, err := dec.Token()
+	if err != nil {
+		return header, err
+	}
+	// version 0 indexes are a bare list of records
+	if token == json.Delim('[') {
+		return header, streamArray(dec, add)
+	}
+	if token != json.Delim('{') {
+		return header, fmt.Errorf("unexpected %v at the start of the index", token)
+	}
+
+	fields := make(map[string]json.RawMessage)
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return header, err
+		}
+		name, _ := token.(string)
+		if name == "records" {
+			if token, err := dec.Token(); err != nil || token != json.Delim('[') {
+				return header, fmt.Errorf("records are not a list")
+			}
+			if err := streamArray(dec, add); err != nil {
+				return header, err
+			}
+			continue
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return header, err
+		}
+		fields[name] = value
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return header, err
+	}
+
+	return header, json.Unmarshal(data, &header)
+}
+
+// streamArray passes the records up to the end of the list being decoded
+// to add.
+func streamArray(dec *json.Decoder, add func(Metadata) error) error {
+	for dec.More() {
+		var record Metadata
+		if err := dec.Decode(&record); err != nil {
+			return err
+		}
+		if err := add(record); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
@@ -0,0 +1,102 @@
+package dupfind
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// CaseInsensitivePaths makes paths that differ only in case compare
+// equal, as they name the same file on Windows.
+var CaseInsensitivePaths = runtime.GOOS == "windows"
+
+// NormalizedPaths makes paths that differ only in their Unicode
+// normalization compare equal, such as names written on macOS, which
+// decomposes accented letters, and copied to Linux, which keeps them
+// as they are.
+var NormalizedPaths = true
+
+// nfcNames is set where the file system finds files under any Unicode
+// normalization of their names, so that walks name them in NFC.
+var nfcNames = runtime.GOOS == "darwin"
+
+// NormalizePath returns path in Unicode normalization form C if paths
+// are compared normalized, and path otherwise.
+func NormalizePath(path string) string {
+	if NormalizedPaths && !norm.NFC.IsNormalString(path) {
+		return norm.NFC.String(path)
+	}
+	return path
+}
+
+// nativeName returns the name or path under which a walk visits the file
+// named name.
+func nativeName(name string) string {
+	if nfcNames && !norm.NFC.IsNormalString(name) {
+		return norm.NFC.String(name)
+	}
+	return name
+}
+
+// PathKey returns the key under which path is stored in maps of paths.
+func PathKey(path string) string {
+	path = NormalizePath(path)
+	if CaseInsensitivePaths {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// SamePath reports whether a and b name the same file.
+func SamePath(a, b string) bool {
+	a, b = NormalizePath(a), NormalizePath(b)
+	if CaseInsensitivePaths {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// CutPathPrefix returns the part of path after dir if path is dir or lies
+// below it. The part after dir is left as it is in path unless only the
+// normalized paths match.
+func CutPathPrefix(path, dir string) (string, bool) {
+	if rest, ok := cutPathPrefix(path, dir); ok || !NormalizedPaths {
+		return rest, ok
+	}
+	return cutPathPrefix(NormalizePath(path), NormalizePath(dir))
+}
+
+func cutPathPrefix(path, dir string) (string, bool) {
+	if len(path) < len(dir) || !SamePath(path[:len(dir)], dir) {
+		return "", false
+	}
+	rest := path[len(dir):]
+	if rest != "" && rest[0] != filepath.Separator && !strings.HasSuffix(dir, string(filepath.Separator)) {
+		return "", false
+	}
+	return rest, true
+}
+
+// CanonicalPath returns the absolute path of path with all symlinks
+// resolved, so that different names of the same file compare equal. The
+// cleaned absolute path is returned if path cannot be resolved.
+func CanonicalPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		return real
+	}
+	return abs
+}
+
+// PathsOverlap reports whether one of the directories a and b lies below
+// the other, or both are the same, after resolving symlinks.
+func PathsOverlap(a, b string) bool {
+	a, b = CanonicalPath(a), CanonicalPath(b)
+	_, below := CutPathPrefix(a, b)
+	_, above := CutPathPrefix(b, a)
+	return below || above
+}
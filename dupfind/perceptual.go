@@ -0,0 +1,146 @@
+package dupfind
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math/bits"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+// IsImage reports whether PerceptualHash can decode the file at path,
+// judging by its extension.
+func IsImage(path string) bool {
+	return imageExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+func (h *Hasher) hashesImage(path string) bool {
+	return h.Perceptual && IsImage(path)
+}
+
+// PerceptualHash computes the difference hash (dHash) of the image at
+// path: 64 bits recording whether brightness increases from left to right
+// across a 9x8 grid laid over the image. Resized or re-encoded copies of
+// an image have hashes that differ in few bits.
+func PerceptualHash(path string) (string, error) {
+	return new(Hasher).perceptualHash(context.Background(), path)
+}
+
+func (h *Hasher) perceptualHash(ctx context.Context, path string) (string, error) {
+
+	f, err := h.open(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%016x", dHash(img)), nil
+}
+
+func dHash(img image.Image) uint64 {
+
+	const width, height = 9, 8
+	b := img.Bounds()
+	var cells [height][width]float64
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			cells[y][x] = brightness(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			hash <<= 1
+			if cells[y][x] < cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// brightness averages the luminance of a sample of the pixels in the
+// rectangle from (x0, y0) to (x1, y1).
+func brightness(img image.Image, x0, y0, x1, y1 int) float64 {
+
+	const samples = 16
+	if x1 <= x0 {
+		x1 = x0 + 1
+	}
+	if y1 <= y0 {
+		y1 = y0 + 1
+	}
+	dx := (x1 - x0 + samples - 1) / samples
+	dy := (y1 - y0 + samples - 1) / samples
+
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += dy {
+		for x := x0; x < x1; x += dx {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+
+	return sum / float64(n)
+}
+
+// PerceptualDistance returns the number of bits in which two perceptual
+// hashes differ. It returns false if either is not a valid hash.
+func PerceptualDistance(a, b string) (int, bool) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return bits.OnesCount64(x ^ y), true
+}
+
+// similarImages returns the records whose perceptual hash is at most
+// maxDistance bits from hash, closest first.
+func similarImages(images []Metadata, hash string, maxDistance int) []Metadata {
+
+	var similar []Metadata
+	distances := make(map[string]int)
+	for _, record := range images {
+		if d, ok := PerceptualDistance(hash, record.Perceptual); ok && d <= maxDistance {
+			similar = append(similar, record)
+			distances[record.Path] = d
+		}
+	}
+	sort.Slice(similar, func(i, j int) bool {
+		di, dj := distances[similar[i].Path], distances[similar[j].Path]
+		if di != dj {
+			return di < dj
+		}
+		return similar[i].Path < similar[j].Path
+	})
+
+	return similar
+}
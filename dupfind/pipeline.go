@@ -0,0 +1,489 @@
+package dupfind
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// PartialSize is the number of leading bytes covered by partial checksums.
+const PartialSize = 64 * 1024
+
+// ProduceMetadata hashes the files below root that walker visits, using
+// the given number of workers.
+func ProduceMetadata(root string, workers int, walker *Walker, hasher *Hasher, stats *ScanStats) <-chan Metadata {
+
+	paths := make(chan string)
+
+	// start producer
+	go ProduceFilePaths(root, paths, walker, stats)
+
+	return HashFilePaths(paths, workers, hasher, nil, stats)
+}
+
+// FilterBySize passes on only those paths whose file size is accepted by
+// keep, so that files which cannot have a duplicate are never hashed.
+// Archives whose members the hasher hashes, files whose streams it
+// hashes, and files it compares by similarity, are always passed on.
+// They are passed on stat'ed, for HashStatedFiles.
+func FilterBySize(paths <-chan string, keep func(int64) bool, hasher *Hasher, stats *ScanStats) <-chan StatedFile {
+
+	kept, rejected := PartitionBySize(paths, keep, hasher, stats)
+	go func() {
+		for record := range rejected {
+			stats.Skipped.Add(1)
+			Log.With("path", record.Path).Debugf("Skipping %s, no indexed file has its size", record.Path)
+		}
+	}()
+
+	return kept
+}
+
+// PartitionBySize is FilterBySize for callers that need the files that
+// were ruled out. These are sent, without checksums, on the second
+// channel, which must be drained along with the first.
+func PartitionBySize(paths <-chan string, keep func(int64) bool, hasher *Hasher, stats *ScanStats) (<-chan StatedFile, <-chan Metadata) {
+
+	kept := make(chan StatedFile)
+	rejected := make(chan Metadata)
+	go func() {
+		defer close(kept)
+		defer close(rejected)
+		for file := range statPaths(paths, hasher.StatWorkers, stats) {
+			path := file.path
+			info, err := file.stat(stats.ctx)
+			if err == nil && !keep(info.Size()) && !hasher.scansArchive(path) && !hasher.Streams && !hasher.comparesSimilar(path) {
+				stats.Files.Add(1)
+				rejected <- FileMetadata(path, info)
+				continue
+			}
+			// errors are reported when the file is hashed
+			kept <- StatedFile{path: path, info: info, err: err}
+		}
+	}()
+
+	return kept, rejected
+}
+
+// FileMetadata returns the record of the file at path without a
+// checksum, taking its size, time, mode and file ID from info.
+func FileMetadata(path string, info os.FileInfo) Metadata {
+	record := Metadata{Path: path, Size: info.Size(), ModTime: info.ModTime(), Mode: info.Mode()}
+	record.Device, record.Inode = fileID(info)
+	record.UID, record.GID, record.Owned = fileOwner(info)
+	return record
+}
+
+// StatFilePaths sends records without checksums for paths, for callers
+// that compare files by their name or size alone.
+func StatFilePaths(paths <-chan string, stats *ScanStats) <-chan Metadata {
+
+	metadata := make(chan Metadata)
+	go func() {
+		defer close(metadata)
+		for path := range paths {
+			info, err := statFile(stats.ctx, path)
+			if errors.Is(err, fs.ErrNotExist) {
+				stats.Vanished.Add(1)
+				continue
+			}
+			if err != nil {
+				stats.Fail(path, err)
+				continue
+			}
+			stats.Files.Add(1)
+			metadata <- FileMetadata(path, info)
+		}
+	}()
+
+	return metadata
+}
+
+// StatedFile is a file and the result of stat'ing it, if done ahead, as
+// passed on by FilterBySize.
+type StatedFile struct {
+	path string
+	info os.FileInfo
+	err  error
+}
+
+// stat returns the result of stat'ing the file, stat'ing it now if that
+// was not done ahead.
+func (r StatedFile) stat(ctx context.Context) (os.FileInfo, error) {
+	if r.info == nil && r.err == nil {
+		return statFile(ctx, r.path)
+	}
+	return r.info, r.err
+}
+
+// statPaths stats paths with the given number of workers. With none,
+// the files are passed on to be stat'ed by the receiver. Files are not
+// stat'ed once the run is aborted.
+func statPaths(paths <-chan string, workers int, stats *ScanStats) <-chan StatedFile {
+
+	files := make(chan StatedFile)
+	if workers <= 0 {
+		go func() {
+			defer close(files)
+			for path := range paths {
+				files <- StatedFile{path: path}
+			}
+		}()
+		return files
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				if stats.Aborted() {
+					continue
+				}
+				info, err := statFile(stats.ctx, path)
+				files <- StatedFile{path: path, info: info, err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(files)
+	}()
+
+	return files
+}
+
+// HashFilePaths hashes paths using the given number of workers, or
+// hasher.HashWorkers if set, or one per CPU if workers is not positive.
+// Files are stat'ed by the hashing workers, or ahead of them by
+// hasher.StatWorkers others. If candidates is not nil, files whose partial
+// checksum does not occur in it are dropped without hashing them
+// completely.
+func HashFilePaths(paths <-chan string, workers int, hasher *Hasher, candidates Index, stats *ScanStats) <-chan Metadata {
+	return HashStatedFiles(statPaths(paths, hasher.StatWorkers, stats), workers, hasher, candidates, stats)
+}
+
+// HashStatedFiles is HashFilePaths for files stat'ed already, as passed on
+// by FilterBySize.
+func HashStatedFiles(files <-chan StatedFile, workers int, hasher *Hasher, candidates Index, stats *ScanStats) <-chan Metadata {
+
+	metadata := make(chan Metadata)
+
+	if hasher.HashWorkers > 0 {
+		workers = hasher.HashWorkers
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	// start consumer/producer (path -> metadata)
+	var gather sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		gather.Add(1)
+		go func(consumerID int) {
+			defer gather.Done()
+			consumeFilePaths(consumerID, files, metadata, hasher, candidates, stats)
+		}(i)
+	}
+
+	// close metadata channel once all producers are done, which must only
+	// be waited for once they were all added
+	go func() {
+		gather.Wait()
+		close(metadata)
+	}()
+
+	return metadata
+}
+
+// ProduceFilePaths sends the files below root that walker visits to
+// paths, and closes it when done. Walk errors abort the run.
+func ProduceFilePaths(root string, paths chan<- string, walker *Walker, stats *ScanStats) {
+	ProduceRootPaths([]string{root}, paths, walker, stats)
+}
+
+// ProduceRootPaths is ProduceFilePaths for several roots, which are
+// walked one after the other.
+func ProduceRootPaths(roots []string, paths chan<- string, walker *Walker, stats *ScanStats) {
+	defer close(paths)
+
+	for _, root := range roots {
+		err := walker.Walk(root, stats, func(path string, info os.FileInfo) error {
+			paths <- path
+			return nil
+		})
+		if err != nil {
+			stats.Abort(err)
+			return
+		}
+	}
+}
+
+// ProduceInputPaths sends the files named in r, separated by sep, that
+// walker does not skip to paths, and closes it when done. Read errors
+// abort the run.
+func ProduceInputPaths(r io.Reader, sep byte, paths chan<- string, walker *Walker, stats *ScanStats) {
+	defer close(paths)
+
+	err := walker.WalkPaths(r, sep, stats, func(path string, info os.FileInfo) error {
+		paths <- path
+		return nil
+	})
+	if err != nil {
+		stats.Abort(fmt.Errorf("reading paths: %w", err))
+	}
+}
+
+// ReadFilePaths sends the paths read from r, one per line, to paths and
+// closes it at EOF.
+func ReadFilePaths(r io.Reader, paths chan<- string) {
+	defer close(paths)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if path := scanner.Text(); path != "" {
+			paths <- path
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		Log.Errorf("Error reading paths: %v", err)
+	}
+}
+
+// comparesSimilar reports whether the file at path may be reported as
+// similar to an indexed file, so that it must be hashed even if no
+// indexed file has the same size or start.
+func (h *Hasher) comparesSimilar(path string) bool {
+	return h.Chunks || h.hashesImage(path)
+}
+
+func consumeFilePaths(id int, files <-chan StatedFile, metadata chan<- Metadata, hasher *Hasher, candidates Index, stats *ScanStats) {
+	for file := range files {
+		path := file.path
+		if stats.Aborted() || !stats.withinBudget() {
+			continue
+		}
+		hasher.pause()
+		info, err := file.stat(stats.ctx)
+		if err == nil && IsSpecial(info.Mode()) {
+			// special files are recorded by type and size, reading them
+			// may block forever
+			stats.Files.Add(1)
+			Log.With("path", path).Debugf("Recorded %s as a %s", path, SpecialType(info.Mode()))
+			metadata <- specialRecord(path, info)
+			continue
+		}
+		if hasher.scansArchive(path) {
+			hashArchive(path, metadata, hasher, candidates, stats)
+		}
+		if err == nil && hasher.Streams && !IsRemote(path) {
+			hashStreams(path, info, metadata, hasher, candidates, stats)
+		}
+		stats.Files.Add(1)
+		// the start of a file is read again with the rest, and a file
+		// may be read again if it changes, but its bytes count once
+		var read int64
+		countRead := func(size int64) {
+			if size > read {
+				stats.Hashed.Add(size - read)
+				read = size
+			}
+		}
+		algorithm := hasher.AlgorithmFor(path)
+		var hit cached
+		var isCached bool
+		if err == nil && hasher.Cache != nil {
+			hit, isCached = hasher.Cache.get(path, algorithm, info)
+		}
+		if err == nil && candidates != nil {
+			// only hash the whole file if its start matches an indexed file
+			partial := hit.partial
+			if !isCached {
+				var size int64
+				partial, size, err = hasher.partialChecksum(stats.ctx, path, algorithm)
+				countRead(size)
+			}
+			if err == nil && !candidates.HasPartial(info.Size(), ChecksumKey(algorithm, partial)) && !hasher.comparesSimilar(path) {
+				stats.Skipped.Add(1)
+				Log.With("path", path).Debugf("Skipping %s, its start matches no indexed file", path)
+				continue
+			}
+		}
+		checksum, partial := hit.checksum, hit.partial
+		unstable := false
+		if err == nil && !isCached {
+			for retries := hasher.ChangeRetries; ; retries-- {
+				var size int64
+				checksum, partial, size, err = hasher.checksum(stats.ctx, path, algorithm)
+				countRead(size)
+				if err != nil {
+					break
+				}
+				// a file written to while it is read may be hashed half old
+				// and half new
+				var after os.FileInfo
+				if after, err = statFile(stats.ctx, path); err != nil || !changedSince(info, after) {
+					break
+				}
+				info = after
+				if retries == 0 {
+					unstable = true
+					break
+				}
+				Log.With("path", path).Debugf("%s changed while it was hashed, hashing it again", path)
+			}
+			if err == nil && !unstable && hasher.Cache != nil {
+				hasher.Cache.put(path, algorithm, info, cached{checksum: checksum, partial: partial})
+			}
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			stats.Vanished.Add(1)
+			continue
+		}
+		if err != nil {
+			stats.Fail(path, err)
+			continue
+		}
+		var xattrs string
+		if hasher.Xattrs == XattrsHash || hasher.Xattrs == XattrsRecord {
+			if xattrs, err = xattrsDigest(path, algorithm); err != nil {
+				stats.Fail(path, err)
+				continue
+			}
+		}
+		if hasher.Xattrs == XattrsHash {
+			checksum = withXattrs(checksum, xattrs, algorithm)
+		}
+		record := Metadata{
+			Path:     path,
+			Checksum: checksum,
+			Xattrs:   xattrs,
+			Unstable: unstable,
+			Partial:  partial,
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+			Mode:     info.Mode(),
+		}
+		record.Device, record.Inode = fileID(info)
+		record.UID, record.GID, record.Owned = fileOwner(info)
+		if hasher.Sparse {
+			record.Allocated, record.Sparse = sparseSize(info)
+		}
+		if algorithm != DefaultAlgorithm {
+			record.Algorithm = algorithm
+		}
+		if hasher.hashesImage(path) {
+			// files that do not decode are still matched by checksum
+			record.Perceptual, _ = hasher.perceptualHash(stats.ctx, path)
+		}
+		if hasher.Chunks && record.Size > 0 {
+			var size int64
+			record.Chunks, size, err = hasher.chunks(stats.ctx, path)
+			countRead(size)
+			if err != nil {
+				stats.Fail(path, err)
+				continue
+			}
+		}
+		if unstable {
+			stats.MarkUnstable(path)
+		}
+		if isCached {
+			Log.With("path", path, "checksum", record.Checksum).Debugf("Reused cached checksum of %s", path)
+		} else {
+			Log.With("path", path, "checksum", record.Checksum).Debugf("Hashed %s", path)
+		}
+		metadata <- record
+	}
+}
+
+// changedSince reports whether a file stat'ed as before has since been
+// written to, judged by its size and modification time.
+func changedSince(before, after os.FileInfo) bool {
+	return before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime())
+}
+
+// sparseSize returns the space the file takes on disk and true if that
+// is less than its size, as for sparse files or files compressed by the
+// file system.
+func sparseSize(info os.FileInfo) (int64, bool) {
+	if allocated, ok := allocatedSize(info); ok && allocated < info.Size() {
+		return allocated, true
+	}
+	return 0, false
+}
+
+// ComputeChecksum hashes the file at path, returning the checksum of the
+// whole file, the checksum of its first PartialSize bytes, and the number of
+// bytes read.
+func ComputeChecksum(path string, algorithm string) (string, string, int64, error) {
+	return new(Hasher).checksum(context.Background(), path, algorithm)
+}
+
+func (h *Hasher) checksum(ctx context.Context, path string, algorithm string) (string, string, int64, error) {
+	f, err := h.openForHash(ctx, path)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer f.Close()
+
+	return h.checksumReader(f, algorithm)
+}
+
+// checksumReader is ComputeChecksum for the contents of r.
+func (h *Hasher) checksumReader(r io.Reader, algorithm string) (string, string, int64, error) {
+
+	var buf []byte
+	if pooled := h.readBuffer(); pooled != nil {
+		defer putBuffer(pooled)
+		buf = *pooled
+		// files would otherwise copy themselves with a buffer of their own
+		r = struct{ io.Reader }{r}
+	}
+	whole := HashAlgorithms[algorithm]()
+	partial := HashAlgorithms[algorithm]()
+	n, err := io.CopyBuffer(io.MultiWriter(whole, partial), io.LimitReader(r, PartialSize), buf)
+	if err != nil {
+		return "", "", n, err
+	}
+	rest, err := io.CopyBuffer(whole, r, buf)
+	n += rest
+	if err != nil {
+		return "", "", n, err
+	}
+
+	return fmt.Sprintf("%x", whole.Sum(nil)), fmt.Sprintf("%x", partial.Sum(nil)), n, nil
+}
+
+// ComputePartialChecksum hashes only the first PartialSize bytes of the
+// file at path.
+func ComputePartialChecksum(path string, algorithm string) (string, int64, error) {
+	return new(Hasher).partialChecksum(context.Background(), path, algorithm)
+}
+
+func (h *Hasher) partialChecksum(ctx context.Context, path string, algorithm string) (string, int64, error) {
+	f, err := h.openForHash(ctx, path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	var buf []byte
+	if pooled := h.readBuffer(); pooled != nil {
+		defer putBuffer(pooled)
+		buf = *pooled
+	}
+	p := HashAlgorithms[algorithm]()
+	n, err := io.CopyBuffer(p, io.LimitReader(f, PartialSize), buf)
+	if err != nil {
+		return "", n, err
+	}
+
+	return fmt.Sprintf("%x", p.Sum(nil)), n, nil
+}
@@ -0,0 +1,44 @@
+package dupfind
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHashFilePathsVanished hashes a file deleted after its path was
+// listed, which must be counted as vanished rather than failed.
+func TestHashFilePathsVanished(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "gone.txt")
+	if err := os.WriteFile(path, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hasher, err := NewHasher(DefaultAlgorithm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := NewScanStats(context.Background(), false)
+
+	paths := make(chan string, 1)
+	paths <- path
+	close(paths)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []Metadata
+	for record := range HashFilePaths(paths, 1, hasher, nil, stats) {
+		records = append(records, record)
+	}
+	if n := stats.Vanished.Load(); n != 1 {
+		t.Errorf("Vanished = %d, want 1", n)
+	}
+	if n := stats.Failed.Load(); n != 0 {
+		t.Errorf("Failed = %d, want 0", n)
+	}
+	if len(records) != 0 {
+		t.Errorf("got %d records, want none", len(records))
+	}
+}
@@ -0,0 +1,81 @@
+package dupfind
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Reflink replaces dst by a clone of src, which shares its data on APFS.
+// The clone gets the permissions, owner and modification time of dst
+// before it is renamed over it, and only if it has the content of dst.
+func Reflink(src, dst string) error {
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), fmt.Sprintf(".%s.dupfind-tmp", filepath.Base(dst)))
+	if err := unix.Clonefile(src, tmp, unix.CLONE_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "clonefile", Path: dst, Err: err}
+	}
+	same, err := sameBytes(tmp, dst)
+	if err == nil && !same {
+		err = fmt.Errorf("%s differs in content from %s", dst, src)
+	}
+	if err == nil {
+		err = os.Chmod(tmp, info.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if st, ok := info.Sys().(*unix.Stat_t); ok && err == nil {
+		// only root may give files away, so this fails harmlessly for
+		// files owned by the user
+		os.Lchown(tmp, int(st.Uid), int(st.Gid))
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// sameBytes reports whether the files at a and b hold the same bytes.
+func sameBytes(a, b string) (bool, error) {
+
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == errA, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
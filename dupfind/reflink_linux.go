@@ -0,0 +1,66 @@
+package dupfind
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"time"
+)
+
+// Reflink makes dst share the data of src with the FIDEDUPERANGE ioctl, as
+// supported by Btrfs and XFS. The kernel compares the data of both files
+// and refuses if it differs, so dst never gets content other than its
+// own. dst keeps its inode, so its owner, permissions and timestamps are
+// kept as well.
+func Reflink(src, dst string) error {
+
+	var st unix.Stat_t
+	if err := unix.Stat(dst, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: dst, Err: err}
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if info, err := in.Stat(); err != nil {
+		return err
+	} else if info.Size() != st.Size {
+		return fmt.Errorf("%s differs in size from %s", dst, src)
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	// file systems may share less than asked for in one call
+	for offset := uint64(0); offset < uint64(st.Size); {
+		dedupe := unix.FileDedupeRange{
+			Src_offset: offset,
+			Src_length: uint64(st.Size) - offset,
+			Info:       []unix.FileDedupeRangeInfo{{Dest_fd: int64(out.Fd()), Dest_offset: offset}},
+		}
+		err := unix.IoctlFileDedupeRange(int(in.Fd()), &dedupe)
+		info := dedupe.Info[0]
+		switch {
+		case err == nil && info.Status < 0:
+			err = unix.Errno(-info.Status)
+		case err == nil && info.Status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+			out.Close()
+			return fmt.Errorf("%s differs in content from %s", dst, src)
+		case err == nil && info.Bytes_deduped == 0:
+			err = unix.EINVAL
+		}
+		if err != nil {
+			out.Close()
+			return &os.PathError{Op: "dedupe", Path: dst, Err: err}
+		}
+		offset += info.Bytes_deduped
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// some file systems count sharing data as a write to dst
+	return os.Chtimes(dst, time.Unix(st.Atim.Unix()), time.Unix(st.Mtim.Unix()))
+}
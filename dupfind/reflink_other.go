@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package dupfind
+
+import "errors"
+
+// Reflink fails where file systems cannot share data between files.
+func Reflink(src, dst string) error {
+	return errors.New("reflinks are not supported on this system")
+}
@@ -0,0 +1,74 @@
+package dupfind
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remote is a store of files other than the local file system, whose
+// files have URL paths such as s3://bucket/photos/a.jpg. Requests are
+// made with the context of the run.
+type Remote interface {
+	// Walk calls fn for each file below root.
+	Walk(ctx context.Context, root string, fn func(path string, info os.FileInfo) error) error
+	Stat(ctx context.Context, path string) (os.FileInfo, error)
+	Open(ctx context.Context, path string) (io.ReadCloser, error)
+}
+
+var (
+	remotesMu sync.RWMutex
+	remotes   = make(map[string]Remote)
+)
+
+// RegisterRemote makes paths starting with scheme:// refer to files in
+// remote.
+func RegisterRemote(scheme string, remote Remote) {
+	remotesMu.Lock()
+	defer remotesMu.Unlock()
+	remotes[scheme] = remote
+}
+
+// remoteFor returns the remote holding the file at path, if it is not a
+// local file.
+func remoteFor(path string) (Remote, bool) {
+	scheme, _, ok := strings.Cut(path, "://")
+	if !ok {
+		return nil, false
+	}
+	remotesMu.RLock()
+	defer remotesMu.RUnlock()
+	remote, ok := remotes[scheme]
+	return remote, ok
+}
+
+// IsRemote reports whether path names a file in a registered remote.
+func IsRemote(path string) bool {
+	_, ok := remoteFor(path)
+	return ok
+}
+
+// statFile returns the FileInfo of a local or remote file.
+func statFile(ctx context.Context, path string) (os.FileInfo, error) {
+	if remote, ok := remoteFor(path); ok {
+		return remote.Stat(ctx, path)
+	}
+	return os.Stat(longPath(path))
+}
+
+// remoteFileInfo describes a remote file.
+type remoteFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i remoteFileInfo) Name() string       { return i.name }
+func (i remoteFileInfo) Size() int64        { return i.size }
+func (i remoteFileInfo) Mode() os.FileMode  { return 0 }
+func (i remoteFileInfo) ModTime() time.Time { return i.modTime }
+func (i remoteFileInfo) IsDir() bool        { return false }
+func (i remoteFileInfo) Sys() any           { return nil }
@@ -0,0 +1,135 @@
+package dupfind
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DirRollup rolls the duplicates found below a directory up to the
+// directories holding them, to find the directories whose whole content
+// is already indexed.
+type DirRollup struct {
+	root string
+
+	mu   sync.Mutex
+	dirs map[string]*dirTotal
+}
+
+type dirTotal struct {
+	path       string
+	files      int
+	duplicates int
+	size       int64
+	// indexDir holds the duplicates of all files below path
+	indexDir string
+}
+
+// NewDirRollup returns a rollup of the files below root.
+func NewDirRollup(root string) *DirRollup {
+	return &DirRollup{root: filepath.Clean(root), dirs: make(map[string]*dirTotal)}
+}
+
+// CountPaths counts the files on paths in the directories holding them,
+// passing them on to the returned channel.
+func (r *DirRollup) CountPaths(paths <-chan string) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for path := range paths {
+			r.mu.Lock()
+			r.ancestors(path, func(t *dirTotal) { t.files++ })
+			r.mu.Unlock()
+			out <- path
+		}
+	}()
+	return out
+}
+
+// Add counts m as a duplicate in the directories holding it. Files that
+// are only similar to an indexed file, or duplicate files not indexed,
+// are ignored.
+func (r *DirRollup) Add(m Match) {
+
+	if m.Similar || m.Self || m.Missing || m.IndexPath == "" {
+		return
+	}
+	indexDir := filepath.Dir(m.IndexPath)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ancestors(m.Path, func(t *dirTotal) {
+		t.duplicates++
+		t.size += m.Size
+		if t.indexDir == "" {
+			t.indexDir = indexDir
+		} else {
+			t.indexDir = commonDir(t.indexDir, indexDir)
+		}
+	})
+}
+
+// ancestors calls fn with the totals of each directory holding path, up
+// to the root.
+func (r *DirRollup) ancestors(path string, fn func(t *dirTotal)) {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		key := PathKey(dir)
+		t := r.dirs[key]
+		if t == nil {
+			t = &dirTotal{path: dir}
+			r.dirs[key] = t
+		}
+		fn(t)
+		if SamePath(dir, r.root) || filepath.Dir(dir) == dir {
+			return
+		}
+	}
+}
+
+// commonDir returns the deepest directory holding both a and b.
+func commonDir(a, b string) string {
+	for {
+		if _, ok := CutPathPrefix(b, a); ok || filepath.Dir(a) == a {
+			return a
+		}
+		a = filepath.Dir(a)
+	}
+}
+
+// Duplicates returns the directories all of whose files duplicate
+// indexed files, largest first. Directories below another one returned
+// are left out.
+func (r *DirRollup) Duplicates() []Match {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var complete []*dirTotal
+	for _, t := range r.dirs {
+		if t.files > 0 && t.duplicates == t.files {
+			complete = append(complete, t)
+		}
+	}
+	// parents sort before the directories below them
+	sort.Slice(complete, func(i, j int) bool { return complete[i].path < complete[j].path })
+
+	var dirs []Match
+	var top []string
+	for _, t := range complete {
+		below := false
+		for _, dir := range top {
+			if _, ok := CutPathPrefix(t.path, dir); ok {
+				below = true
+				break
+			}
+		}
+		if below {
+			continue
+		}
+		top = append(top, t.path)
+		dirs = append(dirs, Match{Path: t.path, IndexPath: t.indexDir, Size: t.size, Dir: true, Files: t.files})
+	}
+	sort.SliceStable(dirs, func(i, j int) bool { return dirs[i].Size > dirs[j].Size })
+
+	return dirs
+}
@@ -0,0 +1,127 @@
+package dupfind
+
+import "path/filepath"
+
+// RootPath returns the location of an indexed file. Paths in a relative
+// index are resolved against root, or against the indexed directory if
+// root is empty. Paths in other indexes that lie below the indexed
+// directory are moved below root, so that an index stays usable after
+// its drive is mounted elsewhere.
+func RootPath(header IndexHeader, root, path string) string {
+
+	if header.Relative {
+		if root == "" {
+			root = header.Root
+		}
+		return filepath.Join(root, path)
+	}
+	if root == "" || header.Root == "" {
+		return path
+	}
+	if rest, ok := CutPathPrefix(path, header.Root); ok {
+		return filepath.Join(root, rest)
+	}
+
+	return path
+}
+
+// RelativePath returns the path stored for the file at path in an index
+// with the given header.
+func RelativePath(header IndexHeader, path string) string {
+	if !header.Relative {
+		return path
+	}
+	rel, err := filepath.Rel(header.Root, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// RootRecords resolves the paths of records read from an index with the
+// given header in place, as RootPath does.
+func RootRecords(header IndexHeader, records []Metadata, root string) []Metadata {
+	if !header.Relative && root == "" {
+		return records
+	}
+	for i := range records {
+		records[i].Path = RootPath(header, root, records[i].Path)
+	}
+	return records
+}
+
+// RootHeader returns the header of an index whose records were resolved
+// with RootRecords.
+func RootHeader(header IndexHeader, root string) IndexHeader {
+	if root != "" {
+		header.Root, header.Roots = root, nil
+	}
+	header.Relative = false
+	return header
+}
+
+// RootIndex returns index with the paths of the records it finds
+// resolved as RootPath does.
+func RootIndex(index Index, root string) Index {
+	if !index.Header().Relative && root == "" {
+		return index
+	}
+	return &rootedIndex{Index: index, root: root}
+}
+
+type rootedIndex struct {
+	Index
+	root string
+}
+
+func (r *rootedIndex) Lookup(key string) []Metadata {
+	return RootRecords(r.Index.Header(), cloneRecords(r.Index.Lookup(key)), r.root)
+}
+
+func (r *rootedIndex) Similar(perceptual string, maxDistance int) []Metadata {
+	return RootRecords(r.Index.Header(), cloneRecords(r.Index.Similar(perceptual, maxDistance)), r.root)
+}
+
+func (r *rootedIndex) Overlapping(chunks []string, minShare int) ([]Metadata, []int) {
+	records, shares := r.Index.Overlapping(chunks, minShare)
+	return RootRecords(r.Index.Header(), cloneRecords(records), r.root), shares
+}
+
+func (r *rootedIndex) Header() IndexHeader {
+	return RootHeader(r.Index.Header(), r.root)
+}
+
+// cloneRecords copies records that the index may hold on to.
+func cloneRecords(records []Metadata) []Metadata {
+	return append([]Metadata(nil), records...)
+}
+
+// RecordRoot returns the one of roots that path lies below, the longest
+// if several do, or the empty string if none does.
+func RecordRoot(roots []string, path string) string {
+
+	var found string
+	for _, root := range roots {
+		if _, ok := CutPathPrefix(path, root); ok && len(root) > len(found) {
+			found = root
+		}
+	}
+
+	return found
+}
+
+// TagRoots sets the Root of the records passed through to the one of
+// roots they were found in.
+func TagRoots(metadata <-chan Metadata, roots []string) <-chan Metadata {
+
+	tagged := make(chan Metadata)
+	go func() {
+		defer close(tagged)
+		for record := range metadata {
+			record.Root = RecordRoot(roots, record.Path)
+			tagged <- record
+		}
+	}()
+
+	return tagged
+}
@@ -0,0 +1,137 @@
+package dupfind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterRemote("s3", &s3Remote{})
+}
+
+// s3Remote reads objects in S3 buckets, with credentials and region taken
+// from the usual AWS environment variables and configuration files.
+type s3Remote struct {
+	once   sync.Once
+	client *s3.Client
+	err    error
+}
+
+func (r *s3Remote) connect(ctx context.Context) (*s3.Client, error) {
+	r.once.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			r.err = fmt.Errorf("loading AWS configuration: %w", err)
+			return
+		}
+		r.client = s3.NewFromConfig(cfg)
+	})
+	return r.client, r.err
+}
+
+// splitS3 splits an s3://bucket/key URL.
+func splitS3(url string) (string, string, error) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(url, "s3://"), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %s, expected s3://bucket/prefix", url)
+	}
+	return bucket, key, nil
+}
+
+func (r *s3Remote) Walk(ctx context.Context, root string, fn func(path string, info os.FileInfo) error) error {
+
+	client, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	bucket, prefix, err := splitS3(root)
+	if err != nil {
+		return err
+	}
+	// the prefix names a directory, so photos does not list photos2/a.jpg
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	pages := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			// zero-length keys ending in / are folder markers
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			info := remoteFileInfo{name: path.Base(key), size: aws.ToInt64(object.Size), modTime: aws.ToTime(object.LastModified)}
+			if err := fn("s3://"+bucket+"/"+key, info); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *s3Remote) Stat(ctx context.Context, url string) (os.FileInfo, error) {
+
+	client, err := r.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bucket, key, err := splitS3(url)
+	if err != nil {
+		return nil, err
+	}
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	return remoteFileInfo{name: path.Base(key), size: aws.ToInt64(head.ContentLength), modTime: aws.ToTime(head.LastModified)}, nil
+}
+
+func (r *s3Remote) Open(ctx context.Context, url string) (io.ReadCloser, error) {
+
+	client, err := r.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bucket, key, err := splitS3(url)
+	if err != nil {
+		return nil, err
+	}
+	object, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	return object.Body, nil
+}
+
+// s3Error maps missing objects to fs.ErrNotExist, so that objects deleted
+// during a run count as vanished.
+func s3Error(err error) error {
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noKey) || errors.As(err, &notFound) {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+	return err
+}
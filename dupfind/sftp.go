@@ -0,0 +1,169 @@
+package dupfind
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterRemote("sftp", &sftpRemote{clients: make(map[string]*sftp.Client)})
+}
+
+// sftpRemote reads files on other machines over SFTP. It authenticates
+// with the keys held by ssh-agent or the default keys in ~/.ssh, and
+// checks host keys against ~/.ssh/known_hosts.
+type sftpRemote struct {
+	mu      sync.Mutex
+	clients map[string]*sftp.Client
+}
+
+// splitSFTP splits an sftp://[user@]host[:port]/path URL into the part
+// naming the host and the path on it. Paths are not escaped, so that they
+// read like local paths.
+func splitSFTP(rawURL string) (string, string) {
+	host, path, _ := strings.Cut(strings.TrimPrefix(rawURL, "sftp://"), "/")
+	return "sftp://" + host, "/" + path
+}
+
+// split returns a client for the host of an SFTP URL, and the path on
+// that host.
+func (r *sftpRemote) split(rawURL string) (*sftp.Client, string, error) {
+
+	host, path := splitSFTP(rawURL)
+	u, err := url.Parse(host)
+	if err != nil || u.Host == "" {
+		return nil, "", fmt.Errorf("invalid SFTP URL %s, expected sftp://user@host/path", rawURL)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[host]; ok {
+		return client, path, nil
+	}
+	client, err := dialSFTP(u)
+	if err != nil {
+		return nil, "", fmt.Errorf("connecting to %s: %w", u.Host, err)
+	}
+	r.clients[host] = client
+
+	return client, path, nil
+}
+
+func dialSFTP(u *url.URL) (*sftp.Client, error) {
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, err
+	}
+
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			if keys, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, keys...)
+			}
+		}
+	}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		pem, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		// keys protected by a passphrase must be added to ssh-agent
+		if signer, err := ssh.ParsePrivateKey(pem); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+
+	name := u.User.Username()
+	if name == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		name = current.Username
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            name,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (r *sftpRemote) Walk(ctx context.Context, root string, fn func(path string, info os.FileInfo) error) error {
+
+	client, path, err := r.split(root)
+	if err != nil {
+		return err
+	}
+	host, _ := splitSFTP(root)
+
+	walker := client.Walk(path)
+	for walker.Step() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := walker.Err(); err != nil {
+			if walker.Path() == path {
+				return fmt.Errorf("%s: %w", root, err)
+			}
+			Log.With("path", host+walker.Path(), "error", err).Warnf("Could not read %s: %v", host+walker.Path(), err)
+			continue
+		}
+		// symlinks and special files have no content to hash
+		if !walker.Stat().Mode().IsRegular() {
+			continue
+		}
+		if err := fn(host+walker.Path(), walker.Stat()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *sftpRemote) Stat(ctx context.Context, rawURL string) (os.FileInfo, error) {
+	client, path, err := r.split(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return client.Stat(path)
+}
+
+func (r *sftpRemote) Open(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	client, path, err := r.split(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return client.Open(path)
+}
@@ -0,0 +1,176 @@
+package dupfind
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// ErrBadSignature is returned by VerifyIndex if an index does not match
+// its signature.
+var ErrBadSignature = errors.New("index does not match its signature, it was changed after it was signed")
+
+// SignatureFile returns the name of the signature of index.
+func SignatureFile(index string) string {
+	return index + ".sig"
+}
+
+// SignIndex signs the contents of index with key, and writes the signature
+// next to it. If key is nil, a signature left by an earlier write, which
+// no longer matches, is removed instead.
+func SignIndex(index string, key ed25519.PrivateKey) error {
+
+	name := SignatureFile(index)
+	if key == nil {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	digest, err := indexDigest(index)
+	if err != nil {
+		return err
+	}
+	signature, err := key.Sign(nil, digest, &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(name, []byte(base64.StdEncoding.EncodeToString(signature)+"\n"), 0o644)
+}
+
+// VerifyIndex checks the signature of index with key.
+func VerifyIndex(index string, key ed25519.PublicKey) error {
+
+	data, err := os.ReadFile(SignatureFile(index))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("index is not signed, %s is missing", SignatureFile(index))
+	}
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid signature %s: %w", SignatureFile(index), err)
+	}
+	digest, err := indexDigest(index)
+	if err != nil {
+		return err
+	}
+	if err := ed25519.VerifyWithOptions(key, digest, signature, &ed25519.Options{Hash: crypto.SHA512}); err != nil {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+// indexDigest hashes the file index, which is signed with Ed25519ph so
+// that large indexes need not be read into memory.
+func indexDigest(index string) ([]byte, error) {
+	f, err := os.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// GenerateSigningKey writes a new ed25519 private key to path, and its
+// public key to path.pub, both PEM encoded as written by
+// openssl genpkey -algorithm ed25519.
+func GenerateSigningKey(path string) error {
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(path, "PRIVATE KEY", der, 0o600); err != nil {
+		return err
+	}
+	if der, err = x509.MarshalPKIXPublicKey(public); err != nil {
+		return err
+	}
+
+	return writePEM(path+".pub", "PUBLIC KEY", der, 0o644)
+}
+
+func writePEM(path, kind string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: kind, Bytes: der})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadPrivateKey reads a PEM encoded ed25519 private key.
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+
+	return private, nil
+}
+
+// ReadPublicKey reads a PEM encoded ed25519 public key.
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+
+	return public, nil
+}
+
+func readPEM(path, kind string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != kind {
+		return nil, fmt.Errorf("%s holds no PEM encoded %s", path, strings.ToLower(kind))
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,48 @@
+package dupfind
+
+import (
+	"os"
+)
+
+// specialTypes are the file types that are not hashed: reading a FIFO
+// blocks until something writes to it, and devices may never end.
+const specialTypes = os.ModeNamedPipe | os.ModeSocket | os.ModeDevice | os.ModeCharDevice
+
+// IsSpecial reports whether mode is that of a FIFO, socket or device.
+// Walks skip such files unless asked to include them, and records of them
+// hold their type and size but no checksum.
+func IsSpecial(mode os.FileMode) bool {
+	return mode&specialTypes != 0
+}
+
+// SpecialType names the type of a special file: fifo, socket,
+// char-device or device. It is empty for other files.
+func SpecialType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "char-device"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	}
+	return ""
+}
+
+// specialRecord returns the record of the special file at path, which
+// is never opened.
+func specialRecord(path string, info os.FileInfo) Metadata {
+
+	record := Metadata{
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	}
+	record.Device, record.Inode = fileID(info)
+	record.UID, record.GID, record.Owned = fileOwner(info)
+
+	return record
+}
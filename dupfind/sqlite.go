@@ -0,0 +1,495 @@
+package dupfind
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	_ "modernc.org/sqlite"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sqliteSchema = `
+CREATE TABLE records (
+	path      TEXT PRIMARY KEY,
+	checksum  TEXT NOT NULL,
+	algorithm TEXT NOT NULL DEFAULT '',
+	size      INTEGER NOT NULL,
+	mtime     INTEGER NOT NULL,
+	key       TEXT NOT NULL,
+	partial     TEXT NOT NULL DEFAULT '',
+	partial_key TEXT NOT NULL DEFAULT '',
+	device      INTEGER NOT NULL DEFAULT 0,
+	inode       INTEGER NOT NULL DEFAULT 0,
+	source      TEXT NOT NULL DEFAULT '',
+	perceptual  TEXT NOT NULL DEFAULT '',
+	chunks      TEXT NOT NULL DEFAULT '',
+	mode        INTEGER NOT NULL DEFAULT 0,
+	sparse      INTEGER NOT NULL DEFAULT 0,
+	allocated   INTEGER NOT NULL DEFAULT 0,
+	owned       INTEGER NOT NULL DEFAULT 0,
+	uid         INTEGER NOT NULL DEFAULT 0,
+	gid         INTEGER NOT NULL DEFAULT 0,
+	root        TEXT NOT NULL DEFAULT '',
+	xattrs      TEXT NOT NULL DEFAULT '',
+	unstable    INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX records_key ON records (key);
+CREATE INDEX records_size ON records (size, partial_key);
+CREATE TABLE header (
+	version      INTEGER NOT NULL,
+	algorithm    TEXT NOT NULL,
+	root         TEXT NOT NULL,
+	created      INTEGER NOT NULL,
+	tool_version TEXT NOT NULL,
+	partial      INTEGER NOT NULL DEFAULT 0,
+	relative     INTEGER NOT NULL DEFAULT 0,
+	summary      TEXT NOT NULL DEFAULT '',
+	roots        TEXT NOT NULL DEFAULT '',
+	xattrs       TEXT NOT NULL DEFAULT '',
+	hash_for     TEXT NOT NULL DEFAULT ''
+);
+`
+
+// readHeader reads the index header. Databases without a header table
+// are version 0.
+func readHeader(db *sql.DB) (IndexHeader, error) {
+
+	var header IndexHeader
+	var created int64
+	err := db.QueryRow("SELECT version, algorithm, root, created, tool_version FROM header").
+		Scan(&header.Version, &header.Algorithm, &header.Root, &created, &header.ToolVersion)
+	if err != nil {
+		var missing int
+		if db.QueryRow("SELECT 1 FROM sqlite_master WHERE name = 'header'").Scan(&missing) == sql.ErrNoRows {
+			return IndexHeader{}, nil
+		}
+		return IndexHeader{}, err
+	}
+	header.Created = time.Unix(0, created).UTC()
+	// older databases have no partial or relative columns, their builds
+	// were complete and stored absolute paths, nor a summary
+	db.QueryRow("SELECT partial FROM header").Scan(&header.Partial)
+	db.QueryRow("SELECT relative FROM header").Scan(&header.Relative)
+	db.QueryRow("SELECT xattrs FROM header").Scan(&header.Xattrs)
+	var summary string
+	if db.QueryRow("SELECT summary FROM header").Scan(&summary) == nil && summary != "" {
+		header.Summary = new(IndexSummary)
+		if err := json.Unmarshal([]byte(summary), header.Summary); err != nil {
+			return IndexHeader{}, err
+		}
+	}
+	var roots string
+	if db.QueryRow("SELECT roots FROM header").Scan(&roots) == nil && roots != "" {
+		if err := json.Unmarshal([]byte(roots), &header.Roots); err != nil {
+			return IndexHeader{}, err
+		}
+	}
+	var hashFor string
+	if db.QueryRow("SELECT hash_for FROM header").Scan(&hashFor) == nil && hashFor != "" {
+		if err := json.Unmarshal([]byte(hashFor), &header.HashFor); err != nil {
+			return IndexHeader{}, err
+		}
+	}
+
+	return header, checkIndexVersion(header)
+}
+
+// sqliteStore keeps the index in a SQLite database, so that lookups are
+// answered on disk.
+type sqliteStore string
+
+func (s sqliteStore) open() (*sql.DB, error) {
+	if _, err := os.Stat(string(s)); err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite", string(s))
+}
+
+func (s sqliteStore) Read() (IndexHeader, []Metadata, error) {
+
+	db, err := s.open()
+	if err != nil {
+		return IndexHeader{}, nil, err
+	}
+	defer db.Close()
+
+	header, err := readHeader(db)
+	if err != nil {
+		return IndexHeader{}, nil, err
+	}
+
+	rows, err := db.Query("SELECT * FROM records")
+	if err != nil {
+		return IndexHeader{}, nil, err
+	}
+	records, err := scanRecords(rows)
+
+	return header, records, err
+}
+
+// scanRecords reads all rows into records. Columns are matched by name,
+// so that databases written before a column was added can still be read.
+func scanRecords(rows *sql.Rows) ([]Metadata, error) {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Metadata
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		var record Metadata
+		for i, column := range columns {
+			switch column {
+			case "path":
+				record.Path = sqlString(values[i])
+			case "checksum":
+				record.Checksum = sqlString(values[i])
+			case "algorithm":
+				record.Algorithm = sqlString(values[i])
+			case "partial":
+				record.Partial = sqlString(values[i])
+			case "size":
+				record.Size = sqlInt(values[i])
+			case "mtime":
+				if mtime := sqlInt(values[i]); mtime != 0 && mtime != zeroTimeNano {
+					record.ModTime = time.Unix(0, mtime)
+				}
+			case "device":
+				record.Device = uint64(sqlInt(values[i]))
+			case "inode":
+				record.Inode = uint64(sqlInt(values[i]))
+			case "source":
+				record.Source = sqlString(values[i])
+			case "perceptual":
+				record.Perceptual = sqlString(values[i])
+			case "chunks":
+				record.Chunks = strings.Fields(sqlString(values[i]))
+			case "mode":
+				record.Mode = os.FileMode(sqlInt(values[i]))
+			case "sparse":
+				record.Sparse = sqlInt(values[i]) != 0
+			case "allocated":
+				record.Allocated = sqlInt(values[i])
+			case "owned":
+				record.Owned = sqlInt(values[i]) != 0
+			case "uid":
+				record.UID = uint32(sqlInt(values[i]))
+			case "gid":
+				record.GID = uint32(sqlInt(values[i]))
+			case "root":
+				record.Root = sqlString(values[i])
+			case "xattrs":
+				record.Xattrs = sqlString(values[i])
+			case "unstable":
+				record.Unstable = sqlInt(values[i]) != 0
+			}
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+func sqlString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func sqlInt(value any) int64 {
+	v, _ := value.(int64)
+	return v
+}
+
+func (s sqliteStore) Write(header IndexHeader, records []Metadata) error {
+	return writeAll(s, header, records)
+}
+
+// Create builds a new database next to the index file, which is renamed
+// into place when the writer is closed. All records are inserted in one
+// transaction.
+func (s sqliteStore) Create() (IndexWriter, error) {
+
+	tmp, err := createTemp(string(s))
+	if err != nil {
+		return nil, err
+	}
+	w := &sqliteWriter{name: string(s), tmp: tmp}
+	if w.db, err = sql.Open("sqlite", tmp); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if _, err := w.db.Exec(sqliteSchema); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if w.tx, err = w.db.Begin(); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	w.insert, err = w.tx.Prepare(`INSERT OR REPLACE INTO records
+		(path, checksum, algorithm, size, mtime, key, partial, partial_key, device, inode, source, perceptual, chunks, mode, sparse, allocated, owned, uid, gid, root, xattrs, unstable)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+type sqliteWriter struct {
+	name   string
+	tmp    string
+	db     *sql.DB
+	tx     *sql.Tx
+	insert *sql.Stmt
+}
+
+// zeroTimeNano is the mtime stored by earlier versions for records without
+// a modification time, which Go leaves undefined. Records without one are
+// now stored with 0.
+var zeroTimeNano = time.Time{}.UnixNano()
+
+func (w *sqliteWriter) Add(record Metadata) error {
+	var mtime int64
+	if !record.ModTime.IsZero() {
+		mtime = record.ModTime.UnixNano()
+	}
+	_, err := w.insert.Exec(record.Path, record.Checksum, record.Algorithm,
+		record.Size, mtime, ChecksumKey(record.Algorithm, record.Checksum),
+		record.Partial, partialKeyOf(record), int64(record.Device), int64(record.Inode), record.Source,
+		record.Perceptual, strings.Join(record.Chunks, " "), int64(record.Mode), record.Sparse, record.Allocated,
+		record.Owned, int64(record.UID), int64(record.GID), record.Root, record.Xattrs, record.Unstable)
+	return err
+}
+
+func (w *sqliteWriter) Close(header IndexHeader) error {
+
+	summary, err := sqliteSummary(w.tx)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	var roots []byte
+	if len(header.Roots) > 0 {
+		if roots, err = json.Marshal(header.Roots); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	var hashFor []byte
+	if len(header.HashFor) > 0 {
+		if hashFor, err = json.Marshal(header.HashFor); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	_, err = w.tx.Exec("INSERT INTO header VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", header.Version,
+		header.Algorithm, header.Root, header.Created.UnixNano(), header.ToolVersion, header.Partial,
+		header.Relative, string(data), string(roots), header.Xattrs, string(hashFor))
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	w.insert.Close()
+	if err := w.tx.Commit(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.db.Close(); err != nil {
+		os.Remove(w.tmp)
+		return err
+	}
+	if err := syncFile(w.tmp); err != nil {
+		os.Remove(w.tmp)
+		return err
+	}
+
+	return renameTemp(w.tmp, w.name)
+}
+
+func (w *sqliteWriter) Abort() {
+	if w.tx != nil {
+		w.tx.Rollback()
+	}
+	w.db.Close()
+	os.Remove(w.tmp)
+}
+
+// syncFile flushes the file at name to disk.
+func syncFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func (s sqliteStore) Index() (Index, error) {
+
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := readHeader(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	lookup, err := db.Prepare("SELECT * FROM records WHERE key = ? ORDER BY path")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	// records of version 0 and legacy indexes have no size or mtime, so
+	// as in in-memory indexes, files of any size are candidates then
+	var sizeless int
+	err = db.QueryRow("SELECT 1 FROM records WHERE mtime IN (0, ?) LIMIT 1", zeroTimeNano).Scan(&sizeless)
+	if err == nil {
+		return &sqliteIndex{header: header, db: db, lookup: lookup}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		db.Close()
+		return nil, err
+	}
+	size, err := db.Prepare("SELECT 1 FROM records WHERE size = ? LIMIT 1")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	// indexes written before partial checksums were stored have no
+	// partial column; treat every file as a candidate for those
+	partial, _ := db.Prepare("SELECT 1 FROM records WHERE size = ? AND partial_key IN ('', ?) LIMIT 1")
+
+	return &sqliteIndex{header: header, db: db, lookup: lookup, size: size, partial: partial}, nil
+}
+
+type sqliteIndex struct {
+	header  IndexHeader
+	db      *sql.DB
+	lookup  *sql.Stmt
+	size    *sql.Stmt
+	partial *sql.Stmt
+
+	// images are loaded on the first similarity query
+	loadImages sync.Once
+	images     []Metadata
+	// chunks are loaded on the first overlap query
+	loadChunks sync.Once
+	chunks     *chunkIndex
+}
+
+func (i *sqliteIndex) Similar(perceptual string, maxDistance int) []Metadata {
+	i.loadImages.Do(func() {
+		// indexes written before perceptual hashes were stored have none
+		rows, err := i.db.Query("SELECT * FROM records WHERE perceptual != ''")
+		if err != nil {
+			return
+		}
+		if i.images, err = scanRecords(rows); err != nil {
+			Log.Errorf("Error querying index: %v", err)
+		}
+	})
+	return similarImages(i.images, perceptual, maxDistance)
+}
+
+func (i *sqliteIndex) Overlapping(chunks []string, minShare int) ([]Metadata, []int) {
+	i.loadChunks.Do(func() {
+		var records []Metadata
+		// indexes written before chunks were stored have none
+		rows, err := i.db.Query("SELECT * FROM records WHERE chunks != ''")
+		if err == nil {
+			if records, err = scanRecords(rows); err != nil {
+				Log.Errorf("Error querying index: %v", err)
+			}
+		}
+		i.chunks = newChunkIndex(records)
+	})
+	return i.chunks.overlapping(chunks, minShare)
+}
+
+func (i *sqliteIndex) Header() IndexHeader {
+	return i.header
+}
+
+func (i *sqliteIndex) HasPartial(size int64, key string) bool {
+	if i.partial == nil {
+		return true
+	}
+	var found int
+	err := i.partial.QueryRow(size, key).Scan(&found)
+	return !errors.Is(err, sql.ErrNoRows)
+}
+
+func (i *sqliteIndex) Algorithms() map[string]bool {
+
+	algorithms := make(map[string]bool)
+	rows, err := i.db.Query("SELECT DISTINCT algorithm FROM records")
+	if err != nil {
+		Log.Errorf("Error querying index: %v", err)
+		return algorithms
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var algorithm string
+		if err := rows.Scan(&algorithm); err == nil {
+			algorithms[RecordAlgorithm(Metadata{Algorithm: algorithm})] = true
+		}
+	}
+
+	return algorithms
+}
+
+func (i *sqliteIndex) HasSize(size int64) bool {
+	if i.size == nil {
+		return true
+	}
+	var found int
+	err := i.size.QueryRow(size).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	// on query errors, hash the file rather than risk missing a duplicate
+	return true
+}
+
+func (i *sqliteIndex) Lookup(key string) []Metadata {
+	rows, err := i.lookup.Query(key)
+	if err != nil {
+		Log.Errorf("Error querying index: %v", err)
+		return nil
+	}
+	records, err := scanRecords(rows)
+	if err != nil {
+		Log.Errorf("Error querying index: %v", err)
+		return nil
+	}
+	return records
+}
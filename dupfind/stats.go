@@ -0,0 +1,164 @@
+package dupfind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ScanStats counts files that could not be indexed during a run and
+// collects the errors that make the run fail.
+type ScanStats struct {
+	// Vanished counts files that were deleted between being listed and
+	// being hashed. This is benign when scanning a live directory.
+	Vanished atomic.Int64
+	// Hashed counts the bytes of the files hashed, each counted once
+	// however often it is read.
+	Hashed atomic.Int64
+	// Files counts the files processed so far.
+	Files atomic.Int64
+	// Skipped counts files that were not hashed completely because their
+	// size or partial checksum ruled out a duplicate.
+	Skipped atomic.Int64
+	// Failed counts files that could not be read.
+	Failed atomic.Int64
+	// Unstable counts files that kept changing while they were hashed,
+	// whose checksums may be wrong.
+	Unstable atomic.Int64
+
+	ctx         context.Context
+	errorsFatal bool
+	maxFiles    int64
+	deadline    time.Time
+	started     atomic.Int64
+	aborted     atomic.Bool
+	mu          sync.Mutex
+	err         error
+	failures    []FileError
+	unstable    []FileError
+}
+
+// FileError is a file that could not be processed, and why.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+// NewScanStats returns statistics for a new run, which is aborted when ctx
+// is canceled. If errorsFatal is set, the run is also aborted on the first
+// file that cannot be processed.
+func NewScanStats(ctx context.Context, errorsFatal bool) *ScanStats {
+	return &ScanStats{ctx: ctx, errorsFatal: errorsFatal}
+}
+
+// Fail records that path could not be processed. Unless errors are fatal,
+// the run carries on without it.
+func (s *ScanStats) Fail(path string, err error) {
+	s.Failed.Add(1)
+	s.mu.Lock()
+	s.failures = append(s.failures, FileError{Path: path, Err: err})
+	s.mu.Unlock()
+	Log.With("path", path, "error", err).Warnf("Could not process %s: %v", path, err)
+	if s.errorsFatal {
+		s.Abort(fmt.Errorf("%s: %w", path, err))
+	}
+}
+
+// Failures returns the files that could not be processed so far, in the
+// order they failed.
+func (s *ScanStats) Failures() []FileError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]FileError(nil), s.failures...)
+}
+
+// ErrUnstable is the reason given for files that kept changing while they
+// were hashed.
+var ErrUnstable = errors.New("changed while it was hashed, its checksum may be wrong")
+
+// MarkUnstable records that path kept changing while it was hashed. It is
+// still indexed, unlike the files that failed.
+func (s *ScanStats) MarkUnstable(path string) {
+	s.Unstable.Add(1)
+	s.mu.Lock()
+	s.unstable = append(s.unstable, FileError{Path: path, Err: ErrUnstable})
+	s.mu.Unlock()
+	Log.With("path", path).Warnf("Warning: %s %v", path, ErrUnstable)
+}
+
+// UnstableFiles returns the files that kept changing while they were
+// hashed so far.
+func (s *ScanStats) UnstableFiles() []FileError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]FileError(nil), s.unstable...)
+}
+
+// Abort stops the run, which then fails with err.
+func (s *ScanStats) Abort(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.aborted.Store(true)
+}
+
+// ErrBudget ends runs that used up the budget set with Limit. It wraps
+// context.Canceled, so that they stop as cleanly as interrupted runs.
+var ErrBudget = fmt.Errorf("budget used up: %w", context.Canceled)
+
+// Limit ends the run before it starts on more than files files or once d
+// has passed, whichever comes first. Zero values set no limit. Files
+// being processed are finished first.
+func (s *ScanStats) Limit(files int64, d time.Duration) {
+	s.maxFiles = files
+	if d > 0 {
+		s.deadline = time.Now().Add(d)
+	}
+}
+
+// withinBudget reports whether the budget allows starting on another
+// file, and aborts the run with ErrBudget if not.
+func (s *ScanStats) withinBudget() bool {
+	if s.maxFiles > 0 && s.started.Add(1) > s.maxFiles || !s.deadline.IsZero() && time.Now().After(s.deadline) {
+		s.Abort(ErrBudget)
+		return false
+	}
+	return true
+}
+
+// Aborted reports whether the run has been aborted.
+func (s *ScanStats) Aborted() bool {
+	return s.aborted.Load() || s.ctx.Err() != nil
+}
+
+// Err returns the error that aborted the run, if any. If the run's
+// context was canceled, this is the context's error.
+func (s *ScanStats) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		return s.ctx.Err()
+	}
+	return s.err
+}
+
+// Report logs the number of files that were not indexed.
+func (s *ScanStats) Report() {
+	if n := s.Vanished.Load(); n > 0 {
+		Log.Infof("%d files removed during scan", n)
+	}
+	if n := s.Skipped.Load(); n > 0 {
+		Log.Infof("%d files ruled out as duplicates without hashing them completely", n)
+	}
+	if n := s.Failed.Load(); n > 0 {
+		Log.Warnf("%d files could not be processed", n)
+	}
+	if n := s.Unstable.Load(); n > 0 {
+		Log.Warnf("%d files changed while they were hashed", n)
+	}
+}
@@ -0,0 +1,86 @@
+package dupfind
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// StreamSeparator separates the path of a file from the name of one of
+// its NTFS alternate data streams, as in report.docx:Zone.Identifier.
+const StreamSeparator = ":"
+
+// fileStream is an alternate data stream of a file.
+type fileStream struct {
+	name string
+	size int64
+}
+
+// Container returns the archive holding an archive member, or the file
+// holding an alternate data stream. It returns false for other paths.
+func Container(path string) (string, bool) {
+	if archive, _, ok := ArchiveMember(path); ok {
+		return archive, true
+	}
+	if file, _, ok := FileStream(path); ok {
+		return file, true
+	}
+	return "", false
+}
+
+// IndexesMember reports whether the hasher records the archive member or
+// alternate data stream at path.
+func (h *Hasher) IndexesMember(path string) bool {
+	if _, _, ok := ArchiveMember(path); ok {
+		return h.Archives
+	}
+	if _, _, ok := FileStream(path); ok {
+		return h.Streams
+	}
+	return false
+}
+
+// hashStreams sends a record for every alternate data stream of the file
+// at path, stat'ed as info. If candidates is not nil, streams of a size
+// that does not occur in it are skipped.
+func hashStreams(path string, info os.FileInfo, metadata chan<- Metadata, hasher *Hasher, candidates Index, stats *ScanStats) {
+
+	streams, err := fileStreams(path)
+	if err != nil {
+		stats.Fail(path, err)
+		return
+	}
+	for _, stream := range streams {
+		if stats.Aborted() {
+			return
+		}
+		stats.Files.Add(1)
+		streamPath := path + StreamSeparator + stream.name
+		if candidates != nil && !candidates.HasSize(stream.size) {
+			stats.Skipped.Add(1)
+			continue
+		}
+
+		algorithm := hasher.AlgorithmFor(path)
+		checksum, partial, n, err := hasher.checksum(stats.ctx, streamPath, algorithm)
+		stats.Hashed.Add(n)
+		if errors.Is(err, fs.ErrNotExist) {
+			stats.Vanished.Add(1)
+			continue
+		}
+		if err != nil {
+			stats.Fail(streamPath, err)
+			continue
+		}
+
+		// streams share the times and owner of their file
+		record := FileMetadata(streamPath, info)
+		record.Checksum, record.Partial, record.Size = checksum, partial, stream.size
+		record.Device, record.Inode = 0, 0
+		if algorithm != DefaultAlgorithm {
+			record.Algorithm = algorithm
+		}
+		Log.With("path", streamPath, "checksum", checksum).Debugf("Hashed %s", streamPath)
+		metadata <- record
+	}
+}
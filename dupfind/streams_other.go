@@ -0,0 +1,14 @@
+//go:build !windows
+
+package dupfind
+
+// fileStreams returns no alternate data streams where there are none.
+func fileStreams(path string) ([]fileStream, error) {
+	return nil, nil
+}
+
+// FileStream returns false where files have no alternate data streams,
+// and colons are part of file names.
+func FileStream(path string) (string, string, bool) {
+	return "", "", false
+}
@@ -0,0 +1,69 @@
+package dupfind
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+	"strings"
+	"unsafe"
+)
+
+var (
+	modkernel32          = windows.NewLazySystemDLL("kernel32.dll")
+	procFindFirstStreamW = modkernel32.NewProc("FindFirstStreamW")
+	procFindNextStreamW  = modkernel32.NewProc("FindNextStreamW")
+)
+
+// win32FindStreamData is WIN32_FIND_STREAM_DATA.
+type win32FindStreamData struct {
+	size int64
+	name [windows.MAX_PATH + 36]uint16
+}
+
+// fileStreams returns the alternate data streams of the file at path, if
+// any. File systems other than NTFS have none.
+func fileStreams(path string) ([]fileStream, error) {
+
+	name, err := windows.UTF16PtrFromString(longPath(path))
+	if err != nil {
+		return nil, err
+	}
+	var data win32FindStreamData
+	h, _, err := procFindFirstStreamW.Call(uintptr(unsafe.Pointer(name)), 0, uintptr(unsafe.Pointer(&data)), 0)
+	if windows.Handle(h) == windows.InvalidHandle {
+		if errors.Is(err, windows.ERROR_HANDLE_EOF) || errors.Is(err, windows.ERROR_INVALID_PARAMETER) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer windows.FindClose(windows.Handle(h))
+
+	var streams []fileStream
+	for {
+		// names are :NAME:$DATA, and the file's content is ::$DATA
+		stream := strings.TrimSuffix(strings.TrimPrefix(windows.UTF16ToString(data.name[:]), ":"), ":$DATA")
+		if stream != "" {
+			streams = append(streams, fileStream{name: stream, size: data.size})
+		}
+		if ok, _, err := procFindNextStreamW.Call(h, uintptr(unsafe.Pointer(&data))); ok == 0 {
+			if errors.Is(err, windows.ERROR_HANDLE_EOF) {
+				return streams, nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// FileStream splits the path of an alternate data stream into the path of
+// the file and the stream's name. It returns false for other paths.
+func FileStream(path string) (string, string, bool) {
+
+	base := path[strings.LastIndexAny(path, `\/`)+1:]
+	i := strings.Index(base, StreamSeparator)
+	if i <= 0 || len(base) == len(path) && i == 1 {
+		// a drive letter is not a file
+		return "", "", false
+	}
+	file := path[:len(path)-len(base)+i]
+
+	return file, path[len(file)+len(StreamSeparator):], true
+}
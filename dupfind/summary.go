@@ -0,0 +1,127 @@
+package dupfind
+
+import (
+	"database/sql"
+	"github.com/cespare/xxhash/v2"
+)
+
+// IndexSummary counts the files in an index and those among them with the
+// same content. Writers store it in the header, so that the duplicates
+// within an indexed tree are known without grouping its records again.
+type IndexSummary struct {
+	Files     int64 `json:"files"`
+	Bytes     int64 `json:"bytes"`
+	Checksums int64 `json:"checksums"`
+	// DuplicateGroups counts the checksums shared by several files, which
+	// are DuplicateFiles files taking DuplicateBytes. All but one copy of
+	// each take Wasted bytes.
+	DuplicateGroups int64 `json:"duplicate_groups"`
+	DuplicateFiles  int64 `json:"duplicate_files"`
+	DuplicateBytes  int64 `json:"duplicate_bytes"`
+	Wasted          int64 `json:"wasted"`
+}
+
+type contentCount struct {
+	files int64
+	size  int64
+}
+
+// summaryCounter computes the summary of records as they are written.
+// Checksums are kept as 64-bit hashes of their keys, whose collisions are
+// too unlikely to skew the counts.
+type summaryCounter struct {
+	files    int64
+	bytes    int64
+	contents map[uint64]contentCount
+}
+
+func newSummaryCounter() *summaryCounter {
+	return &summaryCounter{contents: make(map[uint64]contentCount)}
+}
+
+func (c *summaryCounter) add(record Metadata) {
+	c.files++
+	c.bytes += record.Size
+	if record.Checksum == "" {
+		return
+	}
+	key := xxhash.Sum64String(ChecksumKey(record.Algorithm, record.Checksum))
+	count := c.contents[key]
+	count.files++
+	count.size = record.Size
+	c.contents[key] = count
+}
+
+func (c *summaryCounter) summary() *IndexSummary {
+
+	summary := &IndexSummary{Files: c.files, Bytes: c.bytes, Checksums: int64(len(c.contents))}
+	for _, count := range c.contents {
+		if count.files < 2 {
+			continue
+		}
+		summary.DuplicateGroups++
+		summary.DuplicateFiles += count.files
+		summary.DuplicateBytes += count.files * count.size
+		summary.Wasted += (count.files - 1) * count.size
+	}
+
+	return summary
+}
+
+// sqliteSummary computes the summary of the records in a database.
+func sqliteSummary(q interface {
+	QueryRow(query string, args ...any) *sql.Row
+}) (*IndexSummary, error) {
+
+	var summary IndexSummary
+	err := q.QueryRow(`SELECT count(*), coalesce(sum(size), 0), count(DISTINCT CASE WHEN checksum != '' THEN key END)
+		FROM records`).Scan(&summary.Files, &summary.Bytes, &summary.Checksums)
+	if err != nil {
+		return nil, err
+	}
+	err = q.QueryRow(`SELECT count(*), coalesce(sum(n), 0), coalesce(sum(n * size), 0), coalesce(sum((n - 1) * size), 0)
+		FROM (SELECT count(*) AS n, max(size) AS size FROM records WHERE checksum != '' GROUP BY key HAVING n > 1)`).
+		Scan(&summary.DuplicateGroups, &summary.DuplicateFiles, &summary.DuplicateBytes, &summary.Wasted)
+	if err != nil {
+		return nil, err
+	}
+
+	return &summary, nil
+}
+
+// ReadIndexSummary reads the header of the index at path and the summary
+// of its records without holding them in memory. The summary of indexes
+// written before summaries were stored is computed from their records.
+func ReadIndexSummary(path string) (IndexHeader, *IndexSummary, error) {
+
+	if isSQLitePath(path) {
+		db, err := sqliteStore(path).open()
+		if err != nil {
+			return IndexHeader{}, nil, err
+		}
+		defer db.Close()
+		header, err := readHeader(db)
+		if err != nil {
+			return header, nil, err
+		}
+		if header.Summary != nil {
+			return header, header.Summary, nil
+		}
+		summary, err := sqliteSummary(db)
+		return header, summary, err
+	}
+
+	// the header of a JSON index may follow its records, which are read
+	// again to count them if it turns out to have no summary
+	header, err := eachRecord(path, func(Metadata) error { return nil })
+	if err != nil || header.Summary != nil {
+		return header, header.Summary, err
+	}
+	counter := newSummaryCounter()
+	_, err = eachRecord(path, func(record Metadata) error {
+		counter.add(record)
+		return nil
+	})
+
+	return header, counter.summary(), err
+}
@@ -0,0 +1,141 @@
+package dupfind
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most that is read before waiting for the throttle,
+// which keeps reads smooth rather than bursty.
+const throttleChunk = 64 * 1024
+
+// Throttle limits the rate at which files are read, shared by all workers
+// of a run.
+type Throttle struct {
+	mu   sync.Mutex
+	rate float64 // bytes per second
+	next time.Time
+}
+
+// NewThrottle returns a throttle admitting bytesPerSecond.
+func NewThrottle(bytesPerSecond float64) *Throttle {
+	return &Throttle{rate: bytesPerSecond}
+}
+
+// Wait blocks until n more bytes may be read.
+func (t *Throttle) Wait(n int) {
+
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	start := t.next
+	t.next = t.next.Add(time.Duration(float64(n) / t.rate * float64(time.Second)))
+	t.mu.Unlock()
+
+	time.Sleep(start.Sub(now))
+}
+
+// Reader returns a reader of r that is subject to the throttle.
+func (t *Throttle) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &throttledReader{r: r, t: t}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *Throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	r.t.Wait(len(p))
+	return r.r.Read(p)
+}
+
+type throttledFile struct {
+	io.Reader
+	io.Closer
+}
+
+// open opens the file at path for reading, subject to the hasher's
+// throttle. Remote files are read with ctx.
+func (h *Hasher) open(ctx context.Context, path string) (io.ReadCloser, error) {
+	return h.limited(func() (io.ReadCloser, error) {
+		if remote, ok := remoteFor(path); ok {
+			return h.throttled(remote.Open(ctx, path))
+		}
+		return h.throttled(os.Open(longPath(path)))
+	})
+}
+
+// openForHash is open for files that are read from start to end with the
+// hasher's read buffer, which may use direct I/O.
+func (h *Hasher) openForHash(ctx context.Context, path string) (io.ReadCloser, error) {
+	if _, ok := remoteFor(path); ok || !h.DirectIO {
+		return h.open(ctx, path)
+	}
+	return h.limited(func() (io.ReadCloser, error) {
+		return h.throttled(openDirect(longPath(path)))
+	})
+}
+
+// throttled subjects an opened file to the hasher's throttle.
+func (h *Hasher) throttled(f io.ReadCloser, err error) (io.ReadCloser, error) {
+	if err != nil {
+		return nil, err
+	}
+	if h.Throttle == nil {
+		return f, nil
+	}
+	return throttledFile{h.Throttle.Reader(f), f}, nil
+}
+
+// acquire waits until another file may be opened under MaxOpen, and
+// returns the function that releases it again.
+func (h *Hasher) acquire() func() {
+	if h.MaxOpen <= 0 {
+		return func() {}
+	}
+	h.slotsOnce.Do(func() { h.slots = make(chan struct{}, h.MaxOpen) })
+	h.slots <- struct{}{}
+	var once sync.Once
+	return func() { once.Do(func() { <-h.slots }) }
+}
+
+// limited opens a file with open once MaxOpen allows, and gives up its
+// slot when the file is closed.
+func (h *Hasher) limited(open func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	release := h.acquire()
+	f, err := open()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return releasingFile{f, release}, nil
+}
+
+type releasingFile struct {
+	io.ReadCloser
+	release func()
+}
+
+func (f releasingFile) Close() error {
+	defer f.release()
+	return f.ReadCloser.Close()
+}
+
+// pause sleeps for the hasher's Pause before the next file is read.
+func (h *Hasher) pause() {
+	if h.Pause > 0 {
+		time.Sleep(h.Pause)
+	}
+}
@@ -0,0 +1,106 @@
+package dupfind
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Quarantine moves path below dir instead of deleting it. The file keeps
+// its absolute path below dir, so it can be restored by moving it back,
+// and a number is added to its name if dir already holds a file there.
+func Quarantine(dir, path string) (string, error) {
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	// a Windows drive C: becomes the directory C
+	rel := strings.TrimLeft(strings.ReplaceAll(abs, ":", ""), `\/`)
+	dst := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", err
+	}
+	dst = unusedName(dst)
+	if err := moveFile(abs, dst); err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
+
+// unusedName returns path, or path with a number added before its
+// extension if path exists.
+func unusedName(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	name := path
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s.%d%s", base, n, ext)
+	}
+}
+
+// moveFile renames src to dst, copying it if they are on different file
+// systems.
+func moveFile(src, dst string) error {
+
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	info, statErr := os.Lstat(src)
+	if statErr != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	if err := copyFile(src, dst, info); err != nil {
+		return err
+	}
+	if err := os.Remove(src); err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return nil
+}
+
+// CopyFile copies the regular file src to dst, which must not exist yet,
+// keeping its permissions and modification time.
+func CopyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return copyFile(src, dst, info)
+}
+
+// copyFile copies the regular file src to dst, keeping its permissions and
+// modification time. A partial copy is removed.
+func copyFile(src, dst string, info os.FileInfo) error {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+
+	return err
+}
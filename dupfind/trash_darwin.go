@@ -0,0 +1,21 @@
+package dupfind
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// MoveToTrash moves path to ~/.Trash, where the Finder shows it.
+func MoveToTrash(path string) error {
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(home, ".Trash")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	return moveFile(path, unusedName(filepath.Join(dir, filepath.Base(path))))
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package dupfind
+
+import "errors"
+
+// MoveToTrash fails where there is no trash to move files to.
+func MoveToTrash(path string) error {
+	return errors.New("there is no trash on this system, use a quarantine directory instead")
+}
@@ -0,0 +1,58 @@
+package dupfind
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var procSHFileOperationW = syscall.NewLazyDLL("shell32.dll").NewProc("SHFileOperationW")
+
+// shFileOpStruct is the SHFILEOPSTRUCTW structure of the Windows shell.
+type shFileOpStruct struct {
+	hwnd                  uintptr
+	wFunc                 uint32
+	pFrom                 *uint16
+	pTo                   *uint16
+	fFlags                uint16
+	fAnyOperationsAborted int32
+	hNameMappings         uintptr
+	lpszProgressTitle     *uint16
+}
+
+const (
+	foDelete          = 0x3
+	fofSilent         = 0x4
+	fofNoConfirmation = 0x10
+	fofAllowUndo      = 0x40
+	fofNoErrorUI      = 0x400
+)
+
+// MoveToTrash moves path to the Recycle Bin.
+func MoveToTrash(path string) error {
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	// the shell takes a list of names ended by an empty one
+	from, err := syscall.UTF16FromString(abs)
+	if err != nil {
+		return err
+	}
+	from = append(from, 0)
+	op := shFileOpStruct{
+		wFunc:  foDelete,
+		pFrom:  &from[0],
+		fFlags: fofAllowUndo | fofNoConfirmation | fofSilent | fofNoErrorUI,
+	}
+	if r, _, _ := procSHFileOperationW.Call(uintptr(unsafe.Pointer(&op))); r != 0 {
+		return syscall.Errno(r)
+	}
+	if op.fAnyOperationsAborted != 0 {
+		return errors.New("moving to the Recycle Bin was aborted")
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+//go:build unix && !darwin
+
+package dupfind
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// MoveToTrash moves path to the trash of the desktop, following the
+// freedesktop.org trash specification. Files on the file system of the
+// home directory go to $XDG_DATA_HOME/Trash, others to the .Trash-UID
+// directory at the top of their own file system, so they are never
+// copied.
+func MoveToTrash(path string) error {
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(abs)
+	if err != nil {
+		return err
+	}
+	device, _ := fileID(info)
+
+	dir, err := homeTrash()
+	if err != nil {
+		return err
+	}
+	// trashes on other file systems store paths relative to their top
+	// directory
+	name := abs
+	if dirInfo, err := os.Stat(filepath.Dir(dir)); err != nil || deviceOf(dirInfo) != device {
+		top := mountPoint(abs, device)
+		dir = filepath.Join(top, fmt.Sprintf(".Trash-%d", os.Getuid()))
+		if name, err = filepath.Rel(top, abs); err != nil {
+			return err
+		}
+	}
+	for _, sub := range []string{"files", "info"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return err
+		}
+	}
+
+	// creating the info file reserves the name in the trash
+	trashInfo := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: name}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+	base := filepath.Base(abs)
+	for n := 1; ; n++ {
+		trashName := base
+		if n > 1 {
+			trashName = base + "." + strconv.Itoa(n)
+		}
+		infoPath := filepath.Join(dir, "info", trashName+".trashinfo")
+		f, err := os.OpenFile(infoPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		_, err = f.WriteString(trashInfo)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = moveFile(abs, filepath.Join(dir, "files", trashName))
+		}
+		if err != nil {
+			os.Remove(infoPath)
+		}
+		return err
+	}
+}
+
+// homeTrash returns the trash directory in the user's home.
+func homeTrash() (string, error) {
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		data = filepath.Join(home, ".local", "share")
+	}
+	if err := os.MkdirAll(data, 0o700); err != nil {
+		return "", err
+	}
+	return filepath.Join(data, "Trash"), nil
+}
+
+// mountPoint returns the top directory of the file system path is on.
+func mountPoint(path string, device uint64) string {
+	dir := filepath.Dir(path)
+	for {
+		parent := filepath.Dir(dir)
+		info, err := os.Stat(parent)
+		if parent == dir || err != nil || deviceOf(info) != device {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+func deviceOf(info os.FileInfo) uint64 {
+	device, _ := fileID(info)
+	return device
+}
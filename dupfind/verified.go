@@ -0,0 +1,110 @@
+package dupfind
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// VerifiedFile returns the name of the file recording when the files in
+// index were last verified.
+func VerifiedFile(index string) string {
+	return index + ".verified"
+}
+
+// VerifyLog holds when indexed files were last verified, by path, so that
+// runs that verify a sample of the files rotate through all of them.
+type VerifyLog map[string]time.Time
+
+// ReadVerifyLog reads the log of index, which is empty if none was
+// written. Each line holds a time in RFC 3339 format and a path,
+// separated by a tab.
+func ReadVerifyLog(index string) (VerifyLog, error) {
+
+	log := make(VerifyLog)
+	f, err := os.Open(VerifiedFile(index))
+	if errors.Is(err, fs.ErrNotExist) {
+		return log, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		when, path, ok := strings.Cut(scanner.Text(), "\t")
+		t, err := time.Parse(time.RFC3339, when)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%s: invalid line %q", VerifiedFile(index), scanner.Text())
+		}
+		log[path] = t
+	}
+
+	return log, scanner.Err()
+}
+
+// Write replaces the log of index with l.
+func (l VerifyLog) Write(index string) error {
+
+	paths := make([]string, 0, len(l))
+	for path := range l {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	name := VerifiedFile(index)
+	tmp, err := createTemp(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, path := range paths {
+		fmt.Fprintf(w, "%s\t%s\n", l[path].UTC().Format(time.RFC3339Nano), path)
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return renameTemp(tmp, name)
+}
+
+// Sample returns the records verified least recently, those never
+// verified first in random order. It takes count records or, if bytes is
+// not zero, records of at least bytes in total, whichever comes first.
+func (l VerifyLog) Sample(records []Metadata, count int, bytes int64) []Metadata {
+
+	sample := make([]Metadata, len(records))
+	for i, j := range rand.New(rand.NewSource(time.Now().UnixNano())).Perm(len(records)) {
+		sample[i] = records[j]
+	}
+	sort.SliceStable(sample, func(i, j int) bool {
+		return l[sample[i].Path].Before(l[sample[j].Path])
+	})
+
+	var total int64
+	for i, record := range sample {
+		if i == count || bytes > 0 && total >= bytes {
+			return sample[:i]
+		}
+		total += record.Size
+	}
+
+	return sample
+}
@@ -0,0 +1,614 @@
+package dupfind
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// IgnoreFile lists exclude patterns, one per line, in the root of a walk.
+const IgnoreFile = ".dupfindignore"
+
+// WalkConfig selects the files a Walker visits.
+type WalkConfig struct {
+	// Exclude skips files and directories matching any of these patterns.
+	// Patterns containing / match the path relative to the root, others
+	// the base name. Patterns in the root's ignore file are added to them.
+	Exclude []string
+	// Include, if not empty, restricts the walk to files matching any of
+	// these patterns.
+	Include []string
+	// RespectGitignore skips files ignored by git.
+	RespectGitignore bool
+	// FollowSymlinks descends into symlinked directories.
+	FollowSymlinks bool
+	// SkipSymlinks skips symlinked files instead of visiting their targets.
+	SkipSymlinks bool
+	// OneFileSystem skips directories on other file systems than the root,
+	// such as /proc and mounted drives. It has no effect on Windows.
+	OneFileSystem bool
+	// MinSize and MaxSize, if not zero, skip files smaller or larger than
+	// the given number of bytes.
+	MinSize int64
+	MaxSize int64
+	// MaxDepth, if not zero, skips files more than MaxDepth directories
+	// below the root: with 1 only the files in the root are visited.
+	MaxDepth int
+	// PruneDirs skips directories with any of these names, wherever they
+	// are in the tree.
+	PruneDirs []string
+	// SkipHidden skips files and directories whose name starts with a dot
+	// and, on Windows, those with the hidden attribute. The root is always
+	// visited.
+	SkipHidden bool
+	// Types and Extensions, if not empty, restrict the walk to files of
+	// these classes (image, video, audio, document or archive) and with
+	// these extensions. SniffTypes also visits files without an extension
+	// whose first bytes show that they are of one of the Types.
+	Types      []string
+	Extensions []string
+	SniffTypes bool
+	// Workers is the number of directories read at once. Reading several
+	// helps on network file systems, where each read waits for the server.
+	// Files are then visited in no particular order.
+	Workers int
+	// IncludeSpecial visits FIFOs, sockets and devices, which are
+	// otherwise skipped since reading them may block or never end.
+	IncludeSpecial bool
+}
+
+// NewWalker returns a walker for config, after checking its patterns.
+func NewWalker(config WalkConfig) (*Walker, error) {
+	for _, pattern := range append(config.Exclude, config.Include...) {
+		if err := checkPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	extensions, err := typeExtensions(config.Types, config.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]bool)
+	for _, name := range config.Types {
+		types[name] = true
+	}
+	return &Walker{
+		exclude:        config.Exclude,
+		include:        config.Include,
+		gitignore:      config.RespectGitignore,
+		followSymlinks: config.FollowSymlinks,
+		skipSymlinks:   config.SkipSymlinks,
+		oneFileSystem:  config.OneFileSystem,
+		minSize:        config.MinSize,
+		maxSize:        config.MaxSize,
+		maxDepth:       config.MaxDepth,
+		pruneDirs:      config.PruneDirs,
+		skipHidden:     config.SkipHidden,
+		extensions:     extensions,
+		types:          types,
+		sniffTypes:     config.SniffTypes,
+		workers:        config.Workers,
+		includeSpecial: config.IncludeSpecial,
+	}, nil
+}
+
+// Walker visits the files below a root directory, skipping those that
+// are filtered out.
+type Walker struct {
+	exclude        []string
+	include        []string
+	gitignore      bool
+	followSymlinks bool
+	skipSymlinks   bool
+	oneFileSystem  bool
+	minSize        int64
+	maxSize        int64
+	maxDepth       int
+	pruneDirs      []string
+	skipHidden     bool
+	extensions     map[string]bool
+	types          map[string]bool
+	sniffTypes     bool
+	workers        int
+	includeSpecial bool
+}
+
+// pruned reports whether the directory at rel, relative to the root, is
+// skipped for its name.
+func (w *Walker) pruned(rel string) bool {
+	name := rel[strings.LastIndexByte(rel, '/')+1:]
+	for _, prune := range w.pruneDirs {
+		if SamePath(name, prune) {
+			return true
+		}
+	}
+	return false
+}
+
+// hidden reports whether the file or directory at rel, relative to the
+// root, is skipped for being hidden. Its info is only consulted for the
+// hidden attribute, and may be nil where there is none.
+func (w *Walker) hidden(rel string, info os.FileInfo) bool {
+	if !w.skipHidden {
+		return false
+	}
+	name := rel[strings.LastIndexByte(rel, '/')+1:]
+	return strings.HasPrefix(name, ".") || info != nil && hiddenAttribute(info)
+}
+
+// tooDeep reports whether the file at rel, relative to the root, is below
+// the maximum depth.
+func (w *Walker) tooDeep(rel string) bool {
+	return w.maxDepth > 0 && strings.Count(rel, "/") >= w.maxDepth
+}
+
+// sizeAllowed reports whether a file of the given size passes the size
+// limits.
+func (w *Walker) sizeAllowed(size int64) bool {
+	return size >= w.minSize && (w.maxSize == 0 || size <= w.maxSize)
+}
+
+// skipsSpecial reports whether the file described by info is a special
+// file that is skipped.
+func (w *Walker) skipsSpecial(path string, info os.FileInfo) bool {
+	if w.includeSpecial || !IsSpecial(info.Mode()) {
+		return false
+	}
+	Log.With("path", path).Debugf("Skipping %s, it is a %s", path, SpecialType(info.Mode()))
+	return true
+}
+
+func checkPattern(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return nil
+}
+
+// matchPattern matches rel, a slash-separated path relative to the walk
+// root, against pattern.
+func matchPattern(pattern, rel string) bool {
+	if strings.Contains(pattern, "/") {
+		matched, _ := filepath.Match(strings.TrimPrefix(pattern, "/"), rel)
+		return matched
+	}
+	matched, _ := filepath.Match(pattern, filepath.Base(rel))
+	return matched
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// readIgnoreFile reads exclude patterns from the ignore file in root, if
+// there is one. Blank lines and lines starting with # are skipped.
+func readIgnoreFile(root string) ([]string, error) {
+
+	f, err := os.Open(filepath.Join(root, IgnoreFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := checkPattern(line); err != nil {
+			return nil, fmt.Errorf("%s: %v", IgnoreFile, err)
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// walk holds the state of a single Walker.Walk call.
+type walk struct {
+	*Walker
+	exclude []string
+	git     gitRules
+	stats   *ScanStats
+	fn      func(path string, info os.FileInfo) error
+	// device is the device of the root
+	device uint64
+
+	// with several workers, slots limits the goroutines reading
+	// directories besides the calling one, mu guards git and err, and fnMu
+	// serializes calls of fn
+	slots   chan struct{}
+	pending sync.WaitGroup
+	mu      sync.Mutex
+	fnMu    sync.Mutex
+	err     error
+}
+
+// Walk calls fn for every file below root that passes the filters. If
+// stats is given, files that disappear or cannot be read during the walk
+// are recorded there instead of ending the walk.
+func (w *Walker) Walk(root string, stats *ScanStats, fn func(path string, info os.FileInfo) error) error {
+
+	if remote, ok := remoteFor(root); ok {
+		return w.walkRemote(remote, root, stats, fn)
+	}
+	root = nativeName(root)
+	exclude, err := readIgnoreFile(root)
+	if err != nil {
+		return err
+	}
+
+	state := &walk{
+		Walker:  w,
+		exclude: append(exclude, w.exclude...),
+		stats:   stats,
+		fn:      fn,
+	}
+	if w.gitignore {
+		if state.git, err = loadRootGitRules(root); err != nil {
+			return err
+		}
+	}
+
+	// the root is always followed, even if it is a symlink
+	info, err := os.Stat(longPath(root))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if !w.sizeAllowed(info.Size()) || w.skipsSpecial(root, info) {
+			return nil
+		}
+		return fn(root, info)
+	}
+
+	state.device, _ = fileID(info)
+	if w.workers > 1 {
+		state.slots = make(chan struct{}, w.workers-1)
+	}
+	err = state.dir(root, "", []os.FileInfo{info})
+	state.pending.Wait()
+	if err == nil {
+		err = state.err
+	}
+	if err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// spawn reads the directory at path in a new goroutine if a slot is free,
+// and reports whether it did.
+func (w *walk) spawn(path, rel string, parents []os.FileInfo) bool {
+	select {
+	case w.slots <- struct{}{}:
+	default:
+		return false
+	}
+	w.pending.Add(1)
+	go func() {
+		defer w.pending.Done()
+		defer func() { <-w.slots }()
+		if err := w.dir(path, rel, parents); err != nil {
+			w.mu.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+			w.mu.Unlock()
+		}
+	}()
+	return true
+}
+
+// stopped reports whether another goroutine ended the walk.
+func (w *walk) stopped() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err != nil
+}
+
+// walkRemote visits the files below root in remote. Patterns, size limits
+// and extensions apply as for local files, but there are no ignore files
+// and files are not sniffed.
+func (w *Walker) walkRemote(remote Remote, root string, stats *ScanStats, fn func(path string, info os.FileInfo) error) error {
+
+	ctx := context.Background()
+	if stats != nil {
+		ctx = stats.ctx
+	}
+	err := remote.Walk(ctx, root, func(path string, info os.FileInfo) error {
+		if stats != nil && stats.Aborted() {
+			return filepath.SkipAll
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(path, root), "/")
+		if w.tooDeep(rel) {
+			return nil
+		}
+		// files in excluded directories are skipped as well
+		for dir := rel; ; {
+			if matchAny(w.exclude, dir) || dir != rel && w.pruned(dir) || w.hidden(dir, nil) {
+				return nil
+			}
+			i := strings.LastIndexByte(dir, '/')
+			if i < 0 {
+				break
+			}
+			dir = dir[:i]
+		}
+		if len(w.include) > 0 && !matchAny(w.include, rel) || !w.sizeAllowed(info.Size()) || !w.typeAllowed(rel, false) {
+			return nil
+		}
+		return fn(path, info)
+	})
+	if err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// WalkPaths visits the files named in r, which are separated by sep, such
+// as '\n' for the output of find(1) or 0 for that of find -print0. Paths
+// are made absolute. Directories are skipped, and files are skipped by
+// their base name and size as in a walk of their directory.
+func (w *Walker) WalkPaths(r io.Reader, sep byte, stats *ScanStats, fn func(path string, info os.FileInfo) error) error {
+
+	state := &walk{Walker: w, stats: stats}
+	scanner := bufio.NewScanner(r)
+	scanner.Split(splitAt(sep))
+	for scanner.Scan() {
+		if stats != nil && stats.Aborted() {
+			return nil
+		}
+		if scanner.Text() == "" {
+			continue
+		}
+		path, err := filepath.Abs(nativeName(scanner.Text()))
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Lstat(longPath(path))
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if w.skipSymlinks {
+				continue
+			}
+			info, err = os.Stat(longPath(path))
+		}
+		if err != nil {
+			if err := state.failed(path, err); err == filepath.SkipAll {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := filepath.Base(path)
+		if info.IsDir() || w.skipsSpecial(path, info) || matchAny(w.exclude, name) || w.hidden(name, info) ||
+			len(w.include) > 0 && !matchAny(w.include, name) || !w.sizeAllowed(info.Size()) || !w.typeAllowed(path, true) {
+			continue
+		}
+		if err := fn(path, info); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// splitAt returns a split function for a bufio.Scanner that splits at
+// sep. Lines may also end in \r\n if sep is '\n'.
+func splitAt(sep byte) bufio.SplitFunc {
+	if sep == '\n' {
+		return bufio.ScanLines
+	}
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, sep); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// Filter returns a function that reports whether a walk of root would
+// visit the file at path, judging by the exclude and include patterns,
+// the ignore file in root, the size limits and the file types. Special
+// files fail unless included. Gitignore rules are not consulted.
+// Directories pass unless they are excluded.
+func (w *Walker) Filter(root string) (func(path string, info os.FileInfo) bool, error) {
+
+	exclude, err := readIgnoreFile(root)
+	if err != nil {
+		return nil, err
+	}
+	exclude = append(exclude, w.exclude...)
+
+	return func(path string, info os.FileInfo) bool {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return false
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && (info.IsDir() && w.tooDeep(rel+"/") || !info.IsDir() && w.tooDeep(rel)) {
+			return false
+		}
+		// files in excluded directories are skipped as well
+		for dir := rel; dir != "."; {
+			if matchAny(exclude, dir) || (dir != rel || info.IsDir()) && w.pruned(dir) || w.hidden(dir, nil) {
+				return false
+			}
+			i := strings.LastIndexByte(dir, '/')
+			if i < 0 {
+				break
+			}
+			dir = dir[:i]
+		}
+		if rel != "." && w.hidden(rel, info) {
+			return false
+		}
+		if info.IsDir() {
+			return true
+		}
+		if !w.includeSpecial && IsSpecial(info.Mode()) {
+			return false
+		}
+		return (len(w.include) == 0 || matchAny(w.include, rel)) && w.sizeAllowed(info.Size()) && w.typeAllowed(path, true)
+	}, nil
+}
+
+// failed handles an error for path. It returns nil to carry on with the
+// walk, or the error that ends it.
+func (w *walk) failed(path string, err error) error {
+	if w.stats == nil {
+		return err
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		w.stats.Vanished.Add(1)
+	} else {
+		w.stats.Fail(path, err)
+	}
+	if w.stats.Aborted() {
+		return filepath.SkipAll
+	}
+	return nil
+}
+
+// dir visits the entries of the directory at path. Its path relative to
+// the root is rel, and parents holds the directories leading to it, which
+// is used to detect symlink cycles.
+func (w *walk) dir(path, rel string, parents []os.FileInfo) error {
+
+	entries, err := os.ReadDir(longPath(path))
+	if err != nil {
+		return w.failed(path, err)
+	}
+
+	for _, entry := range entries {
+		if w.stats != nil && w.stats.Aborted() || w.slots != nil && w.stopped() {
+			return filepath.SkipAll
+		}
+
+		name := nativeName(entry.Name())
+		child := filepath.Join(path, name)
+		childRel := name
+		if rel != "" {
+			childRel = rel + "/" + name
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if err := w.failed(child, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if w.hidden(childRel, info) {
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(longPath(child))
+			if err != nil {
+				// dangling symlinks do not point to any content
+				continue
+			}
+			if target.IsDir() && !w.followSymlinks || !target.IsDir() && w.skipSymlinks {
+				continue
+			}
+			info = target
+		}
+
+		if matchAny(w.exclude, childRel) || w.ignored(childRel, info.IsDir()) {
+			continue
+		}
+
+		if info.IsDir() {
+			if visited(parents, info) || w.otherFileSystem(info) || w.pruned(name) ||
+				w.maxDepth > 0 && len(parents) >= w.maxDepth {
+				continue
+			}
+			if w.git != nil {
+				w.mu.Lock()
+				err := w.git.load(child, childRel)
+				w.mu.Unlock()
+				if err != nil {
+					return err
+				}
+			}
+			// the copy keeps goroutines from sharing the parents' array
+			below := append(parents[:len(parents):len(parents)], info)
+			if w.slots != nil && w.spawn(child, childRel, below) {
+				continue
+			}
+			if err := w.dir(child, childRel, below); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if w.skipsSpecial(child, info) || len(w.include) > 0 && !matchAny(w.include, childRel) ||
+			!w.sizeAllowed(info.Size()) || !w.typeAllowed(child, true) {
+			continue
+		}
+		w.fnMu.Lock()
+		err = w.fn(child, info)
+		w.fnMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// otherFileSystem reports whether the directory dir is a mount point that
+// the walk must not cross.
+func (w *walk) otherFileSystem(dir os.FileInfo) bool {
+	if !w.oneFileSystem {
+		return false
+	}
+	device, _ := fileID(dir)
+	return device != w.device
+}
+
+// ignored reports whether gitignore rules exclude rel.
+func (w *walk) ignored(rel string, isDir bool) bool {
+	if w.git == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.git.ignored(rel, isDir)
+}
+
+// visited reports whether dir is one of the given parent directories, in
+// which case following a symlink to it would loop forever.
+func visited(parents []os.FileInfo, dir os.FileInfo) bool {
+	for _, parent := range parents {
+		if os.SameFile(parent, dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package dupfind
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IndexWriter writes a new index one record at a time, so that records
+// need not be held in memory. The index replaces an existing file only
+// once it is complete.
+type IndexWriter interface {
+	Add(record Metadata) error
+	// Close completes the index. The header is passed last so that it can
+	// describe how the run ended.
+	Close(header IndexHeader) error
+	// Abort discards the new index, leaving an existing file untouched.
+	Abort()
+}
+
+// writeAll writes an index holding the given records.
+func writeAll(store IndexStore, header IndexHeader, records []Metadata) error {
+
+	w, err := store.Create()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := w.Add(record); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+
+	return w.Close(header)
+}
+
+// IsIndexFile reports whether path is the index file at index, its
+// signature, the checkpoint of its build, its undo log or one of the
+// temporary files written while replacing it, which should not be indexed
+// themselves.
+func IsIndexFile(index, path string) bool {
+	base := PathKey(filepath.Base(index))
+	name := PathKey(filepath.Base(path))
+	return SamePath(filepath.Dir(path), filepath.Dir(index)) &&
+		(name == base || name == base+".sig" || name == base+".bloom" || name == base+".checkpoint" || name == base+".verified" || name == base+".undo" || name == base+".history" || strings.HasPrefix(name, "."+base+".tmp"))
+}
+
+// createTemp creates an empty temporary file next to name, to be renamed
+// over it with renameTemp once it is complete.
+func createTemp(name string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// renameTemp moves the temporary file tmp into place at name. The file
+// must have been synced to disk, so that a crash after the rename cannot
+// leave an empty index behind.
+func renameTemp(tmp, name string) error {
+
+	// temporary files are private, give the index the usual permissions
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(name); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
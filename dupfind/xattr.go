@@ -0,0 +1,71 @@
+package dupfind
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// The ways of treating extended attributes, such as macOS resource forks
+// and Finder info, set in Hasher.Xattrs and recorded in index headers.
+const (
+	// XattrsIgnore leaves extended attributes out, so that files with the
+	// same content are duplicates whatever their attributes.
+	XattrsIgnore = "ignore"
+	// XattrsHash includes them in the checksum, so that files whose
+	// attributes differ are not duplicates.
+	XattrsHash = "hash"
+	// XattrsRecord records a checksum of them separately, in
+	// Metadata.Xattrs, so that duplicates whose attributes differ can be
+	// flagged.
+	XattrsRecord = "record"
+)
+
+// xattrsDigest returns the checksum of the extended attributes of the file
+// at path, names and values, or "" if it has none.
+func xattrsDigest(path string, algorithm string) (string, error) {
+
+	attrs, err := readXattrs(path)
+	if err != nil || len(attrs) == 0 {
+		return "", err
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := HashAlgorithms[algorithm]()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write(binary.AppendUvarint(nil, uint64(len(attrs[name]))))
+		h.Write(attrs[name])
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// XattrsChecksum returns the checksum HashFilePaths records for the file
+// at path with XattrsHash, given checksum, that of its content.
+func XattrsChecksum(path, checksum, algorithm string) (string, error) {
+
+	digest, err := xattrsDigest(path, algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	return withXattrs(checksum, digest, algorithm), nil
+}
+
+// withXattrs returns the checksum of a file with content checksum
+// checksum and extended attributes digest, which is checksum itself for
+// files without any.
+func withXattrs(checksum, digest string, algorithm string) string {
+	if digest == "" {
+		return checksum
+	}
+	h := HashAlgorithms[algorithm]()
+	fmt.Fprintf(h, "%s\x00xattrs\x00%s", checksum, digest)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
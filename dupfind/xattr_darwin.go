@@ -0,0 +1,9 @@
+package dupfind
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// errNoXattr is the error for reading an extended attribute that does not
+// exist.
+const errNoXattr = unix.ENOATTR
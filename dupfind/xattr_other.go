@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package dupfind
+
+// readXattrs returns no extended attributes where they are not supported.
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
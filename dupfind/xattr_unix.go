@@ -0,0 +1,60 @@
+//go:build linux || darwin
+
+package dupfind
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"strings"
+)
+
+// readXattrs returns the extended attributes of the file at path by name.
+// File systems without them have none.
+func readXattrs(path string) (map[string][]byte, error) {
+
+	list, err := xattrBuffer(func(buf []byte) (int, error) { return unix.Listxattr(path, buf) })
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range strings.Split(string(list), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := xattrBuffer(func(buf []byte) (int, error) { return unix.Getxattr(path, name, buf) })
+		if errors.Is(err, errNoXattr) {
+			// removed since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = value
+	}
+
+	return attrs, nil
+}
+
+// xattrBuffer calls read first to learn the size of the result and then
+// to fill a buffer of that size, retrying if it grew in between.
+func xattrBuffer(read func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := read(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// execMatchWriter runs a command for each match before writing it, with
+// the placeholders {}, {index} and {checksum} in its arguments replaced by
+// the path, the indexed path and the checksum of the match.
+type execMatchWriter struct {
+	MatchWriter
+	args   []string
+	failed int
+}
+
+// newExecMatchWriter returns a writer running command, which is split into
+// arguments like a shell would but is not run by one, for each match
+// written to out.
+func newExecMatchWriter(command string, out MatchWriter) (*execMatchWriter, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, fmt.Errorf("--exec: %w", err)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("--exec: no command given")
+	}
+	return &execMatchWriter{MatchWriter: out, args: args}, nil
+}
+
+func (e *execMatchWriter) Write(m dupfind.Match) error {
+
+	replacer := strings.NewReplacer("{}", m.Path, "{index}", m.IndexPath, "{checksum}", m.Checksum)
+	args := make([]string, len(e.args))
+	for i, arg := range e.args {
+		args[i] = replacer.Replace(arg)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		dupfind.Log.With("path", m.Path, "error", err).Warnf("Command for %s failed: %v", m.Path, err)
+		e.failed++
+	}
+
+	return e.MatchWriter.Write(m)
+}
+
+func (e *execMatchWriter) Close() error {
+	if err := e.MatchWriter.Close(); err != nil {
+		return err
+	}
+	if e.failed > 0 {
+		return fmt.Errorf("--exec failed for %d files", e.failed)
+	}
+	return nil
+}
+
+// splitCommand splits s into words at unquoted white space. Single quotes
+// keep everything up to the next single quote, double quotes everything
+// but backslash escapes up to the next double quote.
+func splitCommand(s string) ([]string, error) {
+
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ExportCmd struct {
+	Index  string `arg:"" optional:"" help:"Index file (default: the index set in the config file)." type:"path"`
+	Format string `help:"Output format: gnu as written by sha256sum, bsd as written by shasum --tag, or hashdeep (${enum})." enum:"gnu,bsd,hashdeep" default:"gnu"`
+	Output string `short:"o" help:"Write to FILE instead of stdout." placeholder:"FILE" type:"path"`
+}
+
+type ImportCmd struct {
+	Checksums string `arg:"" help:"File of checksums in sha256sum, BSD or hashdeep format, or - to read stdin." type:"path"`
+	Index     string `arg:"" optional:"" help:"Index file to write (default: the index set in the config file)." type:"path"`
+	Algorithm string `help:"Algorithm of checksums in sha256sum format (${enum}). By default it is guessed from their length." enum:",sha256,sha1,blake3,xxhash64" default:""`
+	Root      string `help:"Directory that relative paths in the file are relative to (default: the current directory)." placeholder:"DIR" type:"path"`
+	Force     bool   `short:"f" help:"Overwrite an existing index file"`
+	Encrypt   bool   `help:"Encrypt the index with the passphrase given with --passphrase-file or DUPFIND_PASSPHRASE."`
+
+	SignOptions `embed:""`
+}
+
+// bsdNames maps hash algorithms to their names in BSD style digests.
+var bsdNames = map[string]string{
+	"sha256":   "SHA256",
+	"sha1":     "SHA1",
+	"blake3":   "BLAKE3",
+	"xxhash64": "XXH64",
+}
+
+func (e *ExportCmd) Run(ctx *Context) error {
+
+	var err error
+	if e.Index, err = ctx.indexFile(e.Index); err != nil {
+		return err
+	}
+	header, records, err := dupfind.ReadIndex(e.Index)
+	if err != nil {
+		return err
+	}
+	warnPartial(e.Index, header)
+	records = dupfind.RootRecords(header, records, "")
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+
+	var out io.Writer = os.Stdout
+	if e.Output != "" {
+		f, err := os.Create(e.Output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+
+	// gnu and hashdeep files hold a single algorithm
+	algorithm := header.Algorithm
+	if algorithm == "" {
+		algorithm = dupfind.DefaultAlgorithm
+	}
+	if e.Format == "hashdeep" {
+		if algorithm != "sha256" && algorithm != "sha1" {
+			return fmt.Errorf("hashdeep does not support %s checksums", algorithm)
+		}
+		fmt.Fprintf(w, "%%%%%%%% HASHDEEP-1.0\n%%%%%%%% size,%s,filename\n", algorithm)
+		fmt.Fprintf(w, "## Exported by dupfind from %s\n##\n", e.Index)
+	}
+
+	var skipped int
+	for _, record := range records {
+		recordAlgorithm := dupfind.RecordAlgorithm(record)
+		if e.Format != "bsd" && recordAlgorithm != algorithm {
+			skipped++
+			continue
+		}
+		switch e.Format {
+		case "bsd":
+			fmt.Fprintf(w, "%s (%s) = %s\n", bsdNames[recordAlgorithm], record.Path, record.Checksum)
+		case "hashdeep":
+			fmt.Fprintf(w, "%d,%s,%s\n", record.Size, record.Checksum, record.Path)
+		default:
+			// like sha256sum, escape names that would break the line format
+			if strings.ContainsAny(record.Path, "\\\n") {
+				escaped := strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(record.Path)
+				fmt.Fprintf(w, "\\%s  %s\n", record.Checksum, escaped)
+			} else {
+				fmt.Fprintf(w, "%s  %s\n", record.Checksum, record.Path)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if skipped > 0 {
+		dupfind.Log.Warnf("Warning: skipped %d files not hashed with %s, use --format bsd to export them", skipped, algorithm)
+	}
+
+	return nil
+}
+
+var (
+	bsdLine = regexp.MustCompile(`^([A-Za-z0-9]+) \((.*)\) = ([0-9a-fA-F]+)$`)
+	gnuLine = regexp.MustCompile(`^(\\?)([0-9a-fA-F]+) [ *](.*)$`)
+)
+
+// guessAlgorithm returns the algorithm of a checksum in sha256sum format
+// by its length. Blake3 checksums are as long as SHA-256 ones and need
+// --algorithm.
+func guessAlgorithm(checksum string) string {
+	switch len(checksum) {
+	case 40:
+		return "sha1"
+	case 16:
+		return "xxhash64"
+	default:
+		return "sha256"
+	}
+}
+
+func (i *ImportCmd) Run(ctx *Context) error {
+
+	var err error
+	if i.Index, err = ctx.indexFile(i.Index); err != nil {
+		return err
+	}
+	if err := checkOverwrite(i.Index, i.Force); err != nil {
+		return err
+	}
+	key, err := i.signingKey()
+	if err != nil {
+		return err
+	}
+	store, err := openIndexStore(i.Index, "", i.Encrypt)
+	if err != nil {
+		return err
+	}
+	if i.Root == "" {
+		if i.Root, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+
+	var in io.Reader = os.Stdin
+	if i.Checksums != "-" {
+		f, err := os.Open(i.Checksums)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var records []dupfind.Metadata
+	algorithms := make(map[string]bool)
+	var missing, unsupported int
+	// hashdeep files name their columns in a header line
+	var columns []string
+	scanner := bufio.NewScanner(in)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		var path, algorithm, checksum string
+		size := int64(-1)
+
+		if names, ok := strings.CutPrefix(line, "%%%% "); ok {
+			if !strings.HasPrefix(names, "HASHDEEP") {
+				columns = strings.Split(names, ",")
+			}
+			continue
+		}
+		switch {
+		case line == "" || strings.HasPrefix(line, "##"):
+			continue
+		case columns != nil:
+			values := strings.SplitN(line, ",", len(columns))
+			if len(values) != len(columns) {
+				return fmt.Errorf("%s:%d: expected %d columns", i.Checksums, n, len(columns))
+			}
+			for c, column := range columns {
+				switch column {
+				case "size":
+					size, _ = strconv.ParseInt(values[c], 10, 64)
+				case "filename":
+					path = values[c]
+				case "sha256", "sha1":
+					if algorithm == "" || column == "sha256" {
+						algorithm, checksum = column, values[c]
+					}
+				}
+			}
+		default:
+			if m := bsdLine.FindStringSubmatch(line); m != nil {
+				for name, bsd := range bsdNames {
+					if strings.EqualFold(m[1], bsd) {
+						algorithm = name
+					}
+				}
+				path, checksum = m[2], m[3]
+			} else if m := gnuLine.FindStringSubmatch(line); m != nil {
+				checksum, path = m[2], m[3]
+				if m[1] != "" {
+					path = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(path)
+				}
+				algorithm = i.Algorithm
+				if algorithm == "" {
+					algorithm = guessAlgorithm(checksum)
+				}
+			} else {
+				return fmt.Errorf("%s:%d: not a checksum line", i.Checksums, n)
+			}
+		}
+		if algorithm == "" || checksum == "" || path == "" {
+			unsupported++
+			continue
+		}
+
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(i.Root, path)
+		}
+		record := dupfind.Metadata{Path: path, Checksum: strings.ToLower(checksum), Size: size}
+		if info, err := os.Stat(path); err == nil {
+			record.Size, record.ModTime, record.Mode = info.Size(), info.ModTime(), info.Mode()
+		} else if size < 0 {
+			// without a size the file could never be matched
+			dupfind.Log.With("path", path, "error", err).Warnf("Skipping %s: %v", path, err)
+			missing++
+			continue
+		}
+		if algorithm != dupfind.DefaultAlgorithm {
+			record.Algorithm = algorithm
+		}
+		algorithms[algorithm] = true
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New("no checksums to import")
+	}
+
+	header := dupfind.NewIndexHeader(i.Root, "")
+	if len(algorithms) == 1 {
+		for algorithm := range algorithms {
+			header.Algorithm = algorithm
+		}
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].Path < records[b].Path })
+	if err := store.Write(header, records); err != nil {
+		return fmt.Errorf("writing index %s: %w", i.Index, err)
+	}
+	if err := finishIndex(i.Index, key); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d files into %s (%d missing, %d with unsupported algorithms).\n", len(records), i.Index, missing, unsupported)
+
+	return nil
+}
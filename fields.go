@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// matchFields are the parts of a match that --fields can select, named
+// as in JSON and CSV output.
+var matchFields = map[string]func(m dupfind.Match) any{
+	"path":          func(m dupfind.Match) any { return m.Path },
+	"index_path":    func(m dupfind.Match) any { return m.IndexPath },
+	"index_paths":   func(m dupfind.Match) any { return m.IndexPaths },
+	"index_size":    func(m dupfind.Match) any { return m.IndexSize },
+	"index_mtime":   func(m dupfind.Match) any { return m.IndexModTime },
+	"source":        func(m dupfind.Match) any { return m.Source },
+	"checksum":      func(m dupfind.Match) any { return m.Checksum },
+	"size":          func(m dupfind.Match) any { return m.Size },
+	"mtime":         func(m dupfind.Match) any { return m.ModTime },
+	"mode":          func(m dupfind.Match) any { return m.Mode },
+	"removed":       func(m dupfind.Match) any { return m.Removed },
+	"similar":       func(m dupfind.Match) any { return m.Similar },
+	"distance":      func(m dupfind.Match) any { return m.Distance },
+	"shared":        func(m dupfind.Match) any { return m.Shared },
+	"self":          func(m dupfind.Match) any { return m.Self },
+	"missing":       func(m dupfind.Match) any { return m.Missing },
+	"dir":           func(m dupfind.Match) any { return m.Dir },
+	"files":         func(m dupfind.Match) any { return m.Files },
+	"xattrs_differ": func(m dupfind.Match) any { return m.XattrsDiffer },
+}
+
+// recordFields are the parts of an index record that --fields can select.
+var recordFields = map[string]func(r dupfind.Metadata) any{
+	"path":     func(r dupfind.Metadata) any { return r.Path },
+	"checksum": func(r dupfind.Metadata) any { return dupfind.ChecksumKey(r.Algorithm, r.Checksum) },
+	"size":     func(r dupfind.Metadata) any { return r.Size },
+	"mtime":    func(r dupfind.Metadata) any { return r.ModTime },
+	"mode":     func(r dupfind.Metadata) any { return r.Mode },
+	"root":     func(r dupfind.Metadata) any { return r.Root },
+	"xattrs":   func(r dupfind.Metadata) any { return r.Xattrs },
+	"unstable": func(r dupfind.Metadata) any { return r.Unstable },
+	"uid": func(r dupfind.Metadata) any {
+		if !r.Owned {
+			return ""
+		}
+		return r.UID
+	},
+	"gid": func(r dupfind.Metadata) any {
+		if !r.Owned {
+			return ""
+		}
+		return r.GID
+	},
+	"allocated": func(r dupfind.Metadata) any {
+		if !r.Sparse {
+			return r.Size
+		}
+		return r.Allocated
+	},
+}
+
+// checkFields fails if any of fields is not a key of known.
+func checkFields[T any](fields []string, known map[string]T) error {
+
+	for _, field := range fields {
+		if _, ok := known[field]; !ok {
+			var names []string
+			for name := range known {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown field %q (available: %s)", field, strings.Join(names, ", "))
+		}
+	}
+
+	return nil
+}
+
+// formatField renders a field value for text and CSV output.
+func formatField(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, string(os.PathListSeparator))
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Local().Format(time.RFC3339)
+	case os.FileMode:
+		if v == 0 {
+			return ""
+		}
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// fieldsMatchWriter writes only the selected fields of each match: as
+// tab-separated text, as CSV columns, or as the keys of JSON objects.
+type fieldsMatchWriter struct {
+	format  string
+	fields  []string
+	w       io.Writer
+	csv     *csv.Writer
+	started bool
+	objects []map[string]any
+}
+
+func (f *fieldsMatchWriter) Write(m dupfind.Match) error {
+
+	values := make([]any, len(f.fields))
+	for i, field := range f.fields {
+		values[i] = matchFields[field](m)
+	}
+
+	switch f.format {
+	case "json", "ndjson":
+		object := make(map[string]any, len(values))
+		for i, field := range f.fields {
+			object[field] = values[i]
+		}
+		if f.format == "json" {
+			f.objects = append(f.objects, object)
+			return nil
+		}
+		return json.NewEncoder(f.w).Encode(object)
+	case "csv":
+		if !f.started {
+			f.started = true
+			f.csv.Write(f.fields)
+		}
+		f.csv.Write(formatFields(values))
+		f.csv.Flush()
+		return f.csv.Error()
+	default:
+		_, err := fmt.Fprintln(f.w, strings.Join(formatFields(values), "\t"))
+		return err
+	}
+}
+
+func (f *fieldsMatchWriter) Close() error {
+	switch f.format {
+	case "json":
+		if f.objects == nil {
+			f.objects = []map[string]any{}
+		}
+		enc := json.NewEncoder(f.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(f.objects)
+	case "csv":
+		f.csv.Flush()
+		return f.csv.Error()
+	}
+	return nil
+}
+
+func formatFields(values []any) []string {
+	formatted := make([]string, len(values))
+	for i, value := range values {
+		formatted[i] = formatField(value)
+	}
+	return formatted
+}
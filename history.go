@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// historyFile returns the name of the log of the snapshots of index, kept
+// next to it.
+func historyFile(index string) string {
+	return index + ".history"
+}
+
+// historyEvent is a line of the history of an index: a snapshot, taken
+// whenever the index was written, followed by the files it added,
+// changed and removed since the one before. Snapshots count the files
+// the index held and its changes.
+type historyEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Path     string    `json:"path,omitempty"`
+	Checksum string    `json:"checksum,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Files    int       `json:"files,omitempty"`
+	Added    int       `json:"added,omitempty"`
+	Changed  int       `json:"changed,omitempty"`
+	Removed  int       `json:"removed,omitempty"`
+}
+
+// readHistory reads the history of index, oldest first. Indexes without
+// a history have none.
+func readHistory(index string) ([]historyEvent, error) {
+
+	f, err := os.Open(historyFile(index))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []historyEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event historyEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("%s: invalid line %q", historyFile(index), scanner.Text())
+		}
+		events = append(events, event)
+	}
+
+	return events, scanner.Err()
+}
+
+// replayHistory returns the files the index held after the snapshots
+// taken up to until, by path key, as the events that added them.
+func replayHistory(events []historyEvent, until time.Time) map[string]historyEvent {
+
+	files := make(map[string]historyEvent)
+	for _, event := range events {
+		if event.Time.After(until) {
+			break
+		}
+		switch event.Event {
+		case "added", "changed":
+			files[dupfind.PathKey(event.Path)] = event
+		case "removed":
+			delete(files, dupfind.PathKey(event.Path))
+		}
+	}
+
+	return files
+}
+
+// keepsHistory reports whether the history of index is kept.
+func keepsHistory(index string) bool {
+	_, err := os.Stat(historyFile(index))
+	return err == nil
+}
+
+// startHistory starts keeping the history of index, unless it is kept
+// already. An existing index is recorded as the first snapshot, taken
+// when it was last written.
+func startHistory(index string) error {
+
+	if keepsHistory(index) {
+		return nil
+	}
+	info, err := os.Stat(index)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.WriteFile(historyFile(index), nil, 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	return appendHistory(index, info.ModTime())
+}
+
+// appendHistory records a snapshot of index taken at the given time, with
+// the files that changed since the last one. Partial indexes are not
+// recorded, they would show the files not hashed yet as removed.
+func appendHistory(index string, at time.Time) error {
+
+	header, records, err := dupfind.ReadIndex(index)
+	if err != nil {
+		return err
+	}
+	if header.Partial {
+		dupfind.Log.With("index", index).Warnf("Not recording partial index %s in its history", index)
+		return nil
+	}
+	records = dupfind.RootRecords(header, records, "")
+	events, err := readHistory(index)
+	if err != nil {
+		return err
+	}
+	at = at.UTC()
+	before := replayHistory(events, at)
+
+	snapshot := historyEvent{Time: at, Event: "snapshot", Files: len(records)}
+	var changes []historyEvent
+	seen := make(map[string]bool, len(records))
+	for _, record := range records {
+		key := dupfind.PathKey(record.Path)
+		seen[key] = true
+		change := historyEvent{
+			Time:     at,
+			Path:     record.Path,
+			Checksum: dupfind.ChecksumKey(record.Algorithm, record.Checksum),
+			Size:     record.Size,
+		}
+		old, ok := before[key]
+		switch {
+		case !ok:
+			change.Event = "added"
+			snapshot.Added++
+		case old.Checksum != change.Checksum || old.Size != change.Size:
+			change.Event = "changed"
+			snapshot.Changed++
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+	for key, old := range before {
+		if !seen[key] {
+			changes = append(changes, historyEvent{Time: at, Event: "removed", Path: old.Path, Checksum: old.Checksum, Size: old.Size})
+			snapshot.Removed++
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+
+	var b strings.Builder
+	for _, event := range append([]historyEvent{snapshot}, changes...) {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		b.Write(data)
+		b.WriteByte('\n')
+	}
+	f, err := os.OpenFile(historyFile(index), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+type HistoryCmd struct {
+	Index        string `arg:"" optional:"" help:"Index file whose history to show (default: the index set in the config file)." type:"path"`
+	File         string `help:"Show when the file at PATH, or the files below it, were added, changed and removed." placeholder:"PATH" type:"path"`
+	Checksum     string `help:"Show when content with this checksum appeared and disappeared, and at which paths. Checksums of algorithms other than SHA-256 are given as ALGORITHM:CHECKSUM." placeholder:"CHECKSUM"`
+	At           string `help:"List the files the index held at TIME, given as YYYY-MM-DD, YYYY-MM-DD HH:MM or in RFC 3339 format." placeholder:"TIME"`
+	OutputFormat string `help:"Output format (${enum})." enum:"text,json" default:"text"`
+}
+
+// historyTimeFormats are the formats history --at accepts, in local time
+// unless they name a zone.
+var historyTimeFormats = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func parseHistoryTime(s string) (time.Time, error) {
+	for _, format := range historyTimeFormats {
+		if t, err := time.ParseInLocation(format, s, time.Local); err == nil {
+			if format == "2006-01-02" {
+				// a day includes its snapshots
+				t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected YYYY-MM-DD, YYYY-MM-DD HH:MM or RFC 3339", s)
+}
+
+func (h *HistoryCmd) Run(ctx *Context) error {
+
+	var err error
+	if h.Index, err = ctx.indexFile(h.Index); err != nil {
+		return err
+	}
+	if h.At != "" && (h.File != "" || h.Checksum != "") {
+		return errors.New("--at cannot be combined with --file or --checksum")
+	}
+	if !keepsHistory(h.Index) {
+		return fmt.Errorf("%s has no history, build or update it with --history to start one", h.Index)
+	}
+	events, err := readHistory(h.Index)
+	if err != nil {
+		return err
+	}
+
+	if h.At != "" {
+		at, err := parseHistoryTime(h.At)
+		if err != nil {
+			return err
+		}
+		return h.printFiles(replayHistory(events, at))
+	}
+	if h.File == "" && h.Checksum == "" {
+		var snapshots []historyEvent
+		for _, event := range events {
+			if event.Event == "snapshot" {
+				snapshots = append(snapshots, event)
+			}
+		}
+		return h.printEvents(snapshots)
+	}
+
+	checksum := strings.ToLower(h.Checksum)
+	if algorithm, sum, ok := strings.Cut(checksum, ":"); ok && algorithm == dupfind.DefaultAlgorithm {
+		checksum = sum
+	}
+	var matched []historyEvent
+	for _, event := range events {
+		if event.Event == "snapshot" {
+			continue
+		}
+		if _, ok := dupfind.CutPathPrefix(event.Path, h.File); h.File != "" && !ok {
+			continue
+		}
+		if checksum != "" && event.Checksum != checksum {
+			continue
+		}
+		matched = append(matched, event)
+	}
+	return h.printEvents(matched)
+}
+
+// printEvents writes snapshots, or the changes to files, one per line.
+func (h *HistoryCmd) printEvents(events []historyEvent) error {
+
+	if h.OutputFormat == "json" {
+		if events == nil {
+			events = []historyEvent{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(events)
+	}
+	for _, event := range events {
+		when := event.Time.Local().Format("2006-01-02 15:04:05")
+		if event.Event == "snapshot" {
+			fmt.Printf("%s  %d files, %d added, %d changed, %d removed\n", when, event.Files, event.Added, event.Changed, event.Removed)
+			continue
+		}
+		fmt.Printf("%s  %-8s %s  %s (%s)\n", when, strings.ToUpper(event.Event), event.Path, event.Checksum, formatBytes(event.Size))
+	}
+	if len(events) == 0 {
+		fmt.Println("No changes recorded.")
+	}
+
+	return nil
+}
+
+// printFiles writes the files held at some time, sorted by path, as
+// their checksum and path.
+func (h *HistoryCmd) printFiles(files map[string]historyEvent) error {
+
+	held := make([]historyEvent, 0, len(files))
+	for _, file := range files {
+		held = append(held, file)
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i].Path < held[j].Path })
+
+	if h.OutputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(held)
+	}
+	for _, file := range held {
+		fmt.Printf("%s  %s\n", file.Checksum, file.Path)
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"path/filepath"
+	"strings"
+)
+
+// keepCandidate is a copy of a file that may be kept while the other
+// copies are removed or linked to it.
+type keepCandidate struct {
+	dupfind.Metadata
+	// indexed is set for copies in the index, as opposed to the files
+	// being deduplicated
+	indexed bool
+}
+
+// keepRule compares two copies. It returns a negative number if a should
+// rather be kept than b, a positive one if b should, and 0 if the rule
+// does not decide.
+type keepRule func(a, b keepCandidate) int
+
+// parseKeepRules parses --keep rules: oldest, newest, shortest, indexed
+// and prefer:DIR.
+func parseKeepRules(specs []string) ([]keepRule, error) {
+
+	var rules []keepRule
+	for _, spec := range specs {
+		switch spec {
+		case "oldest":
+			rules = append(rules, func(a, b keepCandidate) int { return a.ModTime.Compare(b.ModTime) })
+		case "newest":
+			rules = append(rules, func(a, b keepCandidate) int { return b.ModTime.Compare(a.ModTime) })
+		case "shortest":
+			rules = append(rules, func(a, b keepCandidate) int { return len(a.Path) - len(b.Path) })
+		case "indexed":
+			rules = append(rules, func(a, b keepCandidate) int { return boolRank(a.indexed) - boolRank(b.indexed) })
+		default:
+			dir, ok := strings.CutPrefix(spec, "prefer:")
+			if !ok || dir == "" {
+				return nil, fmt.Errorf("invalid --keep rule %q, expected oldest, newest, shortest, indexed or prefer:DIR", spec)
+			}
+			if abs, err := filepath.Abs(dir); err == nil {
+				dir = abs
+			}
+			rules = append(rules, func(a, b keepCandidate) int {
+				_, ina := dupfind.CutPathPrefix(a.Path, dir)
+				_, inb := dupfind.CutPathPrefix(b.Path, dir)
+				return boolRank(ina) - boolRank(inb)
+			})
+		}
+	}
+
+	return rules, nil
+}
+
+// boolRank orders true before false.
+func boolRank(b bool) int {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+// chooseKeeper returns the index of the copy to keep. Later rules break
+// ties of earlier ones, and the first of equal copies is kept.
+func chooseKeeper(candidates []keepCandidate, rules []keepRule) int {
+
+	keep := 0
+	for i := 1; i < len(candidates); i++ {
+		for _, rule := range rules {
+			if c := rule(candidates[i], candidates[keep]); c != 0 {
+				if c < 0 {
+					keep = i
+				}
+				break
+			}
+		}
+	}
+
+	return keep
+}
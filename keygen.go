@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+)
+
+type KeygenCmd struct {
+	Key string `arg:"" help:"File to write the private key to. The public key is written to FILE.pub." type:"path"`
+}
+
+func (k *KeygenCmd) Run(ctx *Context) error {
+
+	if err := dupfind.GenerateSigningKey(k.Key); err != nil {
+		return err
+	}
+	fmt.Printf("Private key written to %s, public key to %s.pub.\n", k.Key, k.Key)
+	fmt.Printf("Keep the private key secret, and the public key where the index cannot be changed along with it.\n")
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"strings"
+)
+
+type IndexLookupCmd struct {
+	Checksum  string `arg:"" help:"Checksum to look up, or - to read checksums from stdin, one per line or as printed by sha256sum and similar tools."`
+	Index     string `arg:"" optional:"" help:"Index file (default: the index set in the config file)." type:"path"`
+	Algorithm string `help:"Algorithm the checksums were computed with (${enum}). Defaults to the algorithm of the index." enum:",sha256,sha1,blake3,xxhash64" default:""`
+}
+
+func (l *IndexLookupCmd) Run(ctx *Context) error {
+
+	var err error
+	if l.Index, err = ctx.indexFile(l.Index); err != nil {
+		return err
+	}
+	index, err := dupfind.LoadIndex(l.Index)
+	if err != nil {
+		return err
+	}
+	index = dupfind.RootIndex(index, "")
+	warnPartial(l.Index, index.Header())
+	algorithm := l.Algorithm
+	if algorithm == "" {
+		algorithm = index.Header().Algorithm
+	}
+
+	if l.Checksum != "-" {
+		records := index.Lookup(dupfind.ChecksumKey(algorithm, strings.ToLower(l.Checksum)))
+		for _, record := range records {
+			fmt.Println(record.Path)
+		}
+		if len(records) == 0 {
+			return fmt.Errorf("checksum %s is not in the index", l.Checksum)
+		}
+		return nil
+	}
+
+	// lines of sha256sum output name the file after the checksum
+	var found int
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		checksum, name, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if checksum == "" {
+			continue
+		}
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		if name == "" {
+			name = checksum
+		}
+		records := index.Lookup(dupfind.ChecksumKey(algorithm, strings.ToLower(checksum)))
+		for _, record := range records {
+			fmt.Printf("%s\t%s\n", name, record.Path)
+		}
+		if len(records) > 0 {
+			found++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading checksums: %w", err)
+	}
+	if found == 0 {
+		return fmt.Errorf("none of the checksums are in the index")
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"github.com/alecthomas/kong"
+	"io"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"strings"
+)
+
+type ManCmd struct{}
+
+// Run prints a manual page in roff, generated from the same command and
+// flag definitions as --help.
+func (m *ManCmd) Run(k *kong.Context) error {
+	return writeManPage(os.Stdout, k.Model)
+}
+
+// roff escapes s for use as text in a manual page.
+func roff(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+// manFlag writes the entry of flag in an option list.
+func manFlag(b *strings.Builder, flag *kong.Flag) {
+
+	b.WriteString(".TP\n")
+	var names []string
+	if flag.Short != 0 {
+		names = append(names, fmt.Sprintf(`\fB\-%c\fR`, flag.Short))
+	}
+	long := `\fB\-\-` + roff(flag.Name) + `\fR`
+	if flag.Tag.Negatable {
+		long = `\fB\-\-\fR[\fBno\-\fR]\fB` + roff(flag.Name) + `\fR`
+	}
+	if !flag.IsBool() && !flag.IsCounter() {
+		long += `=\fI` + roff(flag.FormatPlaceHolder()) + `\fR`
+	}
+	names = append(names, long)
+	b.WriteString(strings.Join(names, ", ") + "\n")
+
+	help := flag.Help
+	if flag.HasDefault && flag.Default != "" && !flag.IsBool() && flag.PlaceHolder != "" {
+		help += fmt.Sprintf(" (default: %s)", flag.Default)
+	}
+	b.WriteString(roff(help) + "\n")
+}
+
+func writeManPage(w io.Writer, app *kong.Application) error {
+
+	name := app.Name
+	var b strings.Builder
+	fmt.Fprintf(&b, ".\\\" generated by %s man\n", name)
+	fmt.Fprintf(&b, ".TH %s 1 \"\" \"%s %s\" \"User Commands\"\n", strings.ToUpper(name), name, roff(dupfind.Version))
+
+	b.WriteString(".SH NAME\n")
+	fmt.Fprintf(&b, "%s \\- find duplicate files using indexes of their checksums\n", name)
+
+	b.WriteString(".SH SYNOPSIS\n")
+	fmt.Fprintf(&b, ".B %s\n", name)
+	b.WriteString("[\\fIGLOBAL OPTIONS\\fR] \\fICOMMAND\\fR [\\fIOPTIONS\\fR] [\\fIARGUMENTS\\fR]\n")
+
+	b.WriteString(".SH DESCRIPTION\n")
+	fmt.Fprintf(&b, "\\fB%s\\fR records the checksums of a directory tree in an index file, ", name)
+	b.WriteString("and then looks up other files in the index to find those whose content is already there, ")
+	b.WriteString("without reading the indexed files again.\n")
+	b.WriteString("Global options are given before or after the command.\n")
+
+	b.WriteString(".SH GLOBAL OPTIONS\n")
+	for _, flag := range ownFlags(app.Node) {
+		manFlag(&b, flag)
+	}
+
+	b.WriteString(".SH COMMANDS\n")
+	for _, command := range visibleCommands(app) {
+		if len(subcommands(command)) > 0 {
+			continue
+		}
+		fmt.Fprintf(&b, ".SS %s\n", roff(commandPath(command)))
+		fmt.Fprintf(&b, ".B %s %s\n", name, roff(commandPath(command)))
+		var args []string
+		for _, arg := range command.Positional {
+			args = append(args, arg.Summary())
+		}
+		if flags := visibleFlags(command); len(flags) > 0 {
+			b.WriteString("[\\fIOPTIONS\\fR]")
+			if len(args) > 0 {
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString(roff(strings.Join(args, " ")) + "\n")
+		b.WriteString(".PP\n")
+		b.WriteString(roff(command.Help) + ".\n")
+		if command.Detail != "" {
+			b.WriteString(".PP\n" + roff(command.Detail) + "\n")
+		}
+		for _, arg := range command.Positional {
+			b.WriteString(".TP\n")
+			fmt.Fprintf(&b, "\\fI%s\\fR\n", roff(arg.Name))
+			b.WriteString(roff(arg.Help) + "\n")
+		}
+		for _, flag := range visibleFlags(command) {
+			manFlag(&b, flag)
+		}
+	}
+
+	b.WriteString(".SH ENVIRONMENT\n")
+	b.WriteString(".TP\n.B DUPFIND_PASSPHRASE\nPassphrase of encrypted indexes, unless \\fB\\-\\-passphrase\\-file\\fR is given.\n")
+	b.WriteString(".TP\n.B DUPFIND_SMTP_PASSWORD\nPassword for the SMTP server that e\\-mail notifications are sent through.\n")
+
+	b.WriteString(".SH FILES\n")
+	b.WriteString(".TP\n.I ~/.config/dupfind/config.toml\n")
+	b.WriteString("Default settings, with any flag given by its name, as in \\fIindex = \"/data/photos.json\"\\fR. ")
+	b.WriteString("On macOS and Windows, it is kept in the usual directory for settings instead.\n")
+	b.WriteString(".TP\n.I INDEX.sig\nSignature of an index signed with \\fB\\-\\-sign\\-key\\fR.\n")
+	b.WriteString(".TP\n.I INDEX.bloom\nBloom filter of an index, written with \\fB\\-\\-bloom\\fR.\n")
+	b.WriteString(".TP\n.I INDEX.verified\nWhen each indexed file was last verified, for \\fBverify \\-\\-sample\\fR.\n")
+	b.WriteString(".TP\n.I INDEX.errors\nFiles that could not be read by the last build or update.\n")
+	b.WriteString(".TP\n.I INDEX.history\nSnapshots of an index built with \\fB\\-\\-history\\fR, for \\fBhistory\\fR.\n")
+	b.WriteString(".TP\n.I INDEX.undo\nThe files replaced by dedupe, apply and review, for \\fBundo\\fR.\n")
+	b.WriteString(".TP\n.I INDEX.checkpoint\nProgress of an interrupted build, for \\fBbuild \\-\\-resume\\fR.\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
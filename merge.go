@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"sort"
+	"strings"
+)
+
+type MergeCmd struct {
+	Indexes  []string `arg:"" name:"index" help:"Index files to merge." type:"path"`
+	Output   string   `short:"o" help:"Merged index file." type:"path" required:""`
+	Source   bool     `help:"Record which index each entry came from"`
+	Force    bool     `short:"f" help:"Overwrite an existing output file"`
+	Compress string   `help:"Compress the output with gzip or zstd. Files ending in .gz or .zst are compressed anyway." enum:",gzip,zstd" default:""`
+	Encrypt  bool     `help:"Encrypt the output with the passphrase given with --passphrase-file or DUPFIND_PASSPHRASE."`
+
+	SignOptions `embed:""`
+}
+
+func (m *MergeCmd) Run(ctx *Context) error {
+
+	if err := checkOverwrite(m.Output, m.Force); err != nil {
+		return err
+	}
+	key, err := m.signingKey()
+	if err != nil {
+		return err
+	}
+	store, err := openIndexStore(m.Output, m.Compress, m.Encrypt)
+	if err != nil {
+		return err
+	}
+
+	var merged []dupfind.Metadata
+	var origins []string
+	byPath := make(map[string]int)
+	byKey := make(map[string]dupfind.Metadata)
+	algorithms := make(map[string]bool)
+	xattrs := make(map[string]bool)
+	// the --hash-for rules of the indexes, by the rules joined
+	hashFor := make(map[string][]string)
+	var replaced, conflicts, collisions int
+	partial := false
+
+	for _, name := range m.Indexes {
+		header, records, err := dupfind.ReadIndex(name)
+		if err != nil {
+			return err
+		}
+		if header.Algorithm != "" {
+			algorithms[header.Algorithm] = true
+		}
+		partial = partial || header.Partial
+		if problems := dupfind.CheckRecords(records); len(problems) > 0 {
+			dupfind.Log.With("index", name, "problems", len(problems)).Warnf("Warning: index %s has %d inconsistent records, run dupfind check-index to list them", name, len(problems))
+		}
+		xattrs[header.Xattrs] = true
+		hashFor[strings.Join(header.HashFor, "\n")] = header.HashFor
+		// merged indexes hold absolute paths
+		records = dupfind.RootRecords(header, records, "")
+
+		for _, record := range records {
+			if m.Source {
+				record.Source = name
+			}
+
+			// report content that is present in more than one index
+			key := dupfind.ChecksumKey(record.Algorithm, record.Checksum)
+			if other, ok := byKey[key]; ok && other.Source != name && !dupfind.IsSpecial(record.Mode) {
+				collisions++
+				fmt.Printf("%s (%s) has the same content as %s (%s)\n",
+					record.Path, name, other.Path, other.Source)
+			} else if !ok {
+				other = record
+				other.Source = name
+				byKey[key] = other
+			}
+
+			// later indexes take precedence for the same path
+			if i, ok := byPath[dupfind.PathKey(record.Path)]; ok {
+				if old := merged[i]; !dupfind.IsSpecial(record.Mode) && (old.Size != record.Size ||
+					dupfind.ChecksumKey(old.Algorithm, old.Checksum) != key) {
+					conflicts++
+					fmt.Printf("%s has different content in %s and %s, keeping the latter\n", record.Path, origins[i], name)
+				}
+				merged[i], origins[i] = record, name
+				replaced++
+				continue
+			}
+			byPath[dupfind.PathKey(record.Path)] = len(merged)
+			merged, origins = append(merged, record), append(origins, name)
+		}
+	}
+
+	header := dupfind.NewIndexHeader("", "")
+	header.Partial = partial
+	if len(algorithms) == 1 {
+		for algorithm := range algorithms {
+			header.Algorithm = algorithm
+		}
+	}
+	if len(hashFor) == 1 {
+		for _, rules := range hashFor {
+			header.HashFor = rules
+		}
+	}
+	if len(xattrs) == 1 {
+		for mode := range xattrs {
+			header.Xattrs = mode
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Path < merged[j].Path })
+
+	if err := store.Write(header, merged); err != nil {
+		return fmt.Errorf("writing index %s: %w", m.Output, err)
+	}
+	if err := finishIndex(m.Output, key); err != nil {
+		return err
+	}
+
+	fmt.Printf("Merged %d entries from %d indexes into %s (%d paths replaced, %d of them with different content, %d entries with content also in another index).\n",
+		len(merged), len(m.Indexes), m.Output, replaced, conflicts, collisions)
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+// metrics counts the work of a long-running command, which it exposes on
+// /metrics in the Prometheus text format. Gauges that a command does not
+// track are negative and left out.
+type metrics struct {
+	filesProcessed atomic.Int64
+	bytesHashed    atomic.Int64
+	fileErrors     atomic.Int64
+	indexWrites    atomic.Int64
+	indexRecords   atomic.Int64
+	pending        atomic.Int64
+
+	mu       sync.Mutex
+	requests map[string]*histogram
+}
+
+// histogram counts request latencies in latencyBuckets.
+type histogram struct {
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+func newMetrics() *metrics {
+	m := &metrics{requests: make(map[string]*histogram)}
+	m.indexRecords.Store(-1)
+	m.pending.Store(-1)
+	return m
+}
+
+// addStats adds the files processed during a run to the counters.
+func (m *metrics) addStats(stats *dupfind.ScanStats) {
+	m.filesProcessed.Add(stats.Files.Load())
+	m.bytesHashed.Add(stats.Hashed.Load())
+	m.fileErrors.Add(stats.Failed.Load())
+}
+
+// timed wraps handler to record the latency of its requests under
+// endpoint.
+func (m *metrics) timed(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler(w, r)
+		seconds := time.Since(start).Seconds()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		h := m.requests[endpoint]
+		if h == nil {
+			h = &histogram{buckets: make([]int64, len(latencyBuckets))}
+			m.requests[endpoint] = h
+		}
+		for i, bound := range latencyBuckets {
+			if seconds <= bound {
+				h.buckets[i]++
+			}
+		}
+		h.count++
+		h.sum += seconds
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"dupfind_files_processed_total", "counter", "Files hashed or looked up.", m.filesProcessed.Load()},
+		{"dupfind_bytes_hashed_total", "counter", "Bytes read to compute checksums.", m.bytesHashed.Load()},
+		{"dupfind_file_errors_total", "counter", "Files that could not be processed.", m.fileErrors.Load()},
+		{"dupfind_index_writes_total", "counter", "Times the index was written.", m.indexWrites.Load()},
+		{"dupfind_index_records", "gauge", "Records in the index.", m.indexRecords.Load()},
+		{"dupfind_pending_changes", "gauge", "Changed files waiting to be indexed.", m.pending.Load()},
+	} {
+		if metric.value < 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.requests) == 0 {
+		return
+	}
+	var endpoints []string
+	for endpoint := range m.requests {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	const name = "dupfind_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken to answer requests.\n# TYPE %s histogram\n", name, name)
+	for _, endpoint := range endpoints {
+		h := m.requests[endpoint]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{endpoint=%q,le=\"%g\"} %d\n", name, endpoint, bound, h.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{endpoint=%q,le=\"+Inf\"} %d\n", name, endpoint, h.count)
+		fmt.Fprintf(w, "%s_sum{endpoint=%q} %g\n", name, endpoint, h.sum)
+		fmt.Fprintf(w, "%s_count{endpoint=%q} %d\n", name, endpoint, h.count)
+	}
+}
+
+// serveMetrics serves m on /metrics at address, host:port or unix:PATH,
+// until ctx is canceled.
+func serveMetrics(ctx context.Context, address string, m *metrics) error {
+
+	network, address := splitAddress(address)
+	if network == "unix" {
+		os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	go server.Serve(listener)
+
+	return nil
+}
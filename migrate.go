@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"time"
+)
+
+type MigrateCmd struct {
+	Index  string `arg:"" optional:"" help:"Index file to upgrade (default: the index set in the config file)." type:"path"`
+	DryRun bool   `short:"n" help:"Only print what would be changed"`
+	Root   string `help:"Look for the indexed files below DIR instead of the directory the index was built from." placeholder:"DIR" type:"path"`
+
+	SignOptions `embed:""`
+}
+
+// migrateStats counts the fields a migration filled in.
+type migrateStats struct {
+	sizes, times, modes, ids, owners, missing, changed int
+}
+
+func (m *MigrateCmd) Run(ctx *Context) error {
+
+	var err error
+	if m.Index, err = ctx.indexFile(m.Index); err != nil {
+		return err
+	}
+	key, err := m.signingKey()
+	if err != nil {
+		return err
+	}
+	header, records, err := dupfind.ReadIndex(m.Index)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(m.Index)
+	if err != nil {
+		return err
+	}
+
+	// files modified after the index was written may no longer have the
+	// indexed content, so their size and time are left for update to fill
+	// in when it re-hashes them
+	written := header.Created
+	if written.IsZero() {
+		written = info.ModTime()
+	}
+	var counts migrateStats
+	algorithms := make(map[string]bool)
+	for i := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		algorithms[dupfind.RecordAlgorithm(records[i])] = true
+		m.backfill(header, &records[i], written, &counts)
+	}
+
+	version := header.Version
+	header.Version = dupfind.IndexVersion
+	if header.Created.IsZero() {
+		header.Created = written.UTC()
+	}
+	if header.Algorithm == "" && len(algorithms) == 1 {
+		for algorithm := range algorithms {
+			header.Algorithm = algorithm
+		}
+	}
+	verb := "Migrated"
+	if m.DryRun {
+		verb = "Would migrate"
+	} else {
+		if err := dupfind.OpenStore(m.Index).Write(header, records); err != nil {
+			return fmt.Errorf("writing index %s: %w", m.Index, err)
+		}
+		if err := finishIndex(m.Index, key); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s %s from version %d to %d: filled in %d sizes, %d modification times, %d modes, %d file IDs and %d owners.\n",
+		verb, m.Index, version, header.Version, counts.sizes, counts.times, counts.modes, counts.ids, counts.owners)
+	if counts.missing > 0 || counts.changed > 0 {
+		fmt.Printf("%d files no longer exist and %d changed since they were indexed; run update to re-hash them.\n", counts.missing, counts.changed)
+	}
+
+	return nil
+}
+
+// backfill fills in the metadata that record lacks from the file it
+// describes, if it is still there.
+func (m *MigrateCmd) backfill(header dupfind.IndexHeader, record *dupfind.Metadata, written time.Time, counts *migrateStats) {
+
+	if record.Size > 0 && !record.ModTime.IsZero() && record.Mode != 0 && record.Inode != 0 && record.Owned {
+		return
+	}
+	path := dupfind.RootPath(header, m.Root, record.Path)
+	if _, ok := dupfind.Container(path); ok {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		counts.missing++
+		return
+	}
+	if record.Mode == 0 {
+		record.Mode = info.Mode()
+		counts.modes++
+	}
+	current := dupfind.FileMetadata(path, info)
+	if record.Inode == 0 && current.Inode != 0 {
+		record.Device, record.Inode = current.Device, current.Inode
+		counts.ids++
+	}
+	if !record.Owned && current.Owned {
+		record.Owned, record.UID, record.GID = true, current.UID, current.GID
+		counts.owners++
+	}
+	if info.ModTime().After(written) {
+		counts.changed++
+		return
+	}
+	if record.Size == 0 && info.Size() > 0 {
+		record.Size = info.Size()
+		counts.sizes++
+	}
+	if record.ModTime.IsZero() {
+		record.ModTime = info.ModTime()
+		counts.times++
+	}
+}
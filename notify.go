@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"jvkersch/dupfind/dupfind"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// NotifyOptions are the command line flags sending a summary of a run that
+// needs attention, for runs started by cron.
+type NotifyOptions struct {
+	NotifyWebhook string   `help:"POST a JSON summary to URL when the run finds something or fails. Its text field suits Slack and Matrix incoming webhooks." placeholder:"URL"`
+	NotifyEmail   []string `help:"Mail the summary to ADDRESS when the run finds something or fails, through the server given with --smtp-server." placeholder:"ADDRESS"`
+	NotifyAlways  bool     `help:"Send the summary after every run, not only when it finds something or fails."`
+	SMTPServer    string   `name:"smtp-server" help:"SMTP server to send mail through. The password for --smtp-user is read from DUPFIND_SMTP_PASSWORD." placeholder:"HOST:PORT"`
+	SMTPUser      string   `name:"smtp-user" help:"User to log in to the SMTP server as." placeholder:"USER"`
+	SMTPFrom      string   `name:"smtp-from" help:"Sender of notification mails (default: dupfind@HOSTNAME)." placeholder:"ADDRESS"`
+}
+
+// runSummary is the outcome of a run, as sent by notifications.
+type runSummary struct {
+	Command string           `json:"command"`
+	Host    string           `json:"host"`
+	Index   string           `json:"index,omitempty"`
+	Summary string           `json:"summary"`
+	Counts  map[string]int64 `json:"counts,omitempty"`
+	Error   string           `json:"error,omitempty"`
+	Text    string           `json:"text"`
+}
+
+// checkNotify fails if mail is to be sent but cannot be, before the run
+// rather than after it.
+func (o *NotifyOptions) checkNotify() error {
+	if len(o.NotifyEmail) > 0 && o.SMTPServer == "" {
+		return errors.New("--notify-email needs --smtp-server")
+	}
+	return nil
+}
+
+// notify sends summary if the run needs attention, because it found
+// something or failed with err, or if --notify-always is given. Failing to
+// send is logged but does not fail the run.
+func (o *NotifyOptions) notify(summary runSummary, attention bool, err error) {
+
+	if o.NotifyWebhook == "" && len(o.NotifyEmail) == 0 || !attention && err == nil && !o.NotifyAlways {
+		return
+	}
+	summary.Host, _ = os.Hostname()
+	summary.Text = fmt.Sprintf("dupfind %s on %s: %s", summary.Command, summary.Host, summary.Summary)
+	if err != nil {
+		summary.Error = err.Error()
+		summary.Text += "\nError: " + summary.Error
+	}
+	if summary.Summary == "" {
+		summary.Text = fmt.Sprintf("dupfind %s on %s failed: %s", summary.Command, summary.Host, summary.Error)
+	}
+
+	if o.NotifyWebhook != "" {
+		if err := postWebhook(o.NotifyWebhook, summary); err != nil {
+			dupfind.Log.With("error", err).Warnf("Could not notify %s: %v", o.NotifyWebhook, err)
+		}
+	}
+	if len(o.NotifyEmail) > 0 {
+		if err := o.sendMail(summary); err != nil {
+			dupfind.Log.With("error", err).Warnf("Could not mail %s: %v", strings.Join(o.NotifyEmail, ", "), err)
+		}
+	}
+}
+
+func postWebhook(url string, summary runSummary) error {
+
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// sendMail mails the summary. Servers offering STARTTLS are only talked
+// to encrypted, and passwords are only sent encrypted or to localhost.
+func (o *NotifyOptions) sendMail(summary runSummary) error {
+
+	from := o.SMTPFrom
+	if from == "" {
+		from = "dupfind@" + summary.Host
+	}
+	subject := fmt.Sprintf("dupfind %s on %s", summary.Command, summary.Host)
+	if summary.Error != "" {
+		subject += " failed"
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", from, strings.Join(o.NotifyEmail, ", "), subject, time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(summary.Text, "\n", "\r\n") + "\r\n")
+
+	var auth smtp.Auth
+	if o.SMTPUser != "" {
+		host, _, err := net.SplitHostPort(o.SMTPServer)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", o.SMTPUser, os.Getenv("DUPFIND_SMTP_PASSWORD"), host)
+	}
+	return smtp.SendMail(o.SMTPServer, auth, from, o.NotifyEmail, msg.Bytes())
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"github.com/alecthomas/kong"
+	"jvkersch/dupfind/dupfind"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HashOptions are the command line flags selecting hash algorithms.
+type HashOptions struct {
+	Hash          string   `help:"Hash algorithm: sha256, sha1, blake3 or xxhash64. Commands looking up files in an index default to the algorithm of the index, others to sha256." enum:",sha256,sha1,blake3,xxhash64" default:""`
+	HashFor       []string `help:"Use ALGORITHM for files whose name matches PATTERN. The first matching rule wins." placeholder:"PATTERN=ALGORITHM" sep:"none"`
+	Cache         bool     `help:"Remember checksums across runs, and reuse them for files whose size and modification time are unchanged."`
+	CacheFile     string   `help:"File holding the checksums remembered by --cache." default:"${cache_path}" type:"path"`
+	ReadBuffer    byteSize `help:"Read files in blocks of SIZE, e.g. 1M, which can be faster on spinning disks and RAID arrays." placeholder:"SIZE"`
+	DirectIO      bool     `help:"Read files with direct I/O, bypassing the page cache, for instance when indexing huge archives (Linux only)."`
+	StatWorkers   int      `help:"Number of workers that stat files ahead of those hashing them, 0 to leave it to those. On network file systems, where stat'ing files is slow, more of them keep the hashing workers busy; on local disks, hashing is what takes time." default:"0"`
+	HashWorkers   int      `help:"Number of workers that hash files, overriding -j/--workers, 0 to use -j." default:"0"`
+	ChangeRetries int      `help:"Hash a file that changed while it was hashed again, up to N times, before indexing it marked as unstable." default:"2" placeholder:"N"`
+	Xattrs        string   `help:"How to treat extended attributes, such as macOS resource forks: ignore them, hash them with the content so that files differing only in them are not duplicates, or record them to flag such duplicates. Commands looking up files in an index default to the choice of the index, others to ignore (Linux and macOS only)." enum:",ignore,hash,record" default:""`
+
+	ThrottleOptions `embed:""`
+}
+
+func (o *HashOptions) hasher() (*dupfind.Hasher, error) {
+	return o.newHasher(dupfind.DefaultAlgorithm)
+}
+
+// indexRules makes the hasher use the --hash-for rules the index of
+// header was built with, unless others are given.
+func (o *HashOptions) indexRules(header dupfind.IndexHeader) {
+	if len(o.HashFor) == 0 {
+		o.HashFor = header.HashFor
+	}
+}
+
+// indexHasher returns the hasher for looking up files in index, which
+// unless --hash and --hash-for are given hashes them with the algorithms
+// of the index.
+func (o *HashOptions) indexHasher(index dupfind.Index) (*dupfind.Hasher, error) {
+	o.indexRules(index.Header())
+	algorithm := dupfind.IndexAlgorithm(index)
+	if algorithm != "" && o.Hash == "" {
+		dupfind.Log.Debugf("Hashing files with %s, the algorithm of the index", algorithm)
+	}
+	if algorithm == "" {
+		algorithm = dupfind.DefaultAlgorithm
+	}
+	h, err := o.newHasher(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	xattrs := index.Header().Xattrs
+	if o.Xattrs == "" {
+		h.Xattrs = xattrs
+	} else if (xattrs == dupfind.XattrsHash) != (h.Xattrs == dupfind.XattrsHash) {
+		dupfind.Log.Warnf("Warning: the index was built with --xattrs=%s, files with extended attributes will not match it", orIgnore(xattrs))
+	}
+	return h, nil
+}
+
+// orIgnore returns the treatment of extended attributes xattrs, which is
+// to ignore them if it is empty.
+func orIgnore(xattrs string) string {
+	if xattrs == "" {
+		return dupfind.XattrsIgnore
+	}
+	return xattrs
+}
+
+// newHasher returns a hasher for the flags, using fallback unless --hash
+// is given.
+func (o *HashOptions) newHasher(fallback string) (*dupfind.Hasher, error) {
+	if o.Hash != "" {
+		fallback = o.Hash
+	}
+	h, err := dupfind.NewHasher(fallback, o.HashFor)
+	if err != nil {
+		return nil, err
+	}
+	o.throttle(h)
+	h.BufferSize, h.DirectIO = int(o.ReadBuffer), o.DirectIO
+	h.Xattrs, h.ChangeRetries = o.Xattrs, o.ChangeRetries
+	h.StatWorkers, h.HashWorkers = o.StatWorkers, o.HashWorkers
+	if o.Cache {
+		if h.Cache, err = dupfind.OpenHashCache(o.CacheFile); err != nil {
+			return nil, fmt.Errorf("opening hash cache %s: %w", o.CacheFile, err)
+		}
+	}
+	return h, nil
+}
+
+// defaultCachePath returns the default location of the hash cache.
+func defaultCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dupfind", "hashes.db")
+}
+
+// BudgetOptions are the command line flags stopping a run early, as
+// cleanly as if it was interrupted, for runs in limited time slots.
+type BudgetOptions struct {
+	MaxDuration time.Duration `help:"Stop once DURATION, such as 2h, has passed. Files being hashed are finished first." placeholder:"DURATION"`
+	MaxFiles    int64         `help:"Stop before processing more than N files." placeholder:"N"`
+}
+
+func (o *BudgetOptions) budgeted() bool {
+	return o.MaxDuration > 0 || o.MaxFiles > 0
+}
+
+// limit applies the budget to the run counted by stats.
+func (o *BudgetOptions) limit(stats *dupfind.ScanStats) {
+	stats.Limit(o.MaxFiles, o.MaxDuration)
+}
+
+// budgetErr returns err, or nil if it only says that the budget of the
+// run was used up.
+func budgetErr(err error) error {
+	if errors.Is(err, dupfind.ErrBudget) {
+		return nil
+	}
+	return err
+}
+
+// ThrottleOptions are the command line flags limiting how fast files are
+// read.
+type ThrottleOptions struct {
+	MaxReadMbps  float64       `help:"Read files at most at N megabits per second in total, for instance to leave bandwidth to other users of a NAS." placeholder:"N"`
+	Nice         bool          `help:"Run in the background without making the machine sluggish: lower the CPU and disk priority, pause 10ms before each file and read one file at a time, unless --pause or --max-open-files say otherwise."`
+	Pause        time.Duration `help:"Sleep this long before reading each file, in each worker." placeholder:"DURATION"`
+	MaxOpenFiles int           `help:"Read at most N files at once, whatever the number of workers." placeholder:"N"`
+}
+
+// throttle applies the flags to hasher, and lowers the priority of the
+// process with --nice.
+func (o *ThrottleOptions) throttle(hasher *dupfind.Hasher) {
+
+	if o.MaxReadMbps > 0 {
+		hasher.Throttle = dupfind.NewThrottle(o.MaxReadMbps * 1e6 / 8)
+	}
+	hasher.Pause, hasher.MaxOpen = o.Pause, o.MaxOpenFiles
+	if !o.Nice {
+		return
+	}
+	if hasher.Pause == 0 {
+		hasher.Pause = 10 * time.Millisecond
+	}
+	if hasher.MaxOpen == 0 {
+		hasher.MaxOpen = 1
+	}
+	if err := dupfind.LowerPriority(); err != nil {
+		dupfind.Log.Warnf("Warning: could not lower the priority: %v", err)
+	}
+}
+
+// WalkOptions are the command line flags selecting which files to visit.
+type WalkOptions struct {
+	Exclude          []string `help:"Skip files and directories matching PATTERN. Patterns containing / match the path relative to the root, others the base name." placeholder:"PATTERN" sep:"none"`
+	Include          []string `help:"Only visit files matching PATTERN." placeholder:"PATTERN" sep:"none"`
+	RespectGitignore bool     `help:"Skip files ignored by .gitignore files, the repository's info/exclude file and global git excludes."`
+	FollowSymlinks   bool     `help:"Descend into symlinked directories. By default they are not followed."`
+	SkipSymlinks     bool     `help:"Skip symlinked files. Pass --no-skip-symlinks to hash the files they point to." default:"true" negatable:""`
+	OneFileSystem    bool     `short:"x" help:"Do not descend into directories on other file systems, such as /proc or mounted drives."`
+	MinSize          byteSize `help:"Skip files smaller than SIZE, e.g. 4K or 10M." placeholder:"SIZE"`
+	MaxSize          byteSize `help:"Skip files larger than SIZE." placeholder:"SIZE"`
+	MaxDepth         int      `help:"Only visit files at most N directories deep. With 1, only the files directly in the root are visited." placeholder:"N"`
+	PruneDir         []string `help:"Skip directories named NAME, such as .git or __pycache__, wherever they are." placeholder:"NAME" sep:"none"`
+	SkipHidden       bool     `help:"Skip hidden files and directories: those whose name starts with a dot and, on Windows, those with the hidden attribute. By default they are visited like any other." negatable:""`
+	Type             []string `help:"Only visit files of these types: ${enum}, judged by their extension." enum:"image,video,audio,document,archive" placeholder:"TYPE"`
+	Ext              []string `help:"Only visit files with these extensions, such as jpg,png,raw. With --type, files of either are visited." placeholder:"EXT"`
+	SniffType        bool     `help:"Also visit files without an extension if their first bytes show that they are of a --type, which reads them during the walk."`
+	WalkWorkers      int      `help:"Number of directories to read in parallel, which speeds up walks of network file systems." default:"1"`
+	IncludeSpecial   bool     `help:"Record FIFOs, sockets and devices by their type and size, without reading them. They are skipped by default."`
+}
+
+func (o *WalkOptions) walker() (*dupfind.Walker, error) {
+	return dupfind.NewWalker(dupfind.WalkConfig{
+		Exclude:          o.Exclude,
+		Include:          o.Include,
+		RespectGitignore: o.RespectGitignore,
+		FollowSymlinks:   o.FollowSymlinks,
+		SkipSymlinks:     o.SkipSymlinks,
+		OneFileSystem:    o.OneFileSystem,
+		MinSize:          int64(o.MinSize),
+		MaxSize:          int64(o.MaxSize),
+		MaxDepth:         o.MaxDepth,
+		PruneDirs:        o.PruneDir,
+		SkipHidden:       o.SkipHidden,
+		Types:            o.Type,
+		Extensions:       o.Ext,
+		SniffTypes:       o.SniffType,
+		Workers:          o.WalkWorkers,
+		IncludeSpecial:   o.IncludeSpecial,
+	})
+}
+
+// IgnoreOptions are the command line flags leaving out content that is
+// expected to be duplicated.
+type IgnoreOptions struct {
+	IgnoreHashes string `help:"Never report files whose checksum is listed in FILE, one per line, such as license files or boilerplate that is expected in many places. The output of sha256sum or export can be used." placeholder:"FILE" type:"path"`
+}
+
+// ignoredChecksums reads the checksums given with --ignore-hashes, or
+// returns nil if there are none.
+func (o *IgnoreOptions) ignoredChecksums() (dupfind.ChecksumSet, error) {
+	if o.IgnoreHashes == "" {
+		return nil, nil
+	}
+	ignored, err := dupfind.ReadChecksumSet(o.IgnoreHashes)
+	if err != nil {
+		return nil, fmt.Errorf("reading --ignore-hashes: %w", err)
+	}
+	return ignored, nil
+}
+
+// TrashOptions are the command line flags keeping removed duplicates
+// recoverable.
+type TrashOptions struct {
+	Trash    bool   `help:"Move removed files to the trash (the Recycle Bin on Windows) instead of deleting them." xor:"trash"`
+	TrashDir string `help:"Move removed files below DIR instead of deleting them. They keep their absolute path below DIR." placeholder:"DIR" type:"path" xor:"trash"`
+}
+
+// remove removes path, to the trash if asked to.
+func (o *TrashOptions) remove(path string) error {
+	switch {
+	case o.TrashDir != "":
+		_, err := dupfind.Quarantine(o.TrashDir, path)
+		return err
+	case o.Trash:
+		return dupfind.MoveToTrash(path)
+	default:
+		return os.Remove(path)
+	}
+}
+
+// done returns the message for a file the action was carried out on.
+func (o *TrashOptions) done(action string) string {
+	if action == "delete" && o.TrashDir != "" {
+		return "Moved to " + o.TrashDir + ":"
+	}
+	if action == "delete" && o.Trash {
+		return "Moved to trash:"
+	}
+	return actionDone[action]
+}
+
+// byteSize is a file size given on the command line, with an optional
+// binary unit suffix such as K, MB or GiB.
+type byteSize int64
+
+func (b *byteSize) UnmarshalText(text []byte) error {
+	s := strings.ToUpper(strings.TrimSpace(string(text)))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := 1.0
+	if s != "" {
+		if exp := strings.IndexByte("KMGTPE", s[len(s)-1]); exp >= 0 {
+			multiplier = math.Pow(1024, float64(exp+1))
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", text)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+// percentage is a share given on the command line as a number of
+// percent, with or without a percent sign.
+type percentage float64
+
+func (p *percentage) UnmarshalText(text []byte) error {
+	s := strings.TrimSuffix(strings.TrimSpace(string(text)), "%")
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 || n > 100 {
+		return fmt.Errorf("invalid percentage %q", text)
+	}
+	*p = percentage(n / 100)
+	return nil
+}
+
+// sourceMapper decodes arguments of type source, which are made absolute
+// like those of type path unless they are - or the URL of a remote
+// directory such as s3://bucket/prefix. Repeated flags of this type add
+// to a slice.
+type sourceMapper struct{}
+
+func (sourceMapper) Decode(ctx *kong.DecodeContext, target reflect.Value) error {
+	var path string
+	if err := ctx.Scan.PopValueInto("path", &path); err != nil {
+		return err
+	}
+	if path != "-" && !dupfind.IsRemote(path) {
+		path = kong.ExpandPath(path)
+	}
+	if target.Kind() == reflect.Slice {
+		target.Set(reflect.Append(target, reflect.ValueOf(path)))
+		return nil
+	}
+	target.SetString(path)
+	return nil
+}
+
+// SignOptions are the command line flags signing the index written.
+type SignOptions struct {
+	SignKey string `help:"Sign the index with the ed25519 private key in FILE, as written by keygen, so that verify --verify-key can detect changes to it. The signature is written to INDEX.sig." placeholder:"FILE" type:"path"`
+}
+
+// signingKey reads the key given with --sign-key, or returns nil if there
+// is none. It is read before any work is done, so that a wrong key does
+// not fail a long build at the end.
+func (o *SignOptions) signingKey() (ed25519.PrivateKey, error) {
+	if o.SignKey == "" {
+		return nil, nil
+	}
+	return dupfind.ReadPrivateKey(o.SignKey)
+}
+
+// finishIndex is called after index is written. It signs index with key,
+// or removes its outdated signature if key is nil, records a snapshot in
+// its history if it keeps one, and brings its Bloom filter up to date if
+// it has one.
+func finishIndex(index string, key ed25519.PrivateKey) error {
+	if err := dupfind.SignIndex(index, key); err != nil {
+		return fmt.Errorf("signing index %s: %w", index, err)
+	}
+	if keepsHistory(index) {
+		if err := appendHistory(index, time.Now()); err != nil {
+			return fmt.Errorf("recording the history of %s: %w", index, err)
+		}
+	}
+	if _, err := os.Stat(dupfind.BloomFile(index)); err == nil {
+		return writeBloomFilter(index)
+	}
+	return nil
+}
+
+// writeBloomFilter writes the Bloom filter of index unless it is current.
+func writeBloomFilter(index string) error {
+	if dupfind.BloomFilterCurrent(index) {
+		return nil
+	}
+	if err := dupfind.WriteBloomFilter(index); err != nil {
+		return fmt.Errorf("writing Bloom filter of %s: %w", index, err)
+	}
+	return nil
+}
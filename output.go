@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// MatchWriter writes matches in one of the supported output formats.
+type MatchWriter interface {
+	Write(m dupfind.Match) error
+	// Close writes any buffered output.
+	Close() error
+}
+
+// newMatchWriter returns a writer for format. If fields is not empty,
+// only those fields of each match are written.
+func newMatchWriter(format string, w io.Writer, short bool, fields []string) MatchWriter {
+	if len(fields) > 0 {
+		return &fieldsMatchWriter{format: format, fields: fields, w: w, csv: csv.NewWriter(w)}
+	}
+	switch format {
+	case "json":
+		return &jsonMatchWriter{w: w}
+	case "ndjson":
+		return &ndjsonMatchWriter{enc: json.NewEncoder(w)}
+	case "csv":
+		return &csvMatchWriter{w: csv.NewWriter(w)}
+	case "print0":
+		return &print0MatchWriter{w: w}
+	case "long":
+		return newLongMatchWriter(w)
+	case "porcelain":
+		return &porcelainMatchWriter{w: w}
+	default:
+		return &textMatchWriter{w: w, short: short}
+	}
+}
+
+// countingMatchWriter counts the matches written and their size, for the
+// summary of a find run.
+type countingMatchWriter struct {
+	MatchWriter
+	matches int
+	size    int64
+}
+
+func (c *countingMatchWriter) Write(m dupfind.Match) error {
+	c.matches++
+	c.size += m.Size
+	return c.MatchWriter.Write(m)
+}
+
+type textMatchWriter struct {
+	w     io.Writer
+	short bool
+}
+
+func (t *textMatchWriter) Write(m dupfind.Match) error {
+	var err error
+	if m.Removed {
+		_, err = fmt.Fprintf(t.w, "Removed %s\n", m.Path)
+	} else if m.Missing {
+		_, err = fmt.Fprintln(t.w, m.Path)
+	} else if m.Dir && !t.short {
+		_, err = fmt.Fprintf(t.w, "Directory %s%c is 100%% duplicate with index files below %s (%d files, %s)\n",
+			m.Path, filepath.Separator, m.IndexPath, m.Files, formatBytes(m.Size))
+	} else if t.short {
+		_, err = fmt.Fprintln(t.w, filepath.Base(m.Path))
+	} else if m.Self {
+		_, err = fmt.Fprintf(t.w, "File %s is duplicate with looked up file %s\n",
+			m.Path, m.IndexPath)
+	} else if m.Similar && m.Shared > 0 {
+		_, err = fmt.Fprintf(t.w, "File %s shares %d%% of its content with index file %s\n",
+			m.Path, m.Shared, m.IndexPath)
+	} else if m.Similar && m.Checksum == "" {
+		_, err = fmt.Fprintf(t.w, "File %s is likely duplicate with index file %s\n",
+			m.Path, m.IndexPath)
+	} else if m.Similar {
+		_, err = fmt.Fprintf(t.w, "File %s is similar to index file %s (distance %d)\n",
+			m.Path, m.IndexPath, m.Distance)
+	} else if len(m.IndexPaths) > 1 {
+		_, err = fmt.Fprintf(t.w, "File %s is duplicate with index files %s%s%s\n",
+			m.Path, strings.Join(m.IndexPaths, ", "), fromSource(m), xattrsNote(m))
+	} else {
+		_, err = fmt.Fprintf(t.w, "File %s is duplicate with index file %s%s%s\n",
+			m.Path, m.IndexPath, fromSource(m), xattrsNote(m))
+	}
+	return err
+}
+
+// fromSource names the index a match came from, if known.
+func fromSource(m dupfind.Match) string {
+	if m.Source == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (in %s)", m.Source)
+}
+
+// xattrsNote flags a match whose extended attributes differ.
+func xattrsNote(m dupfind.Match) string {
+	if !m.XattrsDiffer {
+		return ""
+	}
+	return ", but their extended attributes differ"
+}
+
+func (t *textMatchWriter) Close() error {
+	return nil
+}
+
+// porcelainMatchWriter writes each match as one line of tab-separated
+// fields for scripts: its kind, path, indexed path, size and checksum.
+// The format is frozen. Fields may only ever be added at the end.
+type porcelainMatchWriter struct {
+	w io.Writer
+}
+
+// porcelainEscaper escapes the characters that would split a field or
+// line of porcelain output.
+var porcelainEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+func (p *porcelainMatchWriter) Write(m dupfind.Match) error {
+	kind := "duplicate"
+	switch {
+	case m.Dir:
+		kind = "dir"
+	case m.Missing:
+		kind = "missing"
+	case m.Removed:
+		kind = "removed"
+	case m.Self:
+		kind = "self"
+	case m.Similar:
+		kind = "similar"
+	}
+	_, err := fmt.Fprintf(p.w, "%s\t%s\t%s\t%d\t%s\n", kind,
+		porcelainEscaper.Replace(m.Path), porcelainEscaper.Replace(m.IndexPath), m.Size, m.Checksum)
+	return err
+}
+
+func (p *porcelainMatchWriter) Close() error {
+	return nil
+}
+
+// longMatchWriter writes each match as a row of aligned columns holding
+// the size and modification time of both copies, so that the older or
+// larger one stands out. Rows are buffered to align them and written on
+// Close.
+type longMatchWriter struct {
+	tw *tabwriter.Writer
+}
+
+func newLongMatchWriter(w io.Writer) *longMatchWriter {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tMTIME\tINDEX SIZE\tINDEX MTIME\tCHECKSUM\tPATH\tINDEX PATH")
+	return &longMatchWriter{tw: tw}
+}
+
+func (l *longMatchWriter) Write(m dupfind.Match) error {
+	path := m.Path
+	if m.Removed {
+		path += " (removed)"
+	}
+	indexSize, indexTime, indexPath := "-", "-", "-"
+	if m.IndexPath != "" {
+		indexSize, indexTime, indexPath = strconv.FormatInt(m.IndexSize, 10), longTime(m.IndexModTime), m.IndexPath
+	}
+	checksum := m.Checksum
+	if checksum == "" {
+		checksum = "-"
+	}
+	_, err := fmt.Fprintf(l.tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+		m.Size, longTime(m.ModTime), indexSize, indexTime, checksum, path, indexPath)
+	return err
+}
+
+// longTime formats t for long output, or - if it is unknown.
+func longTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func (l *longMatchWriter) Close() error {
+	return l.tw.Flush()
+}
+
+// dirMatchWriter holds back the matches of a find --dirs run until all
+// files are looked up. It then writes the directories whose files are all
+// duplicates, followed by the matches outside them.
+type dirMatchWriter struct {
+	out     MatchWriter
+	rollup  *dupfind.DirRollup
+	matches []dupfind.Match
+}
+
+func (d *dirMatchWriter) Write(m dupfind.Match) error {
+	d.rollup.Add(m)
+	d.matches = append(d.matches, m)
+	return nil
+}
+
+func (d *dirMatchWriter) Close() error {
+
+	dirs := d.rollup.Duplicates()
+	for _, dir := range dirs {
+		if err := d.out.Write(dir); err != nil {
+			return err
+		}
+	}
+	for _, m := range d.matches {
+		if !inDirs(m.Path, dirs) {
+			if err := d.out.Write(m); err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.out.Close()
+}
+
+// inDirs reports whether path lies below one of dirs.
+func inDirs(path string, dirs []dupfind.Match) bool {
+	for _, dir := range dirs {
+		if _, ok := dupfind.CutPathPrefix(path, dir.Path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// print0MatchWriter writes the path of each match followed by a NUL
+// character, which unlike a newline cannot occur in a path.
+type print0MatchWriter struct {
+	w io.Writer
+}
+
+func (p *print0MatchWriter) Write(m dupfind.Match) error {
+	_, err := fmt.Fprintf(p.w, "%s\x00", m.Path)
+	return err
+}
+
+func (p *print0MatchWriter) Close() error {
+	return nil
+}
+
+// jsonMatchWriter buffers all matches and writes them as one JSON array.
+type jsonMatchWriter struct {
+	w       io.Writer
+	matches []dupfind.Match
+}
+
+func (j *jsonMatchWriter) Write(m dupfind.Match) error {
+	j.matches = append(j.matches, m)
+	return nil
+}
+
+func (j *jsonMatchWriter) Close() error {
+	if j.matches == nil {
+		j.matches = []dupfind.Match{}
+	}
+	enc := json.NewEncoder(j.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(j.matches)
+}
+
+type ndjsonMatchWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonMatchWriter) Write(m dupfind.Match) error {
+	return n.enc.Encode(m)
+}
+
+func (n *ndjsonMatchWriter) Close() error {
+	return nil
+}
+
+type csvMatchWriter struct {
+	w       *csv.Writer
+	started bool
+}
+
+func (c *csvMatchWriter) Write(m dupfind.Match) error {
+	if !c.started {
+		c.started = true
+		c.w.Write([]string{"path", "index_path", "index_paths", "checksum", "size", "removed", "similar", "distance", "shared", "source", "self", "missing", "dir", "files", "xattrs_differ"})
+	}
+	// all indexed locations share one column, separated like $PATH
+	c.w.Write([]string{m.Path, m.IndexPath, strings.Join(m.IndexPaths, string(os.PathListSeparator)), m.Checksum,
+		strconv.FormatInt(m.Size, 10), strconv.FormatBool(m.Removed), strconv.FormatBool(m.Similar),
+		strconv.Itoa(m.Distance), strconv.Itoa(m.Shared), m.Source,
+		strconv.FormatBool(m.Self), strconv.FormatBool(m.Missing),
+		strconv.FormatBool(m.Dir), strconv.Itoa(m.Files), strconv.FormatBool(m.XattrsDiffer)})
+	// flush every line so results show up while find is still running
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvMatchWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"time"
+)
+
+// planAction removes Path, or replaces it by a link to Target. Size and
+// ModTime describe Path when the action was planned, and so do Mode and
+// its owner, if known, so that it can be restored as it was. Xattrs is
+// XattrsHash if the extended attributes of Path are part of Checksum.
+type planAction struct {
+	Action   string      `json:"action"`
+	Path     string      `json:"path"`
+	Target   string      `json:"target"`
+	Checksum string      `json:"checksum,omitempty"`
+	Size     int64       `json:"size"`
+	ModTime  time.Time   `json:"mtime"`
+	Mode     os.FileMode `json:"mode,omitempty"`
+	Owned    bool        `json:"owned,omitempty"`
+	UID      uint32      `json:"uid,omitempty"`
+	GID      uint32      `json:"gid,omitempty"`
+	Xattrs   string      `json:"xattrs,omitempty"`
+}
+
+// newPlanAction plans action for the file of record, whose checksum was
+// computed treating extended attributes as xattrs says.
+func newPlanAction(action string, record dupfind.Metadata, target, xattrs string) planAction {
+	if xattrs != dupfind.XattrsHash {
+		xattrs = ""
+	}
+	return planAction{
+		Action:   action,
+		Path:     record.Path,
+		Target:   target,
+		Checksum: dupfind.ChecksumKey(record.Algorithm, record.Checksum),
+		Size:     record.Size,
+		ModTime:  record.ModTime,
+		Mode:     record.Mode,
+		Owned:    record.Owned,
+		UID:      record.UID,
+		GID:      record.GID,
+		Xattrs:   xattrs,
+	}
+}
+
+// plan is the file written by dedupe and review --plan, which apply
+// carries out.
+type plan struct {
+	Created time.Time    `json:"created"`
+	Command string       `json:"command"`
+	Index   string       `json:"index"`
+	Actions []planAction `json:"actions"`
+}
+
+// writePlan writes the actions that command planned to name.
+func writePlan(name, command, index string, actions []planAction) error {
+
+	if actions == nil {
+		actions = []planAction{}
+	}
+	data, err := json.MarshalIndent(plan{Created: time.Now().UTC(), Command: command, Index: index, Actions: actions}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(name, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Plan with %d actions written to %s.\n", len(actions), name)
+
+	return nil
+}
+
+// applyAction carries out an action, unless the file changed since it was
+// planned, the file kept is gone or the file already is the file kept.
+func applyAction(action planAction, remove func(string) error) error {
+	info, err := os.Stat(action.Path)
+	if err != nil {
+		return err
+	}
+	if info.Size() != action.Size || !info.ModTime().Equal(action.ModTime) {
+		return errors.New("the file changed since it was hashed")
+	}
+	if target, err := os.Stat(action.Target); err != nil || target.Size() != action.Size {
+		return errors.New("the file kept is gone or changed")
+	}
+	if sameFile(action.Path, action.Target) {
+		return errors.New("the file already is a link to the one kept")
+	}
+	return dedupeFile(action.Action, action.Path, action.Target, remove)
+}
+
+type ApplyCmd struct {
+	Plan   string `arg:"" help:"Plan file written by dedupe or review --plan." type:"existingfile"`
+	DryRun bool   `short:"n" help:"Only print what would be done"`
+
+	TrashOptions `embed:""`
+}
+
+func (a *ApplyCmd) Run(ctx *Context) error {
+
+	data, err := os.ReadFile(a.Plan)
+	if err != nil {
+		return err
+	}
+	var p plan
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("reading plan %s: %w", a.Plan, err)
+	}
+	for i, action := range p.Actions {
+		if _, ok := actionDone[action.Action]; !ok || action.Path == "" || action.Target == "" {
+			return fmt.Errorf("plan %s: action %d is not valid", a.Plan, i+1)
+		}
+	}
+
+	var failed int
+	undo := newUndoLog(p.Index)
+	defer undo.Close()
+	for _, action := range p.Actions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if a.DryRun {
+			fmt.Printf("Would %s %s (duplicate of %s)\n", action.Action, action.Path, action.Target)
+			continue
+		}
+		if err := applyAction(action, a.remove); err != nil {
+			dupfind.Log.With("path", action.Path, "error", err).Warnf("Could not %s %s: %v", action.Action, action.Path, err)
+			failed++
+			continue
+		}
+		if err := undo.record(action); err != nil {
+			return fmt.Errorf("recording %s in the undo log: %w", action.Path, err)
+		}
+		fmt.Printf("%s %s (duplicate of %s)\n", a.done(action.Action), action.Path, action.Target)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d actions failed", failed, len(p.Actions))
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"time"
+)
+
+const (
+	progressInterval = time.Second
+	// statusInterval is how often progress is printed when stderr is not
+	// a terminal.
+	statusInterval = 10 * time.Second
+)
+
+// formatBytes renders a byte count using binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d >= time.Hour {
+		return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%02d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// ProgressOptions are the command line flags controlling progress output.
+type ProgressOptions struct {
+	Progress *bool `help:"Show progress on stderr (default: when stderr is a terminal)." negatable:""`
+	PrePass  bool  `help:"Count files and bytes before hashing so progress can show an ETA." default:"true" negatable:""`
+}
+
+// startProgress starts reporting progress for a walk of root, if enabled.
+// The returned function stops the reporter; it is nil if progress is off.
+func (o *ProgressOptions) startProgress(roots []string, walker *dupfind.Walker, stats *dupfind.ScanStats) func() {
+
+	tty := isTerminal(os.Stderr)
+	if o.Progress == nil && !tty || o.Progress != nil && !*o.Progress {
+		return nil
+	}
+
+	// the pre-pass runs alongside hashing, and the totals are shown once
+	// it is done
+	totals := make(chan progressTotals, 1)
+	if o.PrePass {
+		go func() {
+			if files, bytes, err := totalFileSize(roots, walker, stats); err == nil {
+				totals <- progressTotals{files: files, bytes: bytes}
+			}
+		}()
+	}
+
+	return startProgress(stats, totals, tty)
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// totalFileSize counts the regular files below roots and sums their sizes.
+// It gives up once the run is aborted.
+func totalFileSize(roots []string, walker *dupfind.Walker, stats *dupfind.ScanStats) (int64, int64, error) {
+
+	var files, bytes int64
+	for _, root := range roots {
+		err := walker.Walk(root, nil, func(path string, info os.FileInfo) error {
+			if stats.Aborted() {
+				return errAborted
+			}
+			if info.Mode().IsRegular() {
+				files++
+				bytes += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return files, bytes, err
+		}
+	}
+
+	return files, bytes, nil
+}
+
+// errAborted ends the pre-pass of an aborted run.
+var errAborted = errors.New("aborted")
+
+// progressTotals holds the expected number of files and bytes, or -1 if
+// they are unknown.
+type progressTotals struct {
+	files int64
+	bytes int64
+}
+
+// startProgress periodically prints the number of files and bytes hashed
+// so far to stderr. On a terminal the status line is updated in place;
+// otherwise a new line is printed every statusInterval. The returned
+// function stops the reporter and prints a final line. Totals are unknown
+// until they are received from totalsReady.
+func startProgress(stats *dupfind.ScanStats, totalsReady <-chan progressTotals, tty bool) func() {
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		totals := progressTotals{files: -1, bytes: -1}
+		start := time.Now()
+		lastPrinted := start
+		var last int64
+		var rate float64 // smoothed bytes per second
+		for {
+			select {
+			case totals = <-totalsReady:
+				totalsReady = nil
+			case <-ticker.C:
+				hashed := stats.Hashed.Load()
+				current := float64(hashed-last) / progressInterval.Seconds()
+				if rate == 0 {
+					rate = current
+				} else {
+					rate = 0.3*current + 0.7*rate
+				}
+				last = hashed
+				if tty {
+					fmt.Fprintf(os.Stderr, "\r%s\033[K", formatProgress(stats, totals, rate))
+				} else if time.Since(lastPrinted) >= statusInterval {
+					lastPrinted = time.Now()
+					fmt.Fprintln(os.Stderr, formatProgress(stats, totals, rate))
+				}
+			case <-done:
+				elapsed := time.Since(start).Seconds()
+				rate := 0.0
+				if elapsed > 0 {
+					rate = float64(stats.Hashed.Load()) / elapsed
+				}
+				if tty {
+					fmt.Fprintf(os.Stderr, "\r%s\033[K\n", formatProgress(stats, totals, rate))
+				} else {
+					fmt.Fprintln(os.Stderr, formatProgress(stats, totals, rate))
+				}
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// stopWhenDone forwards metadata and calls stop once the input is drained,
+// so the final progress line is printed before any summary output.
+func stopWhenDone(metadata <-chan dupfind.Metadata, stop func()) <-chan dupfind.Metadata {
+
+	out := make(chan dupfind.Metadata)
+	go func() {
+		defer close(out)
+		for record := range metadata {
+			out <- record
+		}
+		stop()
+	}()
+
+	return out
+}
+
+func formatProgress(stats *dupfind.ScanStats, totals progressTotals, rate float64) string {
+
+	files := stats.Files.Load()
+	hashed := stats.Hashed.Load()
+	if totals.bytes < 0 {
+		return fmt.Sprintf("%d files, hashed %s, %s/s", files, formatBytes(hashed), formatBytes(int64(rate)))
+	}
+
+	percent := 100.0
+	if totals.bytes > 0 {
+		percent = 100 * float64(hashed) / float64(totals.bytes)
+	}
+	eta := "--:--"
+	if remaining := totals.bytes - hashed; remaining <= 0 {
+		eta = formatDuration(0)
+	} else if rate > 0 {
+		eta = formatDuration(time.Duration(float64(remaining) / rate * float64(time.Second)))
+	}
+
+	return fmt.Sprintf("%d/%d files, hashed %s of %s (%.0f%%), %s/s, ETA %s",
+		files, totals.files, formatBytes(hashed), formatBytes(totals.bytes), percent,
+		formatBytes(int64(rate)), eta)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+)
+
+type PruneCmd struct {
+	Index  string `arg:"" optional:"" help:"Index file to prune (default: the index set in the config file)." type:"path"`
+	Check  bool   `help:"Also remove entries whose file changed size or modification time since it was indexed."`
+	DryRun bool   `short:"n" help:"Only print the entries that would be removed"`
+	Root   string `help:"Look for the indexed files below DIR instead of the directory the index was built from." placeholder:"DIR" type:"path"`
+
+	SignOptions `embed:""`
+}
+
+func (p *PruneCmd) Run(ctx *Context) error {
+
+	var err error
+	if p.Index, err = ctx.indexFile(p.Index); err != nil {
+		return err
+	}
+	key, err := p.signingKey()
+	if err != nil {
+		return err
+	}
+	header, records, err := dupfind.ReadIndex(p.Index)
+	if err != nil {
+		return err
+	}
+
+	// records keep their stored paths, so that a relative index stays relative
+	kept := make([]dupfind.Metadata, 0, len(records))
+	var missing, changed int
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := dupfind.RootPath(header, p.Root, record.Path)
+		file, member := path, false
+		if container, ok := dupfind.Container(path); ok {
+			file, member = container, true
+		}
+		info, err := os.Stat(file)
+		switch {
+		case err != nil:
+			fmt.Printf("MISSING  %s\n", path)
+			missing++
+		case p.Check && !member && (info.Size() != record.Size || !info.ModTime().Equal(record.ModTime)):
+			fmt.Printf("CHANGED  %s\n", path)
+			changed++
+		default:
+			kept = append(kept, record)
+		}
+	}
+
+	if p.DryRun {
+		fmt.Printf("Would prune %d of %d entries: %d missing, %d changed.\n", missing+changed, len(records), missing, changed)
+		return nil
+	}
+	if missing+changed > 0 {
+		if err := dupfind.OpenStore(p.Index).Write(header, kept); err != nil {
+			return fmt.Errorf("writing index %s: %w", p.Index, err)
+		}
+		if err := finishIndex(p.Index, key); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Pruned %d of %d entries: %d missing, %d changed.\n", missing+changed, len(records), missing, changed)
+
+	return nil
+}
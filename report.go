@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+type ReportCmd struct {
+	Index        string   `arg:"" optional:"" help:"Index file (default: the index set in the config file)." type:"path"`
+	Top          int      `help:"Only list this many groups, 0 for all" default:"0"`
+	MinWasted    byteSize `help:"Only list groups wasting at least SIZE, e.g. 1M." placeholder:"SIZE"`
+	OutputFormat string   `help:"Output format (${enum})." enum:"text,json" default:"text"`
+	SameOwner    bool     `help:"Only group files with the same owner and group, as on shared servers where each user can only clean up their own files."`
+
+	IgnoreOptions `embed:""`
+}
+
+// reportGroup is a group of duplicates as written by report.
+type reportGroup struct {
+	Checksum string   `json:"checksum"`
+	Size     int64    `json:"size"`
+	Wasted   int64    `json:"wasted"`
+	Owner    string   `json:"owner,omitempty"`
+	Paths    []string `json:"paths"`
+}
+
+func (r *ReportCmd) Run(ctx *Context) error {
+
+	var err error
+	if r.Index, err = ctx.indexFile(r.Index); err != nil {
+		return err
+	}
+	header, records, err := dupfind.ReadIndex(r.Index)
+	if err != nil {
+		return err
+	}
+	warnPartial(r.Index, header)
+	records = dupfind.RootRecords(header, records, "")
+	ignored, err := r.ignoredChecksums()
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string][]dupfind.Metadata)
+	for _, record := range records {
+		if dupfind.IsSpecial(record.Mode) || ignored.Has(record) {
+			continue
+		}
+		key := dupfind.ChecksumKey(record.Algorithm, record.Checksum)
+		if r.SameOwner {
+			key = ownerKey(key, record)
+		}
+		groups[key] = append(groups[key], record)
+	}
+
+	// the total covers all groups, also those not listed
+	var report []reportGroup
+	var wasted int64
+	for _, group := range duplicateGroups(groups) {
+		w := wastedBytes(group)
+		wasted += w
+		if w < int64(r.MinWasted) || r.Top > 0 && len(report) == r.Top {
+			continue
+		}
+		paths := make([]string, len(group))
+		for i, record := range group {
+			paths[i] = record.Path
+		}
+		var owner string
+		if r.SameOwner && group[0].Owned {
+			owner = ownerName(group[0])
+		}
+		report = append(report, reportGroup{
+			Checksum: dupfind.ChecksumKey(group[0].Algorithm, group[0].Checksum),
+			Size:     group[0].Size,
+			Wasted:   w,
+			Owner:    owner,
+			Paths:    paths,
+		})
+	}
+
+	if r.OutputFormat == "json" {
+		if report == nil {
+			report = []reportGroup{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	for _, group := range report {
+		fmt.Printf("%s wasted: %d copies of %s (%s)", formatBytes(group.Wasted), len(group.Paths), formatBytes(group.Size), group.Checksum)
+		if group.Owner != "" {
+			fmt.Printf(", owned by %s", group.Owner)
+		}
+		fmt.Println()
+		for _, path := range group.Paths {
+			fmt.Printf("  %s\n", path)
+		}
+	}
+	fmt.Printf("Total wasted space: %s\n", formatBytes(wasted))
+
+	return nil
+}
+
+// ownerKey extends the checksum key of record by its owner, so that files
+// of different owners are grouped apart.
+func ownerKey(key string, record dupfind.Metadata) string {
+	if !record.Owned {
+		return key
+	}
+	return fmt.Sprintf("%s/%d:%d", key, record.UID, record.GID)
+}
+
+// ownerName returns the names of the user and group owning the file of
+// record, or their IDs if they have no name.
+func ownerName(record dupfind.Metadata) string {
+
+	uid, gid := strconv.FormatUint(uint64(record.UID), 10), strconv.FormatUint(uint64(record.GID), 10)
+	if u, err := user.LookupId(uid); err == nil {
+		uid = u.Username
+	}
+	if g, err := user.LookupGroupId(gid); err == nil {
+		gid = g.Name
+	}
+
+	return uid + ":" + gid
+}
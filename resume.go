@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"jvkersch/dupfind/dupfind"
+	"os"
+)
+
+// previousRecords returns the records that an interrupted build of the
+// index hashed: those of a partial index, updated by those saved in its
+// checkpoint.
+func (b *BuildCmd) previousRecords() ([]dupfind.Metadata, error) {
+
+	var records []dupfind.Metadata
+	header, indexed, err := dupfind.ReadIndex(b.Index)
+	complete := err == nil && !header.Partial
+	switch {
+	case err == nil && header.Partial:
+		records = dupfind.RootRecords(header, indexed, "")
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+	saved, err := dupfind.ReadCheckpoint(b.Index)
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint %s: %w", dupfind.CheckpointFile(b.Index), err)
+	}
+	if records == nil && saved == nil {
+		if complete {
+			return nil, fmt.Errorf("index %s is complete, use update to bring it up to date", b.Index)
+		}
+		return nil, fmt.Errorf("there is no interrupted build of %s to resume", b.Index)
+	}
+
+	return append(records, saved...), nil
+}
+
+// reuseRecords passes on the previous records of the files in paths that
+// did not change since, along with those of the members of unchanged
+// archives and the streams of unchanged files, and the paths of the other files, which are to be hashed. The
+// count of reused records is complete once both channels are closed.
+func reuseRecords(paths <-chan string, previous []dupfind.Metadata, hasher *dupfind.Hasher, reused *int) (<-chan string, <-chan dupfind.Metadata) {
+
+	old := make(map[string]dupfind.Metadata)
+	members := make(map[string][]dupfind.Metadata)
+	for _, record := range previous {
+		old[dupfind.PathKey(record.Path)] = record
+		if file, ok := dupfind.Container(record.Path); ok {
+			key := dupfind.PathKey(file)
+			members[key] = append(members[key], record)
+		}
+	}
+
+	stale := make(chan string)
+	kept := make(chan dupfind.Metadata)
+	go func() {
+		defer close(stale)
+		defer close(kept)
+		for path := range paths {
+			if record, ok := old[dupfind.PathKey(path)]; ok {
+				info, err := os.Stat(path)
+				if err == nil && unchanged(record, info, hasher.AlgorithmFor(path)) {
+					*reused++
+					kept <- record
+					for _, member := range members[dupfind.PathKey(path)] {
+						if hasher.IndexesMember(member.Path) {
+							*reused++
+							kept <- member
+						}
+					}
+					continue
+				}
+			}
+			stale <- path
+		}
+	}()
+
+	return stale, kept
+}
+
+// checkpointMetadata saves the records hashed to checkpoint as they pass.
+func checkpointMetadata(metadata <-chan dupfind.Metadata, checkpoint *dupfind.Checkpoint) <-chan dupfind.Metadata {
+
+	out := make(chan dupfind.Metadata)
+	go func() {
+		defer close(out)
+		failed := false
+		for record := range metadata {
+			if err := checkpoint.Add(record); err != nil && !failed {
+				dupfind.Log.With("error", err).Warnf("Could not save the progress of the build: %v", err)
+				failed = true
+			}
+			out <- record
+		}
+	}()
+
+	return out
+}
+
+// interruptedBuild reports whether an interrupted build of index left a
+// partial index or a checkpoint behind.
+func interruptedBuild(index string) bool {
+	if _, err := os.Stat(dupfind.CheckpointFile(index)); err == nil {
+		return true
+	}
+	header, _, err := dupfind.ReadIndexSummary(index)
+	return err == nil && header.Partial
+}
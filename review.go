@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ReviewCmd struct {
+	Index  string   `arg:"" optional:"" help:"Index file (default: the index set in the config file)." type:"path"`
+	Script string   `help:"Write the chosen actions to FILE as a shell script instead of carrying them out." placeholder:"FILE" type:"path" xor:"plan"`
+	Plan   string   `help:"Write the chosen actions to FILE as a JSON plan instead of carrying them out, for apply to carry out later." placeholder:"FILE" type:"path" xor:"plan"`
+	Keep   []string `help:"Suggest the copy to keep by these rules: oldest, newest, shortest (path) or prefer:DIR. Later rules break ties of earlier ones." placeholder:"RULE"`
+
+	TrashOptions  `embed:""`
+	IgnoreOptions `embed:""`
+}
+
+const reviewHelp = `  N     keep file N and delete the others
+  lN    keep file N and replace the others by hardlinks to it
+  s     skip this group (also an empty line)
+  q     stop reviewing and go on to the chosen actions
+`
+
+const reviewSuggestionHelp = `  N     keep file N and delete the others
+  lN    keep file N and replace the others by hardlinks to it
+        (an empty line or l alone picks the suggested file, marked *)
+  s     skip this group
+  q     stop reviewing and go on to the chosen actions
+`
+
+func (r *ReviewCmd) Run(ctx *Context) error {
+
+	var err error
+	if r.Index, err = ctx.indexFile(r.Index); err != nil {
+		return err
+	}
+	header, records, err := dupfind.ReadIndex(r.Index)
+	if err != nil {
+		return err
+	}
+	warnPartial(r.Index, header)
+	if (r.Script != "" || r.Plan != "") && (r.Trash || r.TrashDir != "") {
+		return errors.New("--trash and --trash-dir cannot be used with --script or --plan, pass them to apply instead")
+	}
+	records = dupfind.RootRecords(header, records, "")
+	rules, err := parseKeepRules(r.Keep)
+	if err != nil {
+		return err
+	}
+	ignored, err := r.ignoredChecksums()
+	if err != nil {
+		return err
+	}
+	help := reviewHelp
+	if len(rules) > 0 {
+		help = reviewSuggestionHelp
+	}
+
+	// files inside archives and streams cannot be removed or linked, and
+	// hardlinks already share their data
+	groups := make(map[string][]dupfind.Metadata)
+	for _, record := range records {
+		key := dupfind.ChecksumKey(record.Algorithm, record.Checksum)
+		if _, ok := dupfind.Container(record.Path); ok || dupfind.IsSpecial(record.Mode) || ignored.Has(record) || dupfind.AnySameInode(record, groups[key]) {
+			continue
+		}
+		groups[key] = append(groups[key], record)
+	}
+	duplicates := duplicateGroups(groups)
+	if len(duplicates) == 0 {
+		fmt.Println("No duplicates in the index.")
+		return nil
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	var plan []planAction
+	fmt.Print("For each group, choose the file to keep:\n" + help)
+review:
+	for n, group := range duplicates {
+		fmt.Printf("\nGroup %d of %d: %d copies of %s, %s wasted\n",
+			n+1, len(duplicates), len(group), formatBytes(group[0].Size), formatBytes(wastedBytes(group)))
+		suggested := 0
+		if len(rules) > 0 {
+			candidates := make([]keepCandidate, len(group))
+			for i, record := range group {
+				candidates[i] = keepCandidate{Metadata: record, indexed: true}
+			}
+			suggested = chooseKeeper(candidates, rules) + 1
+		}
+		// sizes are right-aligned so that the paths line up
+		width := 0
+		for _, record := range group {
+			if n := len(formatBytes(record.Size)); n > width {
+				width = n
+			}
+		}
+		for i, record := range group {
+			mark := " "
+			if i+1 == suggested {
+				mark = "*"
+			}
+			fmt.Printf(" %s%2d  %*s  %s  %s\n", mark, i+1, width, formatBytes(record.Size),
+				record.ModTime.Local().Format("2006-01-02 15:04"), record.Path)
+		}
+		for {
+			fmt.Print("> ")
+			line, err := in.ReadString('\n')
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			answer := strings.TrimSpace(line)
+			if errors.Is(err, io.EOF) && answer == "" || answer == "q" {
+				break review
+			}
+			if answer == "s" || answer == "" && suggested == 0 {
+				break
+			}
+			action := "delete"
+			if rest, ok := strings.CutPrefix(answer, "l"); ok {
+				action, answer = "hardlink", rest
+			}
+			keep, err := strconv.Atoi(answer)
+			if answer == "" {
+				keep, err = suggested, nil
+			}
+			if err != nil || keep < 1 || keep > len(group) {
+				fmt.Print(help)
+				continue
+			}
+			for i, record := range group {
+				if i != keep-1 && action == "hardlink" && !dupfind.SameOwner(withOwner(record), withOwner(group[keep-1])) {
+					fmt.Printf("Not linking %s, it has another owner than %s\n", record.Path, group[keep-1].Path)
+				} else if i != keep-1 {
+					plan = append(plan, newPlanAction(action, record, group[keep-1].Path, header.Xattrs))
+				}
+			}
+			break
+		}
+	}
+
+	if len(plan) == 0 {
+		fmt.Println("\nNothing to do.")
+		return nil
+	}
+	if r.Script != "" {
+		return writeReviewScript(r.Script, plan)
+	}
+	if r.Plan != "" {
+		fmt.Println()
+		return writePlan(r.Plan, "review", r.Index, plan)
+	}
+
+	fmt.Println()
+	for _, action := range plan {
+		fmt.Printf("Will %s %s (duplicate of %s)\n", action.Action, action.Path, action.Target)
+	}
+	fmt.Printf("Carry out these %d actions? [y/N] ", len(plan))
+	line, _ := in.ReadString('\n')
+	if answer := strings.ToLower(strings.TrimSpace(line)); answer != "y" && answer != "yes" {
+		fmt.Println("Nothing done.")
+		return nil
+	}
+
+	var failed int
+	undo := newUndoLog(r.Index)
+	defer undo.Close()
+	for _, action := range plan {
+		if err := applyAction(action, r.remove); err != nil {
+			dupfind.Log.With("path", action.Path, "error", err).Warnf("Could not %s %s: %v", action.Action, action.Path, err)
+			failed++
+			continue
+		}
+		if err := undo.record(action); err != nil {
+			return fmt.Errorf("recording %s in the undo log: %w", action.Path, err)
+		}
+		fmt.Printf("%s %s (duplicate of %s)\n", r.done(action.Action), action.Path, action.Target)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d actions failed", failed, len(plan))
+	}
+
+	return nil
+}
+
+// writeReviewScript writes the actions as a shell script.
+func writeReviewScript(name string, plan []planAction) error {
+
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n# Written by dupfind review\nset -e\n")
+	for _, action := range plan {
+		// what is replaced, to restore it by hand
+		fmt.Fprintf(&b, "# %s: %d bytes, mode %v, modified %s\n",
+			action.Path, action.Size, action.Mode.Perm(), action.ModTime.UTC().Format(time.RFC3339))
+		if action.Action == "hardlink" {
+			fmt.Fprintf(&b, "ln -f -- %s %s\n", shellQuote(action.Target), shellQuote(action.Path))
+		} else {
+			fmt.Fprintf(&b, "rm -- %s\n", shellQuote(action.Path))
+		}
+	}
+	if err := os.WriteFile(name, []byte(b.String()), 0o755); err != nil {
+		return err
+	}
+	fmt.Printf("\nScript with %d actions written to %s.\n", len(plan), name)
+
+	return nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
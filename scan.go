@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"sort"
+)
+
+type ScanCmd struct {
+	Path        string `arg:"" name:"path" help:"Directory to scan." type:"path"`
+	Workers     int    `short:"j" help:"Number of parallel workers, 0 for one per CPU" default:"4"`
+	GroupKey    string `help:"Group files by checksum or size. Grouping by size does not read file contents." enum:"checksum,size" default:"checksum"`
+	Except      string `name:"except-index" help:"Ignore duplicate groups whose content also appears in this index." type:"path"`
+	IgnoreEmpty bool   `help:"Skip empty files, which all have the same content. Pass --no-ignore-empty to list them as a group." default:"true" negatable:""`
+
+	HashOptions   `embed:""`
+	WalkOptions   `embed:""`
+	IgnoreOptions `embed:""`
+}
+
+func (s *ScanCmd) Run(ctx *Context) error {
+
+	if s.IgnoreEmpty && s.MinSize == 0 {
+		s.MinSize = 1
+	}
+	walker, err := s.walker()
+	if err != nil {
+		return err
+	}
+	stats := newScanStats(ctx)
+
+	if s.GroupKey == "size" {
+		if s.IgnoreHashes != "" {
+			return fmt.Errorf("--ignore-hashes needs checksums and cannot be used with --group-key size")
+		}
+		sizes, err := collectFileSizes(s.Path, walker, stats)
+		if err != nil {
+			return err
+		}
+		printSizeGroups(sizes)
+		stats.Report()
+		return nil
+	}
+
+	hasher, err := s.hasher()
+	if err != nil {
+		return err
+	}
+
+	var except dupfind.Index = dupfind.NewMapIndex(dupfind.IndexHeader{}, nil)
+	if s.Except != "" {
+		if except, err = dupfind.LoadIndex(s.Except); err != nil {
+			return err
+		}
+	}
+	ignored, err := s.ignoredChecksums()
+	if err != nil {
+		return err
+	}
+
+	// only files sharing their size with another file can be duplicates
+	sizes, err := collectFileSizes(s.Path, walker, stats)
+	if err != nil {
+		return err
+	}
+
+	paths := make(chan string)
+	go func() {
+		defer close(paths)
+		for _, group := range sizes {
+			if len(group) < 2 {
+				stats.Skipped.Add(int64(len(group)))
+				continue
+			}
+			for _, path := range group {
+				paths <- path
+			}
+		}
+	}()
+	groups := groupRecords(dupfind.HashFilePaths(paths, s.Workers, hasher, nil, stats))
+	for key, records := range groups {
+		if len(except.Lookup(key)) > 0 || ignored.Has(records[0]) {
+			delete(groups, key)
+		}
+	}
+	if err := stats.Err(); err != nil {
+		return err
+	}
+	printGroups(groups)
+	stats.Report()
+
+	return nil
+}
+
+// collectFileSizes walks root and groups regular file paths by size,
+// without reading any file contents. Files that cannot be visited are
+// counted in stats, and the walk stops once the run is aborted.
+func collectFileSizes(root string, walker *dupfind.Walker, stats *dupfind.ScanStats) (map[int64][]string, error) {
+
+	sizes := make(map[int64][]string)
+	err := walker.Walk(root, stats, func(path string, info os.FileInfo) error {
+		if info.Mode().IsRegular() {
+			sizes[info.Size()] = append(sizes[info.Size()], path)
+		}
+		return nil
+	})
+	if err == nil {
+		err = stats.Err()
+	}
+
+	return sizes, err
+}
+
+// printSizeGroups lists the sizes shared by more than one file, largest
+// first, in the format of printGroups.
+func printSizeGroups(sizes map[int64][]string) {
+
+	var keys []int64
+	for size, paths := range sizes {
+		if len(paths) > 1 {
+			keys = append(keys, size)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] > keys[j] })
+
+	fmt.Println("Files of the same size are candidate duplicates only; same size does not imply same content.")
+
+	var files int
+	for _, size := range keys {
+		paths := sizes[size]
+		sort.Strings(paths)
+		fmt.Printf("%d bytes (%d files):\n", size, len(paths))
+		for _, path := range paths {
+			fmt.Printf("  %s\n", path)
+		}
+		files += len(paths)
+	}
+	fmt.Printf("%d same-size groups covering %d files\n", len(keys), files)
+}
+
+// groupRecords collects records by checksum, keeping only checksums shared
+// by more than one file.
+func groupRecords(metadata <-chan dupfind.Metadata) map[string][]dupfind.Metadata {
+
+	groups := make(map[string][]dupfind.Metadata)
+	for record := range metadata {
+		if dupfind.IsSpecial(record.Mode) {
+			continue
+		}
+		key := dupfind.ChecksumKey(record.Algorithm, record.Checksum)
+		groups[key] = append(groups[key], record)
+	}
+	for key, records := range groups {
+		if len(records) < 2 {
+			delete(groups, key)
+		}
+	}
+
+	return groups
+}
+
+func printGroups(groups map[string][]dupfind.Metadata) {
+
+	var keys []string
+	for key, records := range groups {
+		sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return groups[keys[i]][0].Path < groups[keys[j]][0].Path
+	})
+
+	var duplicates int
+	for _, key := range keys {
+		records := groups[key]
+		fmt.Printf("%s (%d files):\n", key, len(records))
+		for _, record := range records {
+			fmt.Printf("  %s\n", record.Path)
+		}
+		duplicates += len(records) - 1
+	}
+	fmt.Printf("%d duplicate groups, %d redundant files\n", len(keys), duplicates)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"jvkersch/dupfind/dupfind"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const defaultServeAddress = "localhost:8421"
+
+type ServeCmd struct {
+	Index   string `arg:"" optional:"" help:"Index file (default: the index set in the config file)." type:"path"`
+	Listen  string `help:"Address to listen on, host:port or unix:PATH for a Unix socket." default:"${serve_address}"`
+	Workers int    `short:"j" help:"Number of parallel workers for each find request, 0 for one per CPU" default:"4"`
+}
+
+// ClientOptions are the command line flags for talking to a server.
+type ClientOptions struct {
+	Server string `help:"Address of the dupfind server, host:port or unix:PATH." default:"${serve_address}"`
+}
+
+type LookupCmd struct {
+	Checksum  string `arg:"" help:"Checksum to look up."`
+	Algorithm string `help:"Algorithm the checksum was computed with (${enum})." enum:"sha256,sha1,blake3,xxhash64" default:"sha256"`
+
+	ClientOptions `embed:""`
+}
+
+type QueryCmd struct {
+	Path         string   `arg:"" name:"path" help:"File or directory to look up, as seen by the server." type:"path"`
+	Short        bool     `help:"For duplicate files, only print out path"`
+	OutputFormat string   `help:"Output format (${enum})." enum:"text,json,ndjson,csv" default:"text"`
+	Fields       []string `help:"Only output these fields of each match, such as path,index_path,size,mtime,mode." placeholder:"FIELD,..."`
+
+	ClientOptions `embed:""`
+}
+
+type ClientCmd struct {
+	Lookup LookupCmd `cmd:"" help:"Print the indexed files with a checksum"`
+	Find   QueryCmd  `cmd:"" help:"Look up the files below a path in the served index"`
+}
+
+// splitAddress splits an address given as host:port or unix:PATH into a
+// network and address for net.Listen and net.Dial.
+func splitAddress(address string) (string, string) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", address
+}
+
+func (s *ServeCmd) Run(ctx *Context) error {
+
+	var err error
+	if s.Index, err = ctx.indexFile(s.Index); err != nil {
+		return err
+	}
+
+	index, err := dupfind.LoadIndex(s.Index)
+	if err != nil {
+		return err
+	}
+	index = dupfind.RootIndex(index, "")
+	warnPartial(s.Index, index.Header())
+	algorithm := index.Header().Algorithm
+	if algorithm == "" {
+		algorithm = dupfind.DefaultAlgorithm
+	}
+	hasher, err := dupfind.NewHasher(algorithm, nil)
+	if err != nil {
+		return err
+	}
+	walker, err := dupfind.NewWalker(dupfind.WalkConfig{SkipSymlinks: true})
+	if err != nil {
+		return err
+	}
+
+	network, address := splitAddress(s.Listen)
+	if network == "unix" {
+		// remove a socket left behind by an earlier server
+		os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+
+	m := newMetrics()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	mux.HandleFunc("/lookup", m.timed("lookup", func(w http.ResponseWriter, r *http.Request) {
+		checksum := r.URL.Query().Get("checksum")
+		if checksum == "" {
+			http.Error(w, "missing checksum", http.StatusBadRequest)
+			return
+		}
+		records := index.Lookup(dupfind.ChecksumKey(r.URL.Query().Get("algorithm"), checksum))
+		if records == nil {
+			records = []dupfind.Metadata{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	}))
+	mux.HandleFunc("/find", m.timed("find", func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			http.Error(w, "missing path", http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		// matches are streamed as newline delimited JSON
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		stats := dupfind.NewScanStats(r.Context(), false)
+		paths := make(chan string)
+		go dupfind.ProduceFilePaths(path, paths, walker, stats)
+		metadata := dupfind.HashStatedFiles(dupfind.FilterBySize(paths, index.HasSize, hasher, stats), s.Workers, hasher, index, stats)
+		out := newMatchWriter("ndjson", w, false, nil)
+		matcher := &dupfind.Matcher{Index: index}
+		for record := range metadata {
+			if match, ok := matcher.Match(record); ok {
+				out.Write(match)
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+			}
+		}
+		m.addStats(stats)
+	}))
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	dupfind.Log.Infof("Serving %s on %s", s.Index, s.Listen)
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// get sends a request to the server and returns the response body.
+func (o *ClientOptions) get(ctx context.Context, endpoint string, query url.Values) (io.ReadCloser, error) {
+
+	network, address := splitAddress(o.Server)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		},
+	}
+	// the host is ignored when dialing, but must be valid for Unix sockets
+	host := address
+	if network == "unix" {
+		host = "dupfind"
+	}
+	u := url.URL{Scheme: "http", Host: host, Path: endpoint, RawQuery: query.Encode()}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("server: %s", strings.TrimSpace(string(msg)))
+	}
+
+	return resp.Body, nil
+}
+
+func (l *LookupCmd) Run(ctx *Context) error {
+
+	body, err := l.get(ctx, "/lookup", url.Values{"checksum": {l.Checksum}, "algorithm": {l.Algorithm}})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var records []dupfind.Metadata
+	if err := json.NewDecoder(body).Decode(&records); err != nil {
+		return err
+	}
+	for _, record := range records {
+		fmt.Println(record.Path)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("checksum %s is not in the index", l.Checksum)
+	}
+
+	return nil
+}
+
+func (q *QueryCmd) Run(ctx *Context) error {
+
+	if err := checkFields(q.Fields, matchFields); err != nil {
+		return err
+	}
+	body, err := q.get(ctx, "/find", url.Values{"path": {q.Path}})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	out := newMatchWriter(q.OutputFormat, os.Stdout, q.Short, q.Fields)
+	dec := json.NewDecoder(body)
+	for {
+		var match dupfind.Match
+		err := dec.Decode(&match)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := out.Write(match); err != nil {
+			return err
+		}
+	}
+
+	return out.Close()
+}
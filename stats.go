@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type StatsCmd struct {
+	Index   string `arg:"" optional:"" help:"Index file (default: the index set in the config file)." type:"path"`
+	Top     int    `help:"Number of duplicate groups and extensions to list" default:"10"`
+	Summary bool   `help:"Only print the totals stored in the index when it was written, without loading its records, which is fast and needs little memory for huge indexes."`
+}
+
+// extensionStats counts the files with one extension.
+type extensionStats struct {
+	name  string
+	files int
+	bytes int64
+}
+
+func (s *StatsCmd) Run(ctx *Context) error {
+
+	var err error
+	if s.Index, err = ctx.indexFile(s.Index); err != nil {
+		return err
+	}
+	if s.Summary {
+		return s.printSummary()
+	}
+	header, records, err := dupfind.ReadIndex(s.Index)
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string][]dupfind.Metadata)
+	extensions := make(map[string]*extensionStats)
+	var total, sparseSize, sparseAllocated int64
+	var sparse, unstable int
+	for _, record := range records {
+		total += record.Size
+		if record.Unstable {
+			unstable++
+		}
+		if record.Sparse {
+			sparse++
+			sparseSize += record.Size
+			sparseAllocated += record.Allocated
+		}
+		if !dupfind.IsSpecial(record.Mode) {
+			key := dupfind.ChecksumKey(record.Algorithm, record.Checksum)
+			groups[key] = append(groups[key], record)
+		}
+
+		ext := strings.ToLower(filepath.Ext(record.Path))
+		if ext == "" {
+			ext = "(none)"
+		}
+		if extensions[ext] == nil {
+			extensions[ext] = &extensionStats{name: ext}
+		}
+		extensions[ext].files++
+		extensions[ext].bytes += record.Size
+	}
+
+	duplicates := duplicateGroups(groups)
+	var duplicateFiles int
+	var duplicateBytes, wasted int64
+	for _, group := range duplicates {
+		duplicateFiles += len(group)
+		duplicateBytes += group[0].Size * int64(len(group))
+		wasted += wastedBytes(group)
+	}
+
+	printHeader(s.Index, header)
+	fmt.Printf("Files:              %d\n", len(records))
+	fmt.Printf("Total size:         %s\n", formatBytes(total))
+	if sparse > 0 {
+		fmt.Printf("Sparse files:       %d, taking %s on disk of %s\n", sparse, formatBytes(sparseAllocated), formatBytes(sparseSize))
+	}
+	if unstable > 0 {
+		fmt.Printf("Unstable files:     %d, changed while they were hashed\n", unstable)
+	}
+	fmt.Printf("Distinct checksums: %d\n", len(groups))
+	fmt.Printf("Duplicate groups:   %d, covering %d files and %s\n", len(duplicates), duplicateFiles, formatBytes(duplicateBytes))
+	fmt.Printf("Wasted space:       %s\n", formatBytes(wasted))
+
+	if len(duplicates) > 0 {
+		fmt.Println()
+		fmt.Println("Largest duplicate groups:")
+		for _, group := range duplicates[:minInt(s.Top, len(duplicates))] {
+			fmt.Printf("  %d files of %s\n", len(group), formatBytes(group[0].Size))
+			for _, record := range group {
+				fmt.Printf("    %s\n", record.Path)
+			}
+		}
+	}
+
+	var exts []*extensionStats
+	for _, ext := range extensions {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		if exts[i].bytes != exts[j].bytes {
+			return exts[i].bytes > exts[j].bytes
+		}
+		return exts[i].name < exts[j].name
+	})
+	if len(exts) > 0 {
+		fmt.Println()
+		fmt.Println("Extensions by size:")
+		for _, ext := range exts[:minInt(s.Top, len(exts))] {
+			fmt.Printf("  %-10s %8d files %12s\n", ext.name, ext.files, formatBytes(ext.bytes))
+		}
+		if len(exts) > s.Top {
+			fmt.Printf("  and %d more\n", len(exts)-s.Top)
+		}
+	}
+
+	return nil
+}
+
+// printSummary prints the header of the index and the summary of its
+// contents.
+func (s *StatsCmd) printSummary() error {
+
+	header, summary, err := dupfind.ReadIndexSummary(s.Index)
+	if err != nil {
+		return err
+	}
+	printHeader(s.Index, header)
+	fmt.Printf("Files:              %d\n", summary.Files)
+	fmt.Printf("Total size:         %s\n", formatBytes(summary.Bytes))
+	fmt.Printf("Distinct checksums: %d\n", summary.Checksums)
+	fmt.Printf("Duplicate groups:   %d, covering %d files and %s\n", summary.DuplicateGroups, summary.DuplicateFiles, formatBytes(summary.DuplicateBytes))
+	fmt.Printf("Wasted space:       %s\n", formatBytes(summary.Wasted))
+
+	return nil
+}
+
+func printHeader(index string, header dupfind.IndexHeader) {
+	fmt.Printf("Index:              %s\n", index)
+	if len(header.Roots) > 0 {
+		fmt.Printf("Roots:              %s\n", strings.Join(header.Roots, "\n                    "))
+	} else if header.Root != "" {
+		fmt.Printf("Root:               %s\n", header.Root)
+	}
+	if !header.Created.IsZero() {
+		fmt.Printf("Created:            %s\n", header.Created.Local().Format("2006-01-02 15:04:05"))
+	}
+	if header.Algorithm != "" {
+		fmt.Printf("Algorithm:          %s\n", header.Algorithm)
+	}
+	if len(header.HashFor) > 0 {
+		fmt.Printf("Hash rules:         %s\n", strings.Join(header.HashFor, ", "))
+	}
+	if header.Relative {
+		fmt.Println("Paths:              relative to the root")
+	}
+	switch header.Xattrs {
+	case dupfind.XattrsHash:
+		fmt.Println("Xattrs:             included in the checksums")
+	case dupfind.XattrsRecord:
+		fmt.Println("Xattrs:             recorded")
+	}
+	if header.Partial {
+		fmt.Println("Partial:            yes, the build was interrupted")
+	}
+}
+
+// duplicateGroups returns the groups of records with more than one file,
+// each sorted by path, with the groups wasting the most space first.
+func duplicateGroups(groups map[string][]dupfind.Metadata) [][]dupfind.Metadata {
+
+	var duplicates [][]dupfind.Metadata
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].Path < group[j].Path })
+		duplicates = append(duplicates, group)
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		wi, wj := wastedBytes(duplicates[i]), wastedBytes(duplicates[j])
+		if wi != wj {
+			return wi > wj
+		}
+		return duplicates[i][0].Path < duplicates[j][0].Path
+	})
+
+	return duplicates
+}
+
+// wastedBytes returns the space taken by all but one copy of a group.
+func wastedBytes(group []dupfind.Metadata) int64 {
+	return group[0].Size * int64(len(group)-1)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type TopCmd struct {
+	Index        string `arg:"" optional:"" help:"Index file (default: the index set in the config file)." type:"path"`
+	Count        int    `short:"n" help:"Number of files and directories to list." default:"10"`
+	Target       string `help:"Only list duplicated files below DIR, such as a disk to free up. Their copies may be anywhere in the index." placeholder:"DIR" type:"path"`
+	OutputFormat string `help:"Output format (${enum})." enum:"text,json" default:"text"`
+
+	IgnoreOptions `embed:""`
+}
+
+// topFile is a duplicated file as written by top, with the paths of its
+// other copies.
+type topFile struct {
+	Path   string   `json:"path"`
+	Size   int64    `json:"size"`
+	Copies []string `json:"copies"`
+}
+
+// topDir is a directory as written by top, with the size and number of
+// the duplicated files directly in it.
+type topDir struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+	Files int    `json:"files"`
+}
+
+func (t *TopCmd) Run(ctx *Context) error {
+
+	var err error
+	if t.Index, err = ctx.indexFile(t.Index); err != nil {
+		return err
+	}
+	header, records, err := dupfind.ReadIndex(t.Index)
+	if err != nil {
+		return err
+	}
+	warnPartial(t.Index, header)
+	records = dupfind.RootRecords(header, records, "")
+	ignored, err := t.ignoredChecksums()
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string][]dupfind.Metadata)
+	for _, record := range records {
+		if dupfind.IsSpecial(record.Mode) || ignored.Has(record) || record.Size == 0 {
+			continue
+		}
+		key := dupfind.ChecksumKey(record.Algorithm, record.Checksum)
+		groups[key] = append(groups[key], record)
+	}
+
+	var files []topFile
+	dirs := make(map[string]*topDir)
+	for _, group := range duplicateGroups(groups) {
+		for _, record := range group {
+			if _, ok := dupfind.CutPathPrefix(record.Path, t.Target); t.Target != "" && !ok {
+				continue
+			}
+			var copies []string
+			for _, other := range group {
+				if other.Path != record.Path {
+					copies = append(copies, other.Path)
+				}
+			}
+			files = append(files, topFile{Path: record.Path, Size: record.Size, Copies: copies})
+
+			dir := filepath.Dir(record.Path)
+			if dirs[dir] == nil {
+				dirs[dir] = &topDir{Path: dir}
+			}
+			dirs[dir].Bytes += record.Size
+			dirs[dir].Files++
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Size != files[j].Size {
+			return files[i].Size > files[j].Size
+		}
+		return files[i].Path < files[j].Path
+	})
+	var topDirs []topDir
+	for _, dir := range dirs {
+		topDirs = append(topDirs, *dir)
+	}
+	sort.Slice(topDirs, func(i, j int) bool {
+		if topDirs[i].Bytes != topDirs[j].Bytes {
+			return topDirs[i].Bytes > topDirs[j].Bytes
+		}
+		return topDirs[i].Path < topDirs[j].Path
+	})
+	files, topDirs = files[:minInt(t.Count, len(files))], topDirs[:minInt(t.Count, len(topDirs))]
+
+	if t.OutputFormat == "json" {
+		if files == nil {
+			files = []topFile{}
+		}
+		if topDirs == nil {
+			topDirs = []topDir{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Files []topFile `json:"files"`
+			Dirs  []topDir  `json:"dirs"`
+		}{files, topDirs})
+	}
+	fmt.Println("Largest duplicated files:")
+	for _, file := range files {
+		fmt.Printf("  %10s  %s (also %s", formatBytes(file.Size), file.Path, file.Copies[0])
+		if len(file.Copies) > 1 {
+			fmt.Printf(" and %d more", len(file.Copies)-1)
+		}
+		fmt.Println(")")
+	}
+	fmt.Println("Directories with the most duplicated bytes:")
+	for _, dir := range topDirs {
+		fmt.Printf("  %10s  %s (%d files)\n", formatBytes(dir.Bytes), dir.Path, dir.Files)
+	}
+
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// undoFile returns the name of the log of the files that dedupe, apply and
+// review replaced, kept next to index.
+func undoFile(index string) string {
+	return index + ".undo"
+}
+
+// undoEntry is an action carried out by the run started at Run, as
+// recorded in the undo log.
+type undoEntry struct {
+	Run time.Time `json:"run"`
+	planAction
+}
+
+// undoLog appends the actions of one run to the undo log of an index. The
+// log is only created once an action is recorded.
+type undoLog struct {
+	name string
+	run  time.Time
+	f    *os.File
+}
+
+func newUndoLog(index string) *undoLog {
+	return &undoLog{name: undoFile(index), run: time.Now().UTC()}
+}
+
+// record appends action to the log, synced to disk so that it survives
+// if the run does not.
+func (l *undoLog) record(action planAction) error {
+
+	if l.f == nil {
+		f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		l.f = f
+	}
+	data, err := json.Marshal(undoEntry{Run: l.run, planAction: action})
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return l.f.Sync()
+}
+
+func (l *undoLog) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// readUndoLog reads the entries of the undo log of index, oldest first.
+func readUndoLog(index string) ([]undoEntry, error) {
+
+	f, err := os.Open(undoFile(index))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []undoEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry undoEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s: invalid line %q", undoFile(index), scanner.Text())
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// writeUndoLog replaces the undo log of index with entries, removing it
+// if there are none.
+func writeUndoLog(index string, entries []undoEntry) error {
+
+	name := undoFile(index)
+	if len(entries) == 0 {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	var b strings.Builder
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		b.Write(data)
+		b.WriteByte('\n')
+	}
+
+	return os.WriteFile(name, []byte(b.String()), 0o644)
+}
+
+type UndoCmd struct {
+	Index  string `arg:"" optional:"" help:"Index file whose undo log to replay (default: the index set in the config file)." type:"path"`
+	All    bool   `help:"Undo all runs in the log, newest first, instead of only the last one."`
+	DryRun bool   `short:"n" help:"Only print what would be done"`
+	Force  bool   `short:"f" help:"Restore files from the kept copy even if its content changed since."`
+}
+
+func (u *UndoCmd) Run(ctx *Context) error {
+
+	var err error
+	if u.Index, err = ctx.indexFile(u.Index); err != nil {
+		return err
+	}
+	entries, err := readUndoLog(u.Index)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("Nothing to undo.")
+		return nil
+	}
+
+	// the last run is undone first, and its last action first
+	last := entries[len(entries)-1].Run
+	var kept []undoEntry
+	undone := make(map[int]bool)
+	var failed int
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if !u.All && !entry.Run.Equal(last) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			break
+		}
+		if u.DryRun {
+			fmt.Printf("Would restore %s from %s\n", entry.Path, entry.Target)
+			continue
+		}
+		if err := undoAction(entry.planAction, u.Force); err != nil {
+			dupfind.Log.With("path", entry.Path, "error", err).Warnf("Could not restore %s: %v", entry.Path, err)
+			failed++
+			continue
+		}
+		undone[i] = true
+		if entry.Action == "reflink" {
+			fmt.Printf("Kept %s, it is a copy of its own already\n", entry.Path)
+		} else {
+			fmt.Printf("Restored %s (copied from %s)\n", entry.Path, entry.Target)
+		}
+	}
+	if u.DryRun {
+		return nil
+	}
+
+	// actions that could not be undone stay in the log
+	for i, entry := range entries {
+		if !undone[i] {
+			kept = append(kept, entry)
+		}
+	}
+	if err := writeUndoLog(u.Index, kept); err != nil {
+		return fmt.Errorf("updating the undo log: %w", err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be restored", failed)
+	}
+
+	return ctx.Err()
+}
+
+// undoAction makes Path a copy of its own of Target again, unless it was
+// changed since action was carried out. Reflinked files are copies of
+// their own already.
+func undoAction(action planAction, force bool) error {
+
+	switch action.Action {
+	case "reflink":
+		return nil
+	case "hardlink":
+		if !sameFile(action.Path, action.Target) {
+			return fmt.Errorf("it is no longer a hardlink to %s", action.Target)
+		}
+	case "symlink":
+		if target, err := os.Readlink(action.Path); err != nil || target != action.Target {
+			return fmt.Errorf("it is no longer a symlink to %s", action.Target)
+		}
+	case "delete":
+		if _, err := os.Lstat(action.Path); err == nil {
+			return errors.New("it exists again")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", action.Action)
+	}
+
+	return restoreCopy(action, force)
+}
+
+// restoreCopy copies Target to Path, with the mode, owner and modification
+// time Path had. The copy is written under a temporary name and renamed
+// over Path once its content is known to be that of the file replaced,
+// hashed as it was when the action was carried out.
+func restoreCopy(action planAction, force bool) error {
+
+	algorithm, checksum, ok := strings.Cut(action.Checksum, ":")
+	if !ok {
+		algorithm, checksum = dupfind.DefaultAlgorithm, action.Checksum
+	}
+	newHash, ok := dupfind.HashAlgorithms[algorithm]
+	if !ok {
+		return fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+
+	in, err := os.Open(action.Target)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := filepath.Join(filepath.Dir(action.Path), fmt.Sprintf(".%s.dupfind-tmp", filepath.Base(action.Path)))
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	h := newHash()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	if err == nil && action.Xattrs == dupfind.XattrsHash {
+		sum, err = dupfind.XattrsChecksum(action.Target, sum, algorithm)
+	}
+	if err == nil && checksum != "" && sum != checksum && !force {
+		err = fmt.Errorf("%s changed since, pass --force to restore it anyway", action.Target)
+	}
+
+	mode := action.Mode.Perm()
+	if info, serr := in.Stat(); serr == nil && action.Mode == 0 {
+		mode = info.Mode().Perm()
+	}
+	if err == nil {
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil && !action.ModTime.IsZero() {
+		err = os.Chtimes(tmp, time.Now(), action.ModTime)
+	}
+	if err == nil && action.Owned {
+		// only root may give files away
+		os.Lchown(tmp, int(action.UID), int(action.GID))
+	}
+	if err == nil {
+		err = os.Rename(tmp, action.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
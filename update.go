@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"sync"
+)
+
+type UpdateCmd struct {
+	Path       string `arg:"" name:"path" help:"Directory to index." type:"path"`
+	Index      string `arg:"" optional:"" help:"Index file to update (default: the index set in the config file)." type:"path"`
+	Workers    int    `short:"j" help:"Number of parallel workers, 0 for one per CPU" default:"4"`
+	Archives   bool   `help:"Also index the files inside zip and tar archives, as ARCHIVE!MEMBER."`
+	Streams    bool   `help:"On Windows, also index the NTFS alternate data streams of files, as FILE:STREAM."`
+	Perceptual bool   `help:"Also store perceptual hashes of JPEG, PNG and GIF images, computing them for indexed images that lack one."`
+	Chunks     bool   `help:"Also store the hashes of content-defined chunks of each file, computing them for indexed files that lack them (experimental)."`
+	Sort       bool   `help:"Write records sorted by path, so that identical trees give identical indexes."`
+	Sparse     bool   `help:"Also record the space that sparse files take on disk for the files re-hashed."`
+	Bloom      bool   `help:"Also write a Bloom filter of the index to INDEX.bloom, so that find can skip files that are not indexed without loading the index. Later writes keep it up to date."`
+	History    bool   `help:"Keep the history of the index in INDEX.history, recording a snapshot whenever it is written, for the history command."`
+
+	HashOptions `embed:""`
+	WalkOptions `embed:""`
+	SignOptions `embed:""`
+}
+
+// unchanged reports whether record still describes the file with the
+// given info, so that its checksum can be reused. Files that changed while
+// they were hashed are always hashed again.
+func unchanged(record dupfind.Metadata, info os.FileInfo, algorithm string) bool {
+	return !record.Unstable && dupfind.RecordAlgorithm(record) == algorithm &&
+		record.Size == info.Size() &&
+		record.ModTime.Equal(info.ModTime())
+}
+
+func underRoot(path, root string) bool {
+	_, ok := dupfind.CutPathPrefix(path, root)
+	return ok
+}
+
+func (u *UpdateCmd) Run(ctx *Context) error {
+
+	var err error
+	if u.Index, err = ctx.indexFile(u.Index); err != nil {
+		return err
+	}
+
+	walker, err := u.walker()
+	if err != nil {
+		return err
+	}
+	key, err := u.signingKey()
+	if err != nil {
+		return err
+	}
+
+	if u.History {
+		if err := startHistory(u.Index); err != nil {
+			return fmt.Errorf("starting the history of %s: %w", u.Index, err)
+		}
+	}
+	header, records, err := dupfind.ReadIndex(u.Index)
+	if err != nil {
+		return err
+	}
+	records = dupfind.RootRecords(header, records, "")
+	u.indexRules(header)
+	hasher, err := u.hasher()
+	if err != nil {
+		return err
+	}
+	hasher.Archives = u.Archives
+	hasher.Streams = u.Streams
+	hasher.Perceptual = u.Perceptual
+	hasher.Chunks = u.Chunks
+	hasher.Sparse = u.Sparse
+	// unchanged files keep their checksums, so all must be hashed alike
+	if u.Xattrs == "" {
+		hasher.Xattrs = header.Xattrs
+	} else if u.Xattrs != orIgnore(header.Xattrs) {
+		return fmt.Errorf("%s was built with --xattrs=%s, build it again to change that", u.Index, orIgnore(header.Xattrs))
+	}
+	old := make(map[string]dupfind.Metadata)
+	members := make(map[string][]dupfind.Metadata)
+	for _, record := range records {
+		old[dupfind.PathKey(record.Path)] = record
+		if file, ok := dupfind.Container(record.Path); ok {
+			key := dupfind.PathKey(file)
+			members[key] = append(members[key], record)
+		}
+	}
+
+	stats := newScanStats(ctx)
+	paths := make(chan string)
+	go dupfind.ProduceFilePaths(u.Path, paths, walker, stats)
+
+	// split walked paths into unchanged records and files to re-hash
+	stale := make(chan string)
+	kept := make(chan dupfind.Metadata)
+	var reused, rehashed, removed int
+	go func() {
+		defer close(stale)
+		defer close(kept)
+
+		seen := make(map[string]bool)
+		for path := range paths {
+			key := dupfind.PathKey(path)
+			seen[key] = true
+			record, ok := old[key]
+			if ok {
+				info, err := os.Stat(path)
+				missing := u.Perceptual && record.Perceptual == "" && dupfind.IsImage(path) ||
+					u.Chunks && len(record.Chunks) == 0 && record.Size > 0
+				if err == nil && unchanged(record, info, hasher.AlgorithmFor(path)) && !missing {
+					reused++
+					kept <- record
+					// the members of an unchanged archive, and the streams
+					// of an unchanged file, are unchanged too
+					for _, member := range members[key] {
+						if hasher.IndexesMember(member.Path) {
+							seen[dupfind.PathKey(member.Path)] = true
+							reused++
+							kept <- member
+						}
+					}
+					continue
+				}
+			}
+			rehashed++
+			stale <- path
+		}
+
+		// keep entries outside the updated tree as long as they exist
+		for key, record := range old {
+			if seen[key] {
+				continue
+			}
+			file := record.Path
+			if container, ok := dupfind.Container(record.Path); ok {
+				file = container
+			}
+			if _, err := os.Stat(file); err == nil && !underRoot(file, u.Path) {
+				kept <- record
+				continue
+			}
+			removed++
+		}
+	}()
+
+	hashed := dupfind.HashFilePaths(stale, u.Workers, hasher, nil, stats)
+	updated := dupfind.NewIndexHeader(u.Path, hasher.Algorithm())
+	updated.Relative = header.Relative
+	updated.Xattrs = header.Xattrs
+	updated.HashFor = hasher.Rules()
+	if !header.Created.IsZero() {
+		updated.Created = header.Created
+	}
+	if len(header.Roots) > 0 {
+		// updating one of several roots keeps the others
+		updated.Root, updated.Roots = header.Root, header.Roots
+		if dupfind.RecordRoot(header.Roots, u.Path) == "" {
+			updated.Roots = append(updated.Roots, u.Path)
+		}
+		hashed = dupfind.TagRoots(hashed, updated.Roots)
+	}
+	// an interrupted update leaves the index as it was
+	metadata := mergeMetadata(kept, hashed)
+	if u.Sort {
+		metadata = sortMetadata(metadata)
+	}
+	if err := writeIndex(metadata, dupfind.OpenStore(u.Index), u.Index, updated, key, stats, false); err != nil {
+		return err
+	}
+	if u.Bloom {
+		if err := writeBloomFilter(u.Index); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Reused %d, re-hashed %d, removed %d entries.\n", reused, rehashed, removed)
+	stats.Report()
+
+	return nil
+}
+
+// mergeMetadata combines several metadata channels into one, which is
+// closed once all inputs are drained.
+func mergeMetadata(inputs ...<-chan dupfind.Metadata) <-chan dupfind.Metadata {
+
+	out := make(chan dupfind.Metadata)
+
+	var wg sync.WaitGroup
+	for _, in := range inputs {
+		wg.Add(1)
+		go func(in <-chan dupfind.Metadata) {
+			defer wg.Done()
+			for record := range in {
+				out <- record
+			}
+		}(in)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
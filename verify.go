@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"jvkersch/dupfind/dupfind"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type VerifyCmd struct {
+	Index       string     `arg:"" help:"Index file." type:"path"`
+	Path        string     `arg:"" optional:"" name:"path" help:"Directory to check for new files (default: the indexed directory)." type:"path"`
+	Workers     int        `short:"j" help:"Number of parallel workers, 0 for one per CPU" default:"4"`
+	Fields      []string   `help:"Fields to print for each reported file (${fields})." placeholder:"FIELD,..." default:"path"`
+	Root        string     `help:"Look for the indexed files below DIR instead of the directory the index was built from." placeholder:"DIR" type:"path"`
+	Key         string     `name:"verify-key" help:"Check the signature of the index with the ed25519 public key in FILE first, and fail if the index was changed after it was signed." placeholder:"FILE" type:"path"`
+	Sample      percentage `help:"Only re-hash PERCENT of the indexed files, such as 5%, choosing those verified least recently, so that successive runs cover the whole index." placeholder:"PERCENT"`
+	SampleBytes byteSize   `help:"Only re-hash files of about SIZE in total, such as 100G, choosing those verified least recently." placeholder:"SIZE"`
+
+	WalkOptions     `embed:""`
+	ThrottleOptions `embed:""`
+	NotifyOptions   `embed:""`
+}
+
+func (v *VerifyCmd) Run(ctx *Context) error {
+
+	if err := v.checkNotify(); err != nil {
+		return err
+	}
+	summary := runSummary{Command: "verify", Index: v.Index}
+	err := v.verify(ctx, &summary)
+	v.notify(summary, false, err)
+	return err
+}
+
+// verify checks the indexed files and adds the outcome to summary.
+func (v *VerifyCmd) verify(ctx *Context, summary *runSummary) error {
+
+	if err := checkFields(v.Fields, recordFields); err != nil {
+		return err
+	}
+	walker, err := v.walker()
+	if err != nil {
+		return err
+	}
+
+	if v.Key != "" {
+		key, err := dupfind.ReadPublicKey(v.Key)
+		if err != nil {
+			return err
+		}
+		if err := dupfind.VerifyIndex(v.Index, key); err != nil {
+			return fmt.Errorf("%s: %w", v.Index, err)
+		}
+		fmt.Printf("Signature of %s is valid.\n", v.Index)
+	}
+
+	header, records, err := dupfind.ReadIndex(v.Index)
+	if err != nil {
+		return err
+	}
+	warnPartial(v.Index, header)
+	records = dupfind.RootRecords(header, records, v.Root)
+	header = dupfind.RootHeader(header, v.Root)
+	indexed := make(map[string]dupfind.Metadata)
+	for _, record := range records {
+		indexed[dupfind.PathKey(record.Path)] = record
+	}
+
+	// samples take the files verified least recently, all files are
+	// still checked for being missing
+	verified, err := dupfind.ReadVerifyLog(v.Index)
+	if err != nil {
+		return err
+	}
+	var sampled map[string]bool
+	if v.Sample > 0 || v.SampleBytes > 0 {
+		count := len(records)
+		if v.Sample > 0 {
+			count = int(math.Ceil(float64(v.Sample) * float64(len(records))))
+		}
+		sampled = make(map[string]bool)
+		for _, record := range verified.Sample(records, count, int64(v.SampleBytes)) {
+			sampled[dupfind.PathKey(record.Path)] = true
+		}
+	}
+
+	var missing, changed, added []dupfind.Metadata
+	notes := make(map[string]string)
+	stats := newScanStats(ctx)
+	paths := make(chan string)
+	go func() {
+		defer close(paths)
+		for _, record := range records {
+			if _, err := os.Stat(record.Path); errors.Is(err, fs.ErrNotExist) {
+				missing = append(missing, record)
+				continue
+			}
+			if sampled == nil || sampled[dupfind.PathKey(record.Path)] {
+				paths <- record.Path
+			}
+		}
+	}()
+
+	// missing is complete once all paths are hashed
+	hasher := dupfind.NewRecordHasher(records)
+	hasher.Xattrs = header.Xattrs
+	v.throttle(hasher)
+	now := time.Now()
+	checked := make(map[string]bool)
+	for record := range dupfind.HashFilePaths(paths, v.Workers, hasher, nil, stats) {
+		checked[record.Path] = true
+		old := indexed[dupfind.PathKey(record.Path)]
+		if record.Checksum == old.Checksum {
+			continue
+		}
+		if !old.ModTime.IsZero() && record.ModTime.Equal(old.ModTime) && record.Size == old.Size {
+			notes[record.Path] = " (unchanged size and modification time, possible corruption)"
+		}
+		changed = append(changed, record)
+	}
+	// the log is kept once a sample was taken, also of interrupted runs
+	if sampled != nil || len(verified) > 0 {
+		if err := writeVerifyLog(v.Index, verified, records, checked, now); err != nil {
+			return fmt.Errorf("recording verified files: %w", err)
+		}
+	}
+	if err := stats.Err(); err != nil {
+		return err
+	}
+
+	roots := []string{v.Path}
+	if v.Path == "" {
+		roots = header.AllRoots()
+	}
+	for _, root := range roots {
+		err := walker.Walk(root, stats, func(path string, info os.FileInfo) error {
+			if _, ok := indexed[dupfind.PathKey(path)]; !ok && !dupfind.IsIndexFile(v.Index, path) {
+				added = append(added, dupfind.Metadata{Path: path, Size: info.Size(), ModTime: info.ModTime(), Mode: info.Mode()})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, group := range []struct {
+		label   string
+		records []dupfind.Metadata
+	}{{"CHANGED", changed}, {"MISSING", missing}, {"NEW", added}} {
+		sort.Slice(group.records, func(i, j int) bool { return group.records[i].Path < group.records[j].Path })
+		for _, record := range group.records {
+			values := make([]string, len(v.Fields))
+			for i, field := range v.Fields {
+				values[i] = formatField(recordFields[field](record))
+			}
+			fmt.Printf("%-8s %s%s\n", group.label, strings.Join(values, "\t"), notes[record.Path])
+		}
+	}
+	files := fmt.Sprintf("%d files", len(records))
+	if sampled != nil {
+		files = fmt.Sprintf("a sample of %d of %d files", len(checked), len(records))
+	}
+	summary.Summary = fmt.Sprintf("Verified %s: %d changed, %d missing, %d new.",
+		files, len(changed), len(missing), len(added))
+	if len(notes) > 0 {
+		summary.Summary += fmt.Sprintf(" %d of the changed files may be corrupt, as their size and modification time did not change.", len(notes))
+	}
+	summary.Counts = map[string]int64{"files": int64(len(records)), "changed": int64(len(changed)), "missing": int64(len(missing)),
+		"new": int64(len(added)), "corrupt": int64(len(notes)), "errors": stats.Failed.Load()}
+	if sampled != nil {
+		summary.Counts["sampled"] = int64(len(checked))
+	}
+	fmt.Printf("Verified %s: %d changed, %d missing, %d new.\n",
+		files, len(changed), len(missing), len(added))
+	stats.Report()
+
+	if len(changed) > 0 || len(missing) > 0 {
+		return fmt.Errorf("verification failed")
+	}
+	return stats.Err()
+}
+
+// writeVerifyLog records that the checked files were verified at now,
+// keeping the entries of the other records and dropping those of files
+// that are no longer indexed.
+func writeVerifyLog(index string, verified dupfind.VerifyLog, records []dupfind.Metadata, checked map[string]bool, now time.Time) error {
+
+	log := make(dupfind.VerifyLog)
+	for _, record := range records {
+		if checked[record.Path] {
+			log[record.Path] = now
+		} else if when, ok := verified[record.Path]; ok {
+			log[record.Path] = when
+		}
+	}
+
+	return log.Write(index)
+}
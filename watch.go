@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"io/fs"
+	"jvkersch/dupfind/dupfind"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type WatchCmd struct {
+	Path    string        `arg:"" name:"path" help:"Directory to watch." type:"path"`
+	Index   string        `arg:"" optional:"" help:"Index file to keep up to date (default: the index set in the config file). It is built first if it does not exist." type:"path"`
+	Workers int           `short:"j" help:"Number of parallel workers, 0 for one per CPU" default:"4"`
+	Delay   time.Duration `help:"Update the index once no files have changed for this long." default:"2s"`
+	Metrics string        `name:"metrics-listen" help:"Serve Prometheus metrics at /metrics on ADDRESS, host:port or unix:PATH." placeholder:"ADDRESS"`
+
+	HashOptions `embed:""`
+	WalkOptions `embed:""`
+	SignOptions `embed:""`
+}
+
+func (w *WatchCmd) Run(ctx *Context) error {
+
+	var err error
+	if w.Index, err = ctx.indexFile(w.Index); err != nil {
+		return err
+	}
+
+	walker, err := w.walker()
+	if err != nil {
+		return err
+	}
+	filter, err := walker.Filter(w.Path)
+	if err != nil {
+		return err
+	}
+	key, err := w.signingKey()
+	if err != nil {
+		return err
+	}
+	if w.RespectGitignore {
+		dupfind.Log.Warnf("Warning: changes to files ignored by git are indexed while watching")
+	}
+
+	// bring the index up to date before watching for changes
+	if _, err := os.Stat(w.Index); errors.Is(err, fs.ErrNotExist) {
+		build := &BuildCmd{Path: w.Path, Index: w.Index, Workers: w.Workers, HashOptions: w.HashOptions, WalkOptions: w.WalkOptions, SignOptions: w.SignOptions}
+		err = build.Run(ctx)
+	} else {
+		update := &UpdateCmd{Path: w.Path, Index: w.Index, Workers: w.Workers, HashOptions: w.HashOptions, WalkOptions: w.WalkOptions, SignOptions: w.SignOptions}
+		err = update.Run(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	header, records, err := dupfind.ReadIndex(w.Index)
+	if err != nil {
+		return err
+	}
+	records = dupfind.RootRecords(header, records, "")
+	w.indexRules(header)
+	hasher, err := w.hasher()
+	if err != nil {
+		return err
+	}
+	indexed := make(map[string]dupfind.Metadata)
+	for _, record := range records {
+		indexed[dupfind.PathKey(record.Path)] = record
+	}
+	m := newMetrics()
+	m.indexRecords.Store(int64(len(indexed)))
+	m.pending.Store(0)
+	if w.Metrics != "" {
+		if err := serveMetrics(ctx, w.Metrics, m); err != nil {
+			return err
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watchTree(watcher, w.Path, filter, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Watching %s for changes.\n", w.Path)
+
+	pending := make(map[string]bool)
+	timer := time.NewTimer(w.Delay)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			dupfind.Log.Errorf("Error watching files: %v", err)
+		case event := <-watcher.Events:
+			if dupfind.IsIndexFile(w.Index, event.Name) {
+				continue
+			}
+			// files moved into the tree with a new directory raise no events
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchTree(watcher, event.Name, filter, pending); err != nil {
+						dupfind.Log.With("path", event.Name, "error", err).Warnf("Could not watch %s: %v", event.Name, err)
+					}
+				}
+			}
+			pending[event.Name] = true
+			m.pending.Store(int64(len(pending)))
+			timer.Reset(w.Delay)
+		case <-timer.C:
+			if err := w.apply(ctx, pending, indexed, header, hasher, key, filter, m); err != nil {
+				return err
+			}
+			pending = make(map[string]bool)
+			m.pending.Store(0)
+		}
+	}
+}
+
+// watchTree watches dir and the directories below it that pass filter.
+// If pending is not nil, the files found are added to it.
+func watchTree(watcher *fsnotify.Watcher, dir string, filter func(string, os.FileInfo) bool, pending map[string]bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the file vanished or cannot be read, it is not indexed either
+			return nil
+		}
+		if !filter(path, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		if pending != nil {
+			pending[path] = true
+		}
+		return nil
+	})
+}
+
+// apply re-hashes the changed files in pending, drops the records of
+// removed files and writes the updated index.
+func (w *WatchCmd) apply(ctx *Context, pending map[string]bool, indexed map[string]dupfind.Metadata,
+	header dupfind.IndexHeader, hasher *dupfind.Hasher, key ed25519.PrivateKey, filter func(string, os.FileInfo) bool, m *metrics) error {
+
+	var stale []string
+	var removed int
+	for path := range pending {
+		info, err := os.Lstat(path)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 && !w.SkipSymlinks {
+			info, err = os.Stat(path)
+		}
+		switch {
+		case err != nil || info.Mode()&os.ModeSymlink != 0 || !filter(path, info):
+			removed += forget(indexed, path)
+		case info.IsDir():
+			// its files were queued when it was created
+		default:
+			delete(indexed, dupfind.PathKey(path))
+			stale = append(stale, path)
+		}
+	}
+
+	stats := newScanStats(ctx)
+	paths := make(chan string)
+	go func() {
+		defer close(paths)
+		for _, path := range stale {
+			paths <- path
+		}
+	}()
+	var rehashed int
+	for record := range dupfind.HashFilePaths(paths, w.Workers, hasher, nil, stats) {
+		indexed[dupfind.PathKey(record.Path)] = record
+		rehashed++
+	}
+	m.addStats(stats)
+	if err := stats.Err(); err != nil {
+		return err
+	}
+	if rehashed == 0 && removed == 0 {
+		return nil
+	}
+
+	records := make([]dupfind.Metadata, 0, len(indexed))
+	for _, record := range indexed {
+		record.Path = dupfind.RelativePath(header, record.Path)
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+	header.Partial = false
+	if err := dupfind.OpenStore(w.Index).Write(header, records); err != nil {
+		return fmt.Errorf("writing index %s: %w", w.Index, err)
+	}
+	if err := finishIndex(w.Index, key); err != nil {
+		return err
+	}
+	m.indexWrites.Add(1)
+	m.indexRecords.Store(int64(len(records)))
+
+	fmt.Printf("%s: re-hashed %d, removed %d entries.\n", time.Now().Format("15:04:05"), rehashed, removed)
+	stats.Report()
+
+	return nil
+}
+
+// forget drops the records of path and of the files below it, and returns
+// how many were dropped.
+func forget(indexed map[string]dupfind.Metadata, path string) int {
+	var n int
+	for key, record := range indexed {
+		if underRoot(record.Path, path) {
+			delete(indexed, key)
+			n++
+		}
+	}
+	return n
+}